@@ -89,5 +89,5 @@ func (sa *ShardAccessor) Close() error {
 	sa.lk.Unlock()
 
 	tsk := &task{op: OpShardRelease, shard: sa.shard}
-	return sa.shard.d.queueTask(tsk, sa.shard.d.externalCh)
+	return sa.shard.d.queueTask(tsk, sa.shard.loop.externalCh)
 }
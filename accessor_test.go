@@ -160,9 +160,9 @@ func checkMmapped(t *testing.T, expect bool, name string) {
 func createAccessor(t *testing.T, mnt mount.Mount) *ShardAccessor {
 	dummyShard := &Shard{
 		d: &DAGStore{
-			ctx:        context.Background(),
-			externalCh: make(chan *task, 64),
+			ctx: context.Background(),
 		},
+		loop: &eventLoop{externalCh: make(chan *task, 64)},
 	}
 
 	reader, err := mnt.Fetch(context.Background())
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	mh "github.com/multiformats/go-multihash"
 
@@ -16,6 +17,7 @@ import (
 	"github.com/ipfs/go-datastore/query"
 	dssync "github.com/ipfs/go-datastore/sync"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/filecoin-project/dagstore/index"
 	"github.com/filecoin-project/dagstore/mount"
@@ -47,6 +49,22 @@ const (
 	RecoverNow
 )
 
+// RestorePolicy specifies how persisted shards that can't be restored are
+// handled on DAGStore start.
+type RestorePolicy int
+
+const (
+	// RestoreLenient loads shards whose mount can't be restored (e.g. because
+	// its scheme is no longer registered) in ShardStateErrored, with an error
+	// wrapping ErrMountUnrestorable, so that they can be fixed or destroyed.
+	// Records that can't be parsed at all are quarantined; see
+	// DAGStore.QuarantinedShards.
+	RestoreLenient RestorePolicy = iota
+
+	// RestoreStrict fails to start if any persisted shard can't be restored.
+	RestoreStrict
+)
+
 var log = logging.Logger("dagstore")
 
 var (
@@ -63,28 +81,40 @@ var (
 	// ErrShardInUse is returned when the user attempts to destroy a shard that
 	// is in use.
 	ErrShardInUse = errors.New("shard in use")
+
+	// ErrMountUnrestorable is the error of shards whose mount couldn't be
+	// restored on start.
+	ErrMountUnrestorable = errors.New("mount could not be restored")
+
+	// ErrDAGStoreClosed is returned when attempting to use a DAG store that
+	// has been closed, or is shutting down. It's also delivered to the
+	// operations that are still waiting for a result when it closes.
+	ErrDAGStoreClosed = errors.New("dag store closed")
 )
 
 // DAGStore is the central object of the DAG store.
 type DAGStore struct {
-	lk      sync.RWMutex
-	mounts  *mount.Registry
-	shards  map[shard.Key]*Shard
-	config  Config
-	indices index.FullIndexRepo
-	store   ds.Datastore
+	// opSeq is the last allocated OpID; accessed atomically, and kept first
+	// for 64-bit alignment.
+	opSeq uint64
+
+	lk          sync.RWMutex
+	mounts      *mount.Registry
+	shards      map[shard.Key]*Shard
+	quarantined []QuarantinedShard // persisted records that couldn't be parsed on start.
+	config      Config
+	indices     index.FullIndexRepo
+	manifests   index.ManifestRepo
+	store       ds.Datastore
 
 	// TopLevelIndex is the top level (cid -> []shards) index that maps a cid to all the shards that is present in.
 	TopLevelIndex index.Inverted
 
+	// loops are the event loops shards are partitioned across.
+	loops []*eventLoop
+
 	// Channels owned by us.
 	//
-	// externalCh receives external tasks.
-	externalCh chan *task
-	// internalCh receives internal tasks to the event loop.
-	internalCh chan *task
-	// completionCh receives tasks queued up as a result of async completions.
-	completionCh chan *task
 	// dispatchResultsCh is a buffered channel for dispatching results back to
 	// the application. Serviced by a dispatcher goroutine.
 	// Note: This pattern decouples the event loop from the application, so a
@@ -94,8 +124,34 @@ type DAGStore struct {
 	// back to the application. Serviced by a dispatcher goroutine.
 	// See note in dispatchResultsCh for background.
 	dispatchFailuresCh chan *dispatch
-	// gcCh is where requests for GC are sent.
-	gcCh chan chan *GCResult
+	// gcCh is where requests for GC are sent. Serviced by the reclaim loop.
+	gcCh chan *gcRequest
+	// evictCh is where requests to evict transients to enforce the
+	// transients quota are sent. Serviced by the reclaim loop.
+	evictCh chan struct{}
+
+	// quota enforces the transients quota; nil if disabled.
+	quota *transientsQuota
+
+	// state buffers the shard records to persist.
+	state *stateWriter
+
+	// metrics are always collected, but only exposed if a registerer is
+	// provided.
+	metrics *metrics
+
+	// subs are the trace subscriptions.
+	subsLk sync.RWMutex
+	subs   map[*Subscription]struct{}
+
+	// closing is set once the DAG store stops accepting operations.
+	closeLk   sync.RWMutex
+	closing   bool
+	started   bool
+	closeOnce sync.Once
+	// pending tracks the outstanding work, so that Shutdown can wait for the
+	// DAG store to become idle.
+	pending pendingWork
 
 	// Channels not owned by us.
 	//
@@ -104,16 +160,24 @@ type DAGStore struct {
 	// failureCh is where shard failures will be notified, if non-nil.
 	failureCh chan<- ShardResult
 
-	// Throttling.
+	// Throttling. The throttlers below wrap the limiters, which can be
+	// resized through UpdateLimits.
 	//
+	limiters            limiters
 	throttleReaadyFetch throttle.Throttler
 	throttleIndex       throttle.Throttler
+	weighReadyFetch     throttle.WeightedThrottler
+	weighIndex          throttle.WeightedThrottler
+	fetchBandwidth      *throttle.TokenBucket // nil if unlimited.
 
 	// Lifecycle.
 	//
 	ctx      context.Context
 	cancelFn context.CancelFunc
 	wg       sync.WaitGroup
+	// asyncWg tracks the operations running asynchronously on behalf of the
+	// event loops, which close waits for before touching the shards.
+	asyncWg sync.WaitGroup
 }
 
 var _ Interface = (*DAGStore)(nil)
@@ -121,14 +185,22 @@ var _ Interface = (*DAGStore)(nil)
 type dispatch struct {
 	w   *waiter
 	res *ShardResult
+
+	// flushed is closed by the dispatcher upon reaching this dispatch,
+	// instead of delivering a result.
+	flushed chan struct{}
 }
 
 // Task represents an operation to be performed on a shard or the DAG store.
 type task struct {
 	*waiter
-	op    OpType
-	shard *Shard
-	err   error
+	op     OpType
+	shard  *Shard
+	err    error
+	id     OpID      // the operation this task belongs to, if any.
+	queued time.Time // when the task was queued; drives task latency metrics.
+	// attempt is the number of the failed attempt, for OpShardRetry.
+	attempt int
 }
 
 // ShardResult encapsulates a result from an asynchronous operation.
@@ -136,6 +208,39 @@ type ShardResult struct {
 	Key      shard.Key
 	Error    error
 	Accessor *ShardAccessor
+
+	// OpID identifies the operation that produced this result. For shard
+	// failures, it identifies the operation that caused the failure, if any.
+	OpID OpID
+	// Queued is the time the operation was submitted, Started the time the
+	// event loop started processing it, and Finished the time this result
+	// was produced. They are zero for shard failures.
+	Queued   time.Time
+	Started  time.Time
+	Finished time.Time
+
+	// Destroyed is populated in the results of DestroyShard operations, and
+	// reports which artefacts belonging to the shard were removed.
+	Destroyed *DestroyResult
+}
+
+// DestroyResult reports the artefacts that were removed when destroying a
+// shard. A false value indicates that the artefact did not exist, or that
+// the teardown failed before reaching it.
+type DestroyResult struct {
+	// TopLevelIndex is true if the multihash -> shard mappings were removed
+	// from the top-level inverted index.
+	TopLevelIndex bool
+	// FullIndex is true if the full index was dropped from the index repo.
+	FullIndex bool
+	// Manifests is true if any manifests were dropped from the manifest
+	// repo.
+	Manifests bool
+	// Transient is true if the local transient copy was deleted.
+	Transient bool
+	// State is true if the persisted shard state was deleted from the
+	// datastore.
+	State bool
 }
 
 type Config struct {
@@ -143,9 +248,51 @@ type Config struct {
 	// be created for remote mounts.
 	TransientsDir string
 
+	// SparseTransients enables sparse transients for remote mounts that
+	// support random access, such as HTTP mounts backed by servers that
+	// support range requests. Rather than downloading the whole shard,
+	// only the byte ranges that are actually read are fetched and cached in
+	// the transient. See mount.UpgradeOpts for details.
+	//
+	// Initializing a shard still reads it in full, sequentially, to generate
+	// its index, so sparse transients only save bandwidth on the accesses
+	// that follow the eviction of a transient.
+	SparseTransients bool
+
+	// TransientDigests enables computing the SHA-256 digest of transients
+	// once they are fully downloaded. The digest is persisted along with the
+	// shard state, and is verified when the transient is reused after a
+	// restart. Transient sizes are always verified.
+	TransientDigests bool
+
+	// TransientsQuota is the maximum number of bytes that transients may
+	// occupy. When the transients usage goes above the high watermark, the
+	// transients of idle shards are evicted in least-recently accessed order,
+	// until the usage falls to the low watermark. Pinned transients are never
+	// evicted (see DAGStore.PinTransient). While the usage is at or above the
+	// quota, fetches that need to create a transient wait for space to be
+	// freed. 0 (default) disables the quota.
+	TransientsQuota int64
+
+	// TransientsHighWatermark and TransientsLowWatermark are the fractions of
+	// the TransientsQuota that trigger eviction, and that eviction brings the
+	// transients usage down to, respectively. They default to 0.9 and 0.7.
+	TransientsHighWatermark float64
+	TransientsLowWatermark  float64
+
 	// IndexRepo is the full index repo to use.
 	IndexRepo index.FullIndexRepo
 
+	// ManifestRepo is the repo where manifests are stored. If nil, and
+	// IndexRepo also implements index.ManifestRepo, IndexRepo is used.
+	ManifestRepo index.ManifestRepo
+
+	// ManifestGenerators are the generators of the manifests derived from
+	// every shard on initialization. Manifests can be retrieved through
+	// DAGStore.ListManifests and DAGStore.GetManifest. They require a
+	// ManifestRepo.
+	ManifestGenerators []ManifestGenerator
+
 	TopLevelIndex index.Inverted
 
 	// Datastore is the datastore where shard state will be persisted.
@@ -160,19 +307,38 @@ type Config struct {
 	//
 	// Note: Not actively consuming from this channel will make the event
 	// loop block.
+	//
+	// Deprecated: use DAGStore.Subscribe, which never blocks the event loop.
 	TraceCh chan<- Trace
 
+	// MetricsRegisterer is the Prometheus registerer on which the DAG store
+	// metrics will be registered, if non-nil. To register the metrics of
+	// multiple DAG stores on the same registry, wrap the registerer with
+	// distinguishing labels (see prometheus.WrapRegistererWith).
+	MetricsRegisterer prometheus.Registerer
+
 	// FailureCh is a channel to be notified every time that a shard moves to
 	// ShardStateErrored. A nil value will send no failure notifications.
 	// Failure events can be used to evaluate the error and call
-	// DAGStore.RecoverShard if deemed recoverable.
+	// DAGStore.RecoverShard if deemed recoverable, unless AutoRecovery is
+	// enabled.
 	//
 	// Note: Not actively consuming from this channel will make the event
 	// loop block.
 	FailureCh chan<- ShardResult
 
+	// EventLoops is the number of event loops processing shard operations.
+	// Shards are partitioned across event loops by key, so operations on a
+	// shard are always processed in order, while operations on shards
+	// assigned to different event loops are processed in parallel. 0
+	// (default) runs a single event loop.
+	EventLoops int
+
 	// MaxConcurrentIndex is the maximum indexing jobs that can
 	// run concurrently. 0 (default) disables throttling.
+	//
+	// This and the following concurrency limits can be changed at runtime
+	// through DAGStore#UpdateLimits.
 	MaxConcurrentIndex int
 
 	// MaxConcurrentReadyFetches is the maximum number of fetches that will
@@ -180,9 +346,76 @@ type Config struct {
 	// immediate fetch. 0 (default) disables throttling.
 	MaxConcurrentReadyFetches int
 
+	// MaxConcurrentIndexBytes is the maximum total size of the shards being
+	// indexed concurrently, on top of MaxConcurrentIndex. A shard larger than
+	// the budget is indexed on its own. 0 (default) disables the budget.
+	MaxConcurrentIndexBytes int64
+
+	// MaxConcurrentReadyFetchBytes is the maximum total size of the fetches
+	// that will run concurrently for mounts that are reporting themselves as
+	// ready, on top of MaxConcurrentReadyFetches. 0 (default) disables the
+	// budget.
+	MaxConcurrentReadyFetchBytes int64
+
+	// MaxFetchBandwidth caps the aggregate throughput of all fetches into
+	// transients, in bytes per second. FetchBandwidthBurst is the number of
+	// bytes that can be fetched in a burst, and defaults to one second's
+	// worth. 0 (default) leaves the throughput unlimited.
+	MaxFetchBandwidth   int64
+	FetchBandwidthBurst int64
+
+	// PriorityAging is the time after which an indexing job or fetch waiting
+	// for a slot is promoted by one priority level, so that lower priority
+	// work isn't starved. 0 uses throttle.DefaultAging.
+	PriorityAging time.Duration
+
 	// RecoverOnStart specifies whether failed shards should be recovered
 	// on start.
 	RecoverOnStart RecoverOnStartPolicy
+
+	// AutoRecovery configures the automatic recovery of shards that fail
+	// while the DAG store is running. The zero value disables it.
+	AutoRecovery AutoRecoveryPolicy
+
+	// RetryPolicy specifies how failed fetches and initializations are
+	// retried before failing the shard. The zero value disables retries.
+	RetryPolicy RetryPolicy
+
+	// RestorePolicy specifies how persisted shards that can't be restored on
+	// start are handled. Defaults to RestoreLenient.
+	RestorePolicy RestorePolicy
+
+	// TopLevelIndexPruneInterval is the interval at which the top-level index
+	// is swept to drop references to shards that are no longer known to the
+	// DAG store. 0 (default) disables the background sweep; it can still be
+	// triggered manually through DAGStore.PruneTopLevelIndex.
+	TopLevelIndexPruneInterval time.Duration
+
+	// PersistMaxStaleness is the maximum time shard state changes are
+	// buffered before being written to the Datastore, in batches if it
+	// supports them. Buffered changes are always written on close. 0 uses
+	// DefaultPersistMaxStaleness.
+	PersistMaxStaleness time.Duration
+
+	// GCInterval is the interval at which GC is performed automatically,
+	// reclaiming the transients selected by GCPolicy. 0 (default) disables
+	// automatic GC; it can still be triggered manually through DAGStore.GC,
+	// which reclaims all reclaimable transients.
+	GCInterval time.Duration
+
+	// GCMinIdle, GCFreeDiskTarget and GCMaxTransients configure the
+	// DefaultGCPolicy used by automatic GC, if GCPolicy is nil. They are,
+	// respectively, the minimum time a shard must have gone unaccessed for
+	// its transient to be reclaimed, the number of bytes that should be
+	// available to the TransientsDir, and the maximum number of transients
+	// to keep. See DefaultGCPolicy for details.
+	GCMinIdle        time.Duration
+	GCFreeDiskTarget int64
+	GCMaxTransients  int
+
+	// GCPolicy selects the transients reclaimed by automatic GC. If nil, a
+	// DefaultGCPolicy configured with the fields above is used.
+	GCPolicy GCPolicy
 }
 
 // NewDAGStore constructs a new DAG store with the supplied configuration.
@@ -203,6 +436,25 @@ func NewDAGStore(cfg Config) (*DAGStore, error) {
 		cfg.IndexRepo = index.NewMemoryRepo()
 	}
 
+	if cfg.ManifestRepo == nil {
+		if repo, ok := cfg.IndexRepo.(index.ManifestRepo); ok {
+			cfg.ManifestRepo = repo
+		}
+	}
+	if len(cfg.ManifestGenerators) > 0 {
+		if cfg.ManifestRepo == nil {
+			return nil, fmt.Errorf("manifest generators require a manifest repo")
+		}
+		seen := make(map[index.ManifestKey]struct{}, len(cfg.ManifestGenerators))
+		for _, g := range cfg.ManifestGenerators {
+			k := index.ManifestKey{GenRule: g.GenRule(), GenVersion: g.GenVersion()}
+			if _, ok := seen[k]; ok {
+				return nil, fmt.Errorf("duplicate manifest generator: %s v%d", k.GenRule, k.GenVersion)
+			}
+			seen[k] = struct{}{}
+		}
+	}
+
 	if cfg.TopLevelIndex == nil {
 		log.Info("using in-memory inverted index")
 		cfg.TopLevelIndex = index.NewInverted(dssync.MutexWrap(ds.NewMapDatastore()))
@@ -223,31 +475,56 @@ func NewDAGStore(cfg Config) (*DAGStore, error) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	dagst := &DAGStore{
-		mounts:              cfg.MountRegistry,
-		config:              cfg,
-		indices:             cfg.IndexRepo,
-		TopLevelIndex:       cfg.TopLevelIndex,
-		shards:              make(map[shard.Key]*Shard),
-		store:               cfg.Datastore,
-		externalCh:          make(chan *task, 128),     // len=128, concurrent external tasks that can be queued up before exercising backpressure.
-		internalCh:          make(chan *task, 1),       // len=1, because eventloop will only ever stage another internal event.
-		completionCh:        make(chan *task, 64),      // len=64, hitting this limit will just make async tasks wait.
-		dispatchResultsCh:   make(chan *dispatch, 128), // len=128, same as externalCh.
-		gcCh:                make(chan chan *GCResult, 8),
-		traceCh:             cfg.TraceCh,
-		failureCh:           cfg.FailureCh,
-		throttleIndex:       throttle.Noop(),
-		throttleReaadyFetch: throttle.Noop(),
-		ctx:                 ctx,
-		cancelFn:            cancel,
+		mounts:            cfg.MountRegistry,
+		config:            cfg,
+		indices:           cfg.IndexRepo,
+		manifests:         cfg.ManifestRepo,
+		TopLevelIndex:     cfg.TopLevelIndex,
+		shards:            make(map[shard.Key]*Shard),
+		store:             cfg.Datastore,
+		state:             newStateWriter(cfg.Datastore),
+		dispatchResultsCh: make(chan *dispatch, 128), // len=128, same as the external task channel of an event loop.
+		gcCh:              make(chan *gcRequest, 8),
+		evictCh:           make(chan struct{}, 1), // len=1, as eviction requests are coalesced.
+		traceCh:           cfg.TraceCh,
+		subs:              make(map[*Subscription]struct{}),
+		failureCh:         cfg.FailureCh,
+		limiters:          newLimiters(cfg),
+		ctx:               ctx,
+		cancelFn:          cancel,
 	}
 
-	if max := cfg.MaxConcurrentIndex; max > 0 {
-		dagst.throttleIndex = throttle.Fixed(max)
+	loops := cfg.EventLoops
+	if loops <= 0 {
+		loops = 1
+	}
+	for i := 0; i < loops; i++ {
+		dagst.loops = append(dagst.loops, newEventLoop())
 	}
 
-	if max := cfg.MaxConcurrentReadyFetches; max > 0 {
-		dagst.throttleReaadyFetch = throttle.Fixed(max)
+	if cfg.TransientsQuota > 0 {
+		q, err := newTransientsQuota(cfg)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		dagst.quota = q
+	}
+
+	if rate := cfg.MaxFetchBandwidth; rate > 0 {
+		dagst.fetchBandwidth = throttle.NewTokenBucket(rate, cfg.FetchBandwidthBurst)
+	}
+
+	dagst.metrics = newMetrics(dagst)
+	dagst.throttleIndex = observeThrottler(dagst.limiters.index, dagst.metrics.throttleWait.WithLabelValues("index"))
+	dagst.throttleReaadyFetch = observeThrottler(dagst.limiters.readyFetch, dagst.metrics.throttleWait.WithLabelValues("ready_fetch"))
+	dagst.weighIndex = observeWeighted(dagst.limiters.indexBytes, dagst.metrics.throttleWait.WithLabelValues("index_bytes"))
+	dagst.weighReadyFetch = observeWeighted(dagst.limiters.readyFetchBytes, dagst.metrics.throttleWait.WithLabelValues("ready_fetch_bytes"))
+	if cfg.MetricsRegisterer != nil {
+		if err := dagst.metrics.register(cfg.MetricsRegisterer); err != nil {
+			cancel()
+			return nil, err
+		}
 	}
 
 	return dagst, nil
@@ -256,7 +533,6 @@ func NewDAGStore(cfg Config) (*DAGStore, error) {
 // Start starts a DAG store.
 func (d *DAGStore) Start(ctx context.Context) error {
 	if err := d.restoreState(); err != nil {
-		// TODO add a lenient mode.
 		return fmt.Errorf("failed to restore dagstore state: %w", err)
 	}
 
@@ -267,13 +543,17 @@ func (d *DAGStore) Start(ctx context.Context) error {
 	// Reset in-progress states.
 	//
 	// Queue shards whose registration needs to be restarted. Release those
-	// ops after we spawn the control goroutine. Otherwise, having more shards
-	// in this state than the externalCh buffer size would exceed the channel
+	// ops after we spawn the event loops. Otherwise, having more shards in
+	// this state than the external task buffer size would exceed the channel
 	// buffer, and we'd block forever.
 	var toRegister, toRecover []*Shard
 	for _, s := range d.shards {
 		switch s.state {
 		case ShardStateErrored:
+			if errors.Is(s.err, ErrMountUnrestorable) {
+				log.Warnw("start: skipping recovery of shard with unrestorable mount", "shard", s.key, "error", s.err)
+				break
+			}
 			switch d.config.RecoverOnStart {
 			case DoNotRecover:
 				log.Infow("start: skipping recovery of shard in errored state", "shard", s.key, "error", s.err)
@@ -304,30 +584,66 @@ func (d *DAGStore) Start(ctx context.Context) error {
 		}
 	}
 
-	// spawn the control goroutine.
+	d.closeLk.Lock()
+	d.started = true
+	d.closeLk.Unlock()
+
+	// spawn the event loops, and the reclaim loop.
+	for _, l := range d.loops {
+		d.wg.Add(1)
+		go d.control(l)
+	}
 	d.wg.Add(1)
-	go d.control()
+	go d.reclaimLoop()
 
 	// spawn the dispatcher goroutine for responses, responsible for pumping
 	// async results back to the caller.
 	d.wg.Add(1)
 	go d.dispatcher(d.dispatchResultsCh)
 
+	// spawn the shard state writer.
+	maxStaleness := d.config.PersistMaxStaleness
+	if maxStaleness <= 0 {
+		maxStaleness = DefaultPersistMaxStaleness
+	}
+	d.wg.Add(1)
+	go d.persistLoop(maxStaleness)
+
+	// spawn the top-level index pruner, if enabled.
+	if interval := d.config.TopLevelIndexPruneInterval; interval > 0 {
+		d.wg.Add(1)
+		go d.pruneTopLevelIndexLoop(interval)
+	}
+
+	// spawn the GC scheduler, if enabled.
+	if interval := d.config.GCInterval; interval > 0 {
+		policy := d.config.GCPolicy
+		if policy == nil {
+			policy = &DefaultGCPolicy{
+				MinIdle:        d.config.GCMinIdle,
+				FreeDiskTarget: d.config.GCFreeDiskTarget,
+				MaxTransients:  d.config.GCMaxTransients,
+			}
+		}
+		d.wg.Add(1)
+		go d.gcLoop(interval, policy)
+	}
+
 	// application has provided a failure channel; spawn the dispatcher.
 	if d.failureCh != nil {
-		d.dispatchFailuresCh = make(chan *dispatch, 128) // len=128, same as externalCh.
+		d.dispatchFailuresCh = make(chan *dispatch, 128) // len=128, same as dispatchResultsCh.
 		d.wg.Add(1)
 		go d.dispatcher(d.dispatchFailuresCh)
 	}
 
 	// release the queued registrations before we return.
 	for _, s := range toRegister {
-		_ = d.queueTask(&task{op: OpShardRegister, shard: s, waiter: &waiter{ctx: ctx}}, d.externalCh)
+		_ = d.queueTask(&task{op: OpShardRegister, shard: s, waiter: &waiter{ctx: ctx}}, s.loop.externalCh)
 	}
 
 	// queue shard recovery for shards in the errored state before we return.
 	for _, s := range toRecover {
-		_ = d.queueTask(&task{op: OpShardRecover, shard: s, waiter: &waiter{ctx: ctx}}, d.externalCh)
+		_ = d.queueTask(&task{op: OpShardRecover, shard: s, waiter: &waiter{ctx: ctx}}, s.loop.externalCh)
 	}
 
 	return nil
@@ -347,6 +663,47 @@ func (d *DAGStore) GetIterableIndex(key shard.Key) (carindex.IterableIndex, erro
 	return ii, nil
 }
 
+// ListManifests returns the keys of the manifests available for a shard.
+func (d *DAGStore) ListManifests(key shard.Key) ([]index.ManifestKey, error) {
+	if err := d.checkManifests(key); err != nil {
+		return nil, err
+	}
+	keys, err := d.manifests.ListManifests(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list manifests: %w", err)
+	}
+	return keys, nil
+}
+
+// GetManifest returns the manifest identified by the key. It returns an error
+// wrapping index.ErrNotFound if the manifest doesn't exist.
+func (d *DAGStore) GetManifest(key index.ManifestKey) (index.Manifest, error) {
+	if err := d.checkManifests(key.Shard); err != nil {
+		return nil, err
+	}
+	m, err := d.manifests.GetManifest(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest: %w", err)
+	}
+	return m, nil
+}
+
+// checkManifests checks that manifests are supported, and that the shard is
+// known.
+func (d *DAGStore) checkManifests(key shard.Key) error {
+	if d.manifests == nil {
+		return errors.New("manifests unsupported: no manifest repo")
+	}
+
+	d.lk.RLock()
+	_, ok := d.shards[key]
+	d.lk.RUnlock()
+	if !ok {
+		return ErrShardUnknown
+	}
+	return nil
+}
+
 func (d *DAGStore) ShardsContainingMultihash(ctx context.Context, h mh.Multihash) ([]shard.Key, error) {
 	return d.TopLevelIndex.GetShardsForMultihash(ctx, h)
 }
@@ -357,6 +714,11 @@ type RegisterOpts struct {
 	// for indexing.
 	ExistingTransient string
 
+	// ExistingTransientInfo is the expected size and, optionally, digest of
+	// the ExistingTransient. If provided, the transient is verified against
+	// it before being used, and is refetched from the mount on mismatch.
+	ExistingTransientInfo *mount.TransientInfo
+
 	// LazyInitialization defers shard indexing to the first access instead of
 	// performing it at registration time. Use this option when fetching the
 	// asset is expensive.
@@ -365,33 +727,44 @@ type RegisterOpts struct {
 	// has acknowledged the inclusion of the shard, without waiting for any
 	// indexing to happen.
 	LazyInitialization bool
+
+	// Priority is the priority of the shard's initialization when claiming
+	// fetch and indexing slots. See Config.MaxConcurrentIndex and
+	// Config.MaxConcurrentReadyFetches.
+	Priority throttle.Priority
 }
 
 // RegisterShard initiates the registration of a new shard.
 //
 // This method returns an error synchronously if preliminary validation fails.
 // Otherwise, it queues the shard for registration. The caller should monitor
-// supplied channel for a result.
+// supplied channel for a result, which carries the OpID of the operation.
 func (d *DAGStore) RegisterShard(ctx context.Context, key shard.Key, mnt mount.Mount, out chan ShardResult, opts RegisterOpts) error {
+	_, err := d.registerShard(key, mnt, opts, &waiter{ctx: ctx, outCh: out})
+	return err
+}
+
+func (d *DAGStore) registerShard(key shard.Key, mnt mount.Mount, opts RegisterOpts, w *waiter) (OpID, error) {
+	w.prioritize(opts.Priority)
+
 	d.lk.Lock()
 	if _, ok := d.shards[key]; ok {
 		d.lk.Unlock()
-		return fmt.Errorf("%s: %w", key.String(), ErrShardExists)
+		return 0, fmt.Errorf("%s: %w", key.String(), ErrShardExists)
 	}
 
 	// wrap the original mount in an upgrader.
-	upgraded, err := mount.Upgrade(mnt, d.throttleReaadyFetch, d.config.TransientsDir, key.String(), opts.ExistingTransient)
+	upgraded, err := mount.UpgradeWithOpts(mnt, d.throttleReaadyFetch, d.config.TransientsDir, key.String(), opts.ExistingTransient, d.upgradeOpts(opts.ExistingTransientInfo))
 	if err != nil {
 		d.lk.Unlock()
-		return err
+		return 0, err
 	}
 
-	w := &waiter{outCh: out, ctx: ctx}
-
 	// add the shard to the shard catalogue, and drop the lock.
 	s := &Shard{
 		d:     d,
 		key:   key,
+		loop:  d.loopFor(key.String()),
 		state: ShardStateNew,
 		mount: upgraded,
 		lazy:  opts.LazyInitialization,
@@ -399,27 +772,56 @@ func (d *DAGStore) RegisterShard(ctx context.Context, key shard.Key, mnt mount.M
 	d.shards[key] = s
 	d.lk.Unlock()
 
-	tsk := &task{op: OpShardRegister, shard: s, waiter: w}
-	return d.queueTask(tsk, d.externalCh)
+	id, err := d.submit(OpShardRegister, s, w)
+	if err != nil {
+		// the event loop never saw the shard; forget it.
+		d.lk.Lock()
+		delete(d.shards, key)
+		d.lk.Unlock()
+	}
+	return id, err
 }
 
 type DestroyOpts struct {
 }
 
+// DestroyShard destroys the shard, removing it from the DAG store along with
+// every artefact that belongs to it: its entries in the top-level index, its
+// full index, its transient copy, and its persisted state.
+//
+// Shards with active acquirers, or that are initializing or recovering, cannot
+// be destroyed; the operation will fail with an error on the supplied channel.
+//
+// The teardown deletes the persisted state last, so if it's interrupted (e.g.
+// the process dies) the shard will be restored on the next start, and the
+// destroy can be retried. If the teardown fails, the shard is moved to
+// ShardStateErrored.
+//
+// The result delivered on the supplied channel carries the OpID of the
+// operation.
 func (d *DAGStore) DestroyShard(ctx context.Context, key shard.Key, out chan ShardResult, _ DestroyOpts) error {
+	_, err := d.destroyShard(key, &waiter{ctx: ctx, outCh: out})
+	return err
+}
+
+func (d *DAGStore) destroyShard(key shard.Key, w *waiter) (OpID, error) {
 	d.lk.Lock()
 	s, ok := d.shards[key]
 	if !ok {
 		d.lk.Unlock()
-		return ErrShardUnknown // TODO: encode shard key
+		return 0, ErrShardUnknown // TODO: encode shard key
 	}
 	d.lk.Unlock()
 
-	tsk := &task{op: OpShardDestroy, shard: s, waiter: &waiter{ctx: ctx, outCh: out}}
-	return d.queueTask(tsk, d.externalCh)
+	return d.submit(OpShardDestroy, s, w)
 }
 
 type AcquireOpts struct {
+	// Priority is the priority of the acquisition. Higher priority acquirers
+	// are served first when the shard becomes available, and when claiming
+	// fetch slots. If the acquisition triggers a lazy initialization or a
+	// recovery, those run with its priority, too.
+	Priority throttle.Priority
 }
 
 // AcquireShard acquires access to the specified shard, and returns a
@@ -431,18 +833,24 @@ type AcquireOpts struct {
 //
 // This method returns an error synchronously if preliminary validation fails.
 // Otherwise, it queues the shard for acquisition. The caller should monitor
-// supplied channel for a result.
-func (d *DAGStore) AcquireShard(ctx context.Context, key shard.Key, out chan ShardResult, _ AcquireOpts) error {
+// supplied channel for a result, which carries the OpID of the operation.
+func (d *DAGStore) AcquireShard(ctx context.Context, key shard.Key, out chan ShardResult, opts AcquireOpts) error {
+	w := &waiter{ctx: ctx, outCh: out}
+	w.prioritize(opts.Priority)
+	_, err := d.acquireShard(key, w)
+	return err
+}
+
+func (d *DAGStore) acquireShard(key shard.Key, w *waiter) (OpID, error) {
 	d.lk.Lock()
 	s, ok := d.shards[key]
 	if !ok {
 		d.lk.Unlock()
-		return fmt.Errorf("%s: %w", key.String(), ErrShardUnknown)
+		return 0, fmt.Errorf("%s: %w", key.String(), ErrShardUnknown)
 	}
 	d.lk.Unlock()
 
-	tsk := &task{op: OpShardAcquire, shard: s, waiter: &waiter{ctx: ctx, outCh: out}}
-	return d.queueTask(tsk, d.externalCh)
+	return d.submit(OpShardAcquire, s, w)
 }
 
 type RecoverOpts struct {
@@ -457,27 +865,46 @@ type RecoverOpts struct {
 // but an error will be returned quickly on the supplied channel.
 //
 // Otherwise, the recovery operation will be queued and the supplied channel
-// will be notified when it completes.
-//
-// TODO add an operation identifier to ShardResult -- starts to look like
-//  a Trace event?
+// will be notified when it completes, with a result carrying the OpID of the
+// operation.
 func (d *DAGStore) RecoverShard(ctx context.Context, key shard.Key, out chan ShardResult, _ RecoverOpts) error {
+	_, err := d.recoverShard(key, &waiter{ctx: ctx, outCh: out})
+	return err
+}
+
+func (d *DAGStore) recoverShard(key shard.Key, w *waiter) (OpID, error) {
 	d.lk.Lock()
 	s, ok := d.shards[key]
 	if !ok {
 		d.lk.Unlock()
-		return fmt.Errorf("%s: %w", key.String(), ErrShardUnknown)
+		return 0, fmt.Errorf("%s: %w", key.String(), ErrShardUnknown)
 	}
 	d.lk.Unlock()
 
-	tsk := &task{op: OpShardRecover, shard: s, waiter: &waiter{ctx: ctx, outCh: out}}
-	return d.queueTask(tsk, d.externalCh)
+	return d.submit(OpShardRecover, s, w)
 }
 
+// Trace describes a shard operation processed by the event loop.
 type Trace struct {
-	Key   shard.Key
-	Op    OpType
-	After ShardInfo
+	Key shard.Key
+	Op  OpType
+	// OpID identifies the operation this task belongs to, or is zero if the
+	// task doesn't originate from a submitted operation.
+	OpID OpID
+	// Before and After are the shard info before and after the operation.
+	Before ShardInfo
+	After  ShardInfo
+	// Time is the time at which the operation finished processing.
+	Time time.Time
+	// Duration is the time from queuing the operation to it finishing
+	// processing.
+	Duration time.Duration
+	// Error is the error carried by the operation, e.g. the cause of the
+	// failure for OpShardFail.
+	Error error
+	// Attempt is the number of the failed attempt being retried, counting
+	// from 1, for OpShardRetry.
+	Attempt int
 }
 
 type ShardInfo struct {
@@ -524,59 +951,134 @@ func (d *DAGStore) AllShardsInfo() AllShardsInfo {
 // GC performs DAG store garbage collection by reclaiming transient files of
 // shards that are currently available but inactive, or errored.
 //
-// GC runs with exclusivity from the event loop.
+// GC runs alongside the event loops; it only blocks operations on the shards
+// whose transients it's reclaiming, while it deletes them.
 func (d *DAGStore) GC(ctx context.Context) (*GCResult, error) {
-	ch := make(chan *GCResult)
+	return d.runGC(ctx, nil)
+}
+
+// runGC requests GC from the reclaim loop, with the supplied policy, and
+// waits for the result.
+func (d *DAGStore) runGC(ctx context.Context, policy GCPolicy) (*GCResult, error) {
+	req := &gcRequest{policy: policy, resCh: make(chan *GCResult)}
 	select {
-	case d.gcCh <- ch:
+	case d.gcCh <- req:
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 
 	select {
-	case res := <-ch:
+	case res := <-req.resCh:
 		return res, nil
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 }
 
-func (d *DAGStore) Close() error {
-	d.cancelFn()
-	d.wg.Wait()
-	_ = d.store.Sync(context.TODO(), ds.Key{})
-	return nil
+// submit allocates an OpID for an operation submitted by the application,
+// queues its task, and returns the OpID. Operations are rejected once the
+// DAG store is closing.
+func (d *DAGStore) submit(op OpType, s *Shard, w *waiter) (OpID, error) {
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closing {
+		return 0, ErrDAGStoreClosed
+	}
+
+	w.id, w.created = d.newOpID(), time.Now()
+	tsk := &task{op: op, shard: s, waiter: w, id: w.id}
+	if err := d.queueTask(tsk, s.loop.externalCh); err != nil {
+		return 0, err
+	}
+	return w.id, nil
 }
 
 func (d *DAGStore) queueTask(tsk *task, ch chan<- *task) error {
+	tsk.queued = time.Now()
+	d.pending.add(1)
 	select {
 	case <-d.ctx.Done():
-		return fmt.Errorf("dag store closed")
+		d.pending.add(-1)
+		return ErrDAGStoreClosed
 	case ch <- tsk:
 		return nil
 	}
 }
 
+// QuarantinedShard is a persisted shard record that couldn't be parsed on
+// start. The record is left untouched in the datastore.
+type QuarantinedShard struct {
+	// Key is the datastore key of the record.
+	Key string
+	// Record is the raw record.
+	Record []byte
+	// Error is the error that occurred parsing the record.
+	Error error
+}
+
+// QuarantinedShards returns the persisted shard records that couldn't be
+// parsed on start, under the RestoreLenient policy.
+func (d *DAGStore) QuarantinedShards() []QuarantinedShard {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	return append([]QuarantinedShard(nil), d.quarantined...)
+}
+
+// quarantine records a persisted shard that couldn't be parsed, or fails
+// under the RestoreStrict policy.
+func (d *DAGStore) quarantine(key string, record []byte, err error) error {
+	if d.config.RestorePolicy == RestoreStrict {
+		return fmt.Errorf("failed to restore shard record %s: %w", key, err)
+	}
+	log.Warnw("failed to parse shard record; quarantining", "key", key, "error", err)
+	d.quarantined = append(d.quarantined, QuarantinedShard{Key: key, Record: record, Error: err})
+	return nil
+}
+
 func (d *DAGStore) restoreState() error {
 	results, err := d.store.Query(d.ctx, query.Query{})
 	if err != nil {
 		return fmt.Errorf("failed to recover dagstore state from store: %w", err)
 	}
+	// legacy records are rewritten in the current format once loaded.
+	legacy := make(map[ds.Key]*PersistedShard)
 	for {
 		res, ok := results.NextSync()
 		if !ok {
-			return nil
+			break
 		}
+		ps, err := decodeRecord(res.Value)
+		if err != nil {
+			if err := d.quarantine(res.Key, res.Value, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if isLegacyRecord(res.Value) {
+			legacy[ds.NewKey(res.Key)] = ps
+		}
+
 		s := &Shard{d: d}
-		if err := s.UnmarshalJSON(res.Value); err != nil {
-			log.Warnf("failed to recover state of shard %s: %s; skipping", shard.KeyFromString(res.Key), err)
+		if err := s.restore(ps); errors.Is(err, ErrMountUnrestorable) && d.config.RestorePolicy == RestoreLenient {
+			log.Warnw("failed to restore mount of shard; loading it in errored state", "shard", s.key, "error", err)
+			s.state, s.err = ShardStateErrored, err
+		} else if err != nil {
+			if err := d.quarantine(res.Key, res.Value, err); err != nil {
+				return err
+			}
 			continue
 		}
 
 		log.Debugw("restored shard state on dagstore startup", "shard", s.key, "shard state", s.state, "shard error", s.err,
 			"shard lazy", s.lazy)
+		s.loop = d.loopFor(s.key.String())
 		d.shards[s.key] = s
 	}
+
+	if _, err := migrateRecords(d.ctx, d.store, legacy); err != nil {
+		return fmt.Errorf("failed to migrate legacy shard records: %w", err)
+	}
+	return nil
 }
 
 // ensureDir checks whether the specified path is a directory, and if not it
@@ -594,10 +1096,23 @@ func ensureDir(path string) error {
 	return nil
 }
 
+// upgradeOpts returns the options to upgrade shard mounts with, given the
+// expected integrity information of the initial transient, if any.
+func (d *DAGStore) upgradeOpts(initial *mount.TransientInfo) mount.UpgradeOpts {
+	return mount.UpgradeOpts{
+		Sparse:       d.config.SparseTransients,
+		Digest:       d.config.TransientDigests,
+		InitialInfo:  initial,
+		FetchWeights: d.weighReadyFetch,
+		Bandwidth:    d.fetchBandwidth,
+	}
+}
+
 // failShard queues a shard failure (does not fail it immediately). It is
 // suitable for usage both outside and inside the event loop, depending on the
-// channel passed.
-func (d *DAGStore) failShard(s *Shard, ch chan *task, format string, args ...interface{}) error {
+// channel passed. The failure is attributed to the operation with the
+// supplied id, if non-zero.
+func (d *DAGStore) failShard(s *Shard, ch chan *task, id OpID, format string, args ...interface{}) error {
 	err := fmt.Errorf(format, args...)
-	return d.queueTask(&task{op: OpShardFail, shard: s, err: err}, ch)
+	return d.queueTask(&task{op: OpShardFail, shard: s, err: err, id: id}, ch)
 }
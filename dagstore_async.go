@@ -2,10 +2,16 @@ package dagstore
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
 
 	"github.com/filecoin-project/dagstore/index"
 
 	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
 	carindex "github.com/ipld/go-car/v2/index"
 	"github.com/multiformats/go-multihash"
 
@@ -21,14 +27,23 @@ import (
 // joining them to form a ShardAccessor.
 func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mount.Mount) {
 	k := s.key
+	if !w.created.IsZero() {
+		defer func() {
+			d.metrics.acquireDuration.Observe(time.Since(w.created).Seconds())
+		}()
+	}
 
-	reader, err := mnt.Fetch(ctx)
+	var reader mount.Reader
+	err := d.retry(ctx, s, w.id, func(ctx context.Context) (err error) {
+		reader, err = d.fetchWithinQuota(ctx, s)
+		return err
+	})
 
-	if err := ctx.Err(); err != nil {
-		log.Warnw("context cancelled while fetching shard; releasing", "shard", s.key, "error", err)
+	if err := d.ctxErr(ctx); err != nil {
+		log.Warnw("context cancelled while fetching shard; releasing", "op_id", w.id, "shard", s.key, "error", err)
 
 		// release the shard to decrement the refcount that's incremented before `acquireAsync` is called.
-		_ = d.queueTask(&task{op: OpShardRelease, shard: s}, d.completionCh)
+		_ = d.queueTask(&task{op: OpShardRelease, shard: s, id: w.id}, s.loop.completionCh)
 
 		// send the shard error to the caller for correctness
 		// since the context is cancelled, the result will be discarded.
@@ -37,29 +52,29 @@ func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mo
 	}
 
 	if err != nil {
-		log.Warnw("acquire: failed to fetch from mount upgrader", "shard", s.key, "error", err)
+		log.Warnw("acquire: failed to fetch from mount upgrader", "op_id", w.id, "shard", s.key, "error", err)
 
 		// release the shard to decrement the refcount that's incremented before `acquireAsync` is called.
-		_ = d.queueTask(&task{op: OpShardRelease, shard: s}, d.completionCh)
+		_ = d.queueTask(&task{op: OpShardRelease, shard: s, id: w.id}, s.loop.completionCh)
 
 		// fail the shard
-		_ = d.failShard(s, d.completionCh, "failed to acquire reader of mount so we can return the accessor: %w", err)
+		_ = d.failShard(s, s.loop.completionCh, w.id, "failed to acquire reader of mount so we can return the accessor: %w", err)
 
 		// send the shard error to the caller.
 		d.dispatchResult(&ShardResult{Key: k, Error: err}, w)
 		return
 	}
 
-	log.Debugw("acquire: successfully fetched from mount upgrader", "shard", s.key)
+	log.Debugw("acquire: successfully fetched from mount upgrader", "op_id", w.id, "shard", s.key)
 
 	// acquire the index.
 	idx, err := d.indices.GetFullIndex(k)
 
-	if err := ctx.Err(); err != nil {
-		log.Warnw("context cancelled while indexing shard; releasing", "shard", s.key, "error", err)
+	if err := d.ctxErr(ctx); err != nil {
+		log.Warnw("context cancelled while indexing shard; releasing", "op_id", w.id, "shard", s.key, "error", err)
 
 		// release the shard to decrement the refcount that's incremented before `acquireAsync` is called.
-		_ = d.queueTask(&task{op: OpShardRelease, shard: s}, d.completionCh)
+		_ = d.queueTask(&task{op: OpShardRelease, shard: s, id: w.id}, s.loop.completionCh)
 
 		// send the shard error to the caller for correctness
 		// since the context is cancelled, the result will be discarded.
@@ -68,23 +83,23 @@ func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mo
 	}
 
 	if err != nil {
-		log.Warnw("acquire: failed to get index for shard", "shard", s.key, "error", err)
+		log.Warnw("acquire: failed to get index for shard", "op_id", w.id, "shard", s.key, "error", err)
 		if err := reader.Close(); err != nil {
 			log.Errorf("failed to close mount reader: %s", err)
 		}
 
 		// release the shard to decrement the refcount that's incremented before `acquireAsync` is called.
-		_ = d.queueTask(&task{op: OpShardRelease, shard: s}, d.completionCh)
+		_ = d.queueTask(&task{op: OpShardRelease, shard: s, id: w.id}, s.loop.completionCh)
 
 		// fail the shard
-		_ = d.failShard(s, d.completionCh, "failed to recover index for shard %s: %w", k, err)
+		_ = d.failShard(s, s.loop.completionCh, w.id, "failed to recover index for shard %s: %w", k, &indexError{err})
 
 		// send the shard error to the caller.
 		d.dispatchResult(&ShardResult{Key: k, Error: err}, w)
 		return
 	}
 
-	log.Debugw("acquire: successful; returning accessor", "shard", s.key)
+	log.Debugw("acquire: successful; returning accessor", "op_id", w.id, "shard", s.key)
 
 	// build the accessor.
 	sa, err := NewShardAccessor(reader, idx, s)
@@ -93,10 +108,10 @@ func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mo
 	// will be called to release the shard if we were unable to deliver
 	// the accessor.
 	w.notifyDead = func() {
-		log.Warnw("context cancelled while delivering accessor; releasing", "shard", s.key)
+		log.Warnw("context cancelled while delivering accessor; releasing", "op_id", w.id, "shard", s.key)
 
 		// release the shard to decrement the refcount that's incremented before `acquireAsync` is called.
-		_ = d.queueTask(&task{op: OpShardRelease, shard: s}, d.completionCh)
+		_ = d.queueTask(&task{op: OpShardRelease, shard: s, id: w.id}, s.loop.completionCh)
 	}
 
 	d.dispatchResult(&ShardResult{Key: k, Accessor: sa, Error: err}, w)
@@ -104,36 +119,23 @@ func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mo
 
 // initializeShard initializes a shard asynchronously by fetching its data and
 // performing indexing.
-func (d *DAGStore) initializeShard(ctx context.Context, s *Shard, mnt mount.Mount) {
-	reader, err := mnt.Fetch(ctx)
-	if err != nil {
-		log.Warnw("initialize: failed to fetch from mount upgrader", "shard", s.key, "error", err)
-
-		_ = d.failShard(s, d.completionCh, "failed to acquire reader of mount on initialization: %w", err)
-		return
-	}
-	defer reader.Close()
-
-	log.Debugw("initialize: successfully fetched from mount upgrader", "shard", s.key)
-
-	// works for both CARv1 and CARv2.
-	var idx carindex.Index
-	err = d.throttleIndex.Do(ctx, func(_ context.Context) error {
-		var err error
-		idx, err = car.ReadOrGenerateIndex(reader, car.ZeroLengthSectionAsEOF(true), car.StoreIdentityCIDs(true))
-		if err == nil {
-			log.Debugw("initialize: finished generating index for shard", "shard", s.key)
-		} else {
-			log.Warnw("initialize: failed to generate index for shard", "shard", s.key, "error", err)
-		}
+func (d *DAGStore) initializeShard(ctx context.Context, id OpID, s *Shard, mnt mount.Mount) {
+	var (
+		reader mount.Reader
+		idx    carindex.Index
+	)
+	err := d.retry(ctx, s, id, func(ctx context.Context) (err error) {
+		reader, idx, err = d.fetchAndIndex(ctx, id, s)
 		return err
 	})
 	if err != nil {
-		_ = d.failShard(s, d.completionCh, "failed to read/generate CAR Index: %w", err)
+		_ = d.failShard(s, s.loop.completionCh, id, "%w", err)
 		return
 	}
+	defer reader.Close()
+
 	if err := d.indices.AddFullIndex(s.key, idx); err != nil {
-		_ = d.failShard(s, d.completionCh, "failed to add index for shard: %w", err)
+		_ = d.failShard(s, s.loop.completionCh, id, "failed to add index for shard: %w", err)
 		return
 	}
 
@@ -142,13 +144,203 @@ func (d *DAGStore) initializeShard(ctx context.Context, s *Shard, mnt mount.Moun
 	if ok {
 		mhIter := &mhIdx{iterableIdx: iterableIdx}
 		if err := d.TopLevelIndex.AddMultihashesForShard(ctx, mhIter, s.key); err != nil {
-			log.Errorw("failed to add shard multihashes to the inverted index", "shard", s.key, "error", err)
+			log.Errorw("failed to add shard multihashes to the inverted index", "op_id", id, "shard", s.key, "error", err)
 		}
 	} else {
-		log.Errorw("shard index is not iterable", "shard", s.key)
+		log.Errorw("shard index is not iterable", "op_id", id, "shard", s.key)
+	}
+
+	// derive the configured manifests from the shard.
+	if len(d.config.ManifestGenerators) > 0 {
+		if err := d.generateManifests(ctx, s, reader, idx); err != nil {
+			log.Errorw("failed to generate manifests for shard", "op_id", id, "shard", s.key, "error", err)
+		}
+	}
+
+	_ = d.queueTask(&task{op: OpShardMakeAvailable, shard: s, id: id}, s.loop.completionCh)
+}
+
+// fetchAndIndex fetches the shard from its mount, and reads or generates its
+// index. On success, the caller owns the returned reader.
+func (d *DAGStore) fetchAndIndex(ctx context.Context, id OpID, s *Shard) (mount.Reader, carindex.Index, error) {
+	reader, err := d.fetchWithinQuota(ctx, s)
+	if err != nil {
+		log.Warnw("initialize: failed to fetch from mount upgrader", "op_id", id, "shard", s.key, "error", err)
+		return nil, nil, fmt.Errorf("failed to acquire reader of mount on initialization: %w", err)
+	}
+
+	log.Debugw("initialize: successfully fetched from mount upgrader", "op_id", id, "shard", s.key)
+
+	// works for both CARv1 and CARv2.
+	var idx carindex.Index
+	err = d.throttleIndex.Do(ctx, func(ctx context.Context) error {
+		return d.weighIndex.Do(ctx, d.shardSize(ctx, s), func(_ context.Context) error {
+			start, counting := time.Now(), &countingReader{Reader: reader}
+			defer func() {
+				d.metrics.indexDuration.Observe(time.Since(start).Seconds())
+				d.metrics.indexBytes.Add(float64(counting.n))
+			}()
+
+			var err error
+			idx, err = car.ReadOrGenerateIndex(counting, car.ZeroLengthSectionAsEOF(true), car.StoreIdentityCIDs(true))
+			if err == nil {
+				log.Debugw("initialize: finished generating index for shard", "op_id", id, "shard", s.key)
+			} else {
+				log.Warnw("initialize: failed to generate index for shard", "op_id", id, "shard", s.key, "error", err)
+			}
+			return err
+		})
+	})
+	if err != nil {
+		_ = reader.Close()
+		return nil, nil, &indexError{fmt.Errorf("failed to read/generate CAR Index: %w", err)}
+	}
+	return reader, idx, nil
+}
+
+// generateManifests runs all configured manifest generators against the
+// shard, and stores the resulting manifests in the manifest repo.
+func (d *DAGStore) generateManifests(ctx context.Context, s *Shard, reader mount.Reader, idx carindex.Index) error {
+	bs, err := blockstore.NewReadOnly(reader, idx, car.ZeroLengthSectionAsEOF(true))
+	if err != nil {
+		return fmt.Errorf("failed to open shard blockstore: %w", err)
+	}
+	defer bs.Close()
+
+	roots, err := bs.Roots()
+	if err != nil {
+		return fmt.Errorf("failed to read shard roots: %w", err)
+	}
+
+	for _, g := range d.config.ManifestGenerators {
+		k := index.ManifestKey{Shard: s.key, GenRule: g.GenRule(), GenVersion: g.GenVersion()}
+		m, err := g.Generate(ctx, bs, roots)
+		if err != nil {
+			return fmt.Errorf("failed to generate manifest %s: %w", k, err)
+		}
+		if err := d.manifests.AddManifest(k, m); err != nil {
+			return fmt.Errorf("failed to add manifest %s: %w", k, err)
+		}
+		log.Debugw("initialize: generated manifest for shard", "shard", s.key, "rule", k.GenRule, "version", k.GenVersion)
+	}
+	return nil
+}
+
+// destroyAsync tears down every artefact belonging to a shard that has been
+// marked as destroyed by the event loop, and notifies the destroy waiter.
+//
+// Every step is idempotent, and the persisted shard state is deleted last, so
+// that an interrupted teardown leaves the shard recoverable on restart, where
+// the destroy can be retried.
+func (d *DAGStore) destroyAsync(ctx context.Context, id OpID, s *Shard) {
+	res, err := d.teardown(ctx, s)
+	if err != nil {
+		log.Warnw("destroy: failed to tear down shard", "op_id", id, "shard", s.key, "error", err)
+	} else {
+		log.Debugw("destroy: shard torn down", "op_id", id, "shard", s.key)
+	}
+
+	// the event loop won't touch this shard while it's marked as destroyed,
+	// so it's safe to take over the waiter.
+	s.lk.Lock()
+	w := s.wDestroy
+	s.wDestroy = nil
+	if err != nil {
+		// hand the shard back to the event loop, and fail it.
+		s.destroyed = false
+	}
+	s.lk.Unlock()
+
+	if err == nil {
+		d.lk.Lock()
+		delete(d.shards, s.key)
+		d.lk.Unlock()
+
+		// wake up fetches waiting for space in the transients quota.
+		if d.quota != nil && res.Transient {
+			d.quota.signal()
+		}
+	} else {
+		_ = d.failShard(s, s.loop.completionCh, id, "failed to destroy shard: %w", &destroyError{err})
+	}
+
+	if w != nil {
+		d.dispatchResult(&ShardResult{Key: s.key, Error: err, Destroyed: res}, w)
+	}
+}
+
+// teardown removes the top-level index entries, the full index, the transient
+// and the persisted state of a shard, in that order. The top-level index
+// entries are discovered through the full index, so they must be removed
+// first.
+func (d *DAGStore) teardown(ctx context.Context, s *Shard) (*DestroyResult, error) {
+	res := new(DestroyResult)
+
+	istat, err := d.indices.StatFullIndex(s.key)
+	if err != nil {
+		return res, fmt.Errorf("failed to stat full index: %w", err)
+	}
+
+	if istat.Exists {
+		idx, err := d.indices.GetFullIndex(s.key)
+		if err != nil {
+			return res, fmt.Errorf("failed to get full index: %w", err)
+		}
+		if iterableIdx, ok := idx.(carindex.IterableIndex); ok {
+			mhIter := &mhIdx{iterableIdx: iterableIdx}
+			if err := d.TopLevelIndex.RemoveMultihashesForShard(ctx, mhIter, s.key); err != nil {
+				return res, fmt.Errorf("failed to remove shard multihashes from the inverted index: %w", err)
+			}
+			res.TopLevelIndex = true
+		} else {
+			log.Warnw("destroy: shard index is not iterable; skipping inverted index cleanup", "shard", s.key)
+		}
+
+		dropped, err := d.indices.DropFullIndex(s.key)
+		if err != nil {
+			return res, fmt.Errorf("failed to drop full index: %w", err)
+		}
+		res.FullIndex = dropped
+	}
+
+	if d.manifests != nil {
+		keys, err := d.manifests.ListManifests(s.key)
+		if err != nil {
+			return res, fmt.Errorf("failed to list manifests: %w", err)
+		}
+		for _, k := range keys {
+			dropped, err := d.manifests.DropManifest(k)
+			if err != nil {
+				return res, fmt.Errorf("failed to drop manifest %s: %w", k, err)
+			}
+			res.Manifests = res.Manifests || dropped
+		}
+	}
+
+	// transients supplied by the user are left alone.
+	if s.mount.OwnsTransient() {
+		if err := s.mount.DeleteTransient(); err != nil && !os.IsNotExist(err) {
+			return res, fmt.Errorf("failed to delete transient: %w", err)
+		}
+		res.Transient = true
+	}
+
+	// DeleteTransient leaves the sidecar files of partial downloads and
+	// sparse transients behind, so that they can be resumed; remove them too.
+	for _, p := range s.mount.OwnedPaths() {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return res, fmt.Errorf("failed to delete transient file %s: %w", p, err)
+		}
+	}
+
+	// assuming that the datastore is namespaced if need be.
+	k := ds.NewKey(s.key.String())
+	if err := d.state.delete(ctx, k); err != nil {
+		return res, fmt.Errorf("failed to delete shard state: %w", err)
 	}
+	res.State = true
 
-	_ = d.queueTask(&task{op: OpShardMakeAvailable, shard: s}, d.completionCh)
+	return res, nil
 }
 
 // Convenience struct for converting from CAR index.IterableIndex to the
@@ -2,7 +2,14 @@ package dagstore
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/dagstore/throttle"
 )
 
 type OpType int
@@ -16,6 +23,7 @@ const (
 	OpShardFail
 	OpShardRelease
 	OpShardRecover
+	OpShardRetry
 )
 
 func (o OpType) String() string {
@@ -27,11 +35,57 @@ func (o OpType) String() string {
 		"OpShardAcquire",
 		"OpShardFail",
 		"OpShardRelease",
-		"OpShardRecover"}[o]
+		"OpShardRecover",
+		"OpShardRetry"}[o]
+}
+
+// OpID identifies an operation submitted through RegisterShard,
+// AcquireShard, RecoverShard or DestroyShard. It is carried by the tasks the
+// operation gives rise to, including asynchronous fetches, indexing and
+// failures, and by the resulting traces, results and log lines. Tasks that
+// don't originate from a submitted operation, like shard releases or
+// restored registrations, have a zero OpID.
+type OpID uint64
+
+// newOpID allocates a unique operation identifier.
+func (d *DAGStore) newOpID() OpID {
+	return OpID(atomic.AddUint64(&d.opSeq, 1))
+}
+
+// eventLoop is one of the event loops processing shard tasks. Shards are
+// partitioned across event loops by key, so that all tasks of a shard are
+// processed by the same event loop, in order, while tasks of shards assigned
+// to different event loops are processed in parallel.
+type eventLoop struct {
+	// externalCh receives external tasks.
+	externalCh chan *task
+	// internalCh receives internal tasks to the event loop.
+	internalCh chan *task
+	// completionCh receives tasks queued up as a result of async completions.
+	completionCh chan *task
+}
+
+func newEventLoop() *eventLoop {
+	return &eventLoop{
+		externalCh:   make(chan *task, 128), // len=128, concurrent external tasks that can be queued up before exercising backpressure.
+		internalCh:   make(chan *task, 1),   // len=1, because eventloop will only ever stage another internal event.
+		completionCh: make(chan *task, 64),  // len=64, hitting this limit will just make async tasks wait.
+	}
+}
+
+// loopFor returns the event loop that processes the tasks of the shard with
+// the supplied key.
+func (d *DAGStore) loopFor(key string) *eventLoop {
+	if len(d.loops) == 1 {
+		return d.loops[0]
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return d.loops[h.Sum32()%uint32(len(d.loops))]
 }
 
-// control runs the DAG store's event loop.
-func (d *DAGStore) control() {
+// control runs one of the DAG store's event loops.
+func (d *DAGStore) control(l *eventLoop) {
 	defer d.wg.Done()
 
 	// wFailure is a synthetic failure waiter that uses the DAGStore's
@@ -41,8 +95,8 @@ func (d *DAGStore) control() {
 	var wFailure = &waiter{ctx: d.ctx, outCh: d.failureCh}
 
 	for {
-		// consume the next task or GC request; if we're shutting down, this method will error.
-		tsk, gc, err := d.consumeNext()
+		// consume the next task; if we're shutting down, this method will error.
+		tsk, err := d.consumeNext(l)
 		if err != nil {
 			if err == context.Canceled {
 				log.Infow("dagstore closed")
@@ -52,23 +106,36 @@ func (d *DAGStore) control() {
 			return
 		}
 
-		if gc != nil {
-			// this was a GC request.
-			d.gc(gc)
-			continue
-		}
-
 		s := tsk.shard
-		log.Debugw("processing task", "op", tsk.op, "shard", tsk.shard.key, "error", tsk.err)
+		log.Debugw("processing task", "op", tsk.op, "op_id", tsk.id, "shard", tsk.shard.key, "error", tsk.err)
+
+		// record when the event loop started processing the operation.
+		if w := tsk.waiter; w != nil && w.started.IsZero() {
+			w.started = time.Now()
+		}
 
 		s.lk.Lock()
 		prevState := s.state
+		before := ShardInfo{ShardState: s.state, Error: s.err, refs: s.refs}
+
+		// reject tasks for shards that are being destroyed; these were queued
+		// before the destroy was accepted.
+		if s.destroyed {
+			log.Debugw("ignoring task for destroyed shard", "op", tsk.op, "op_id", tsk.id, "shard", s.key)
+			if tsk.waiter != nil {
+				err := fmt.Errorf("%s: shard is being destroyed: %w", s.key, ErrShardUnknown)
+				d.dispatchResult(&ShardResult{Key: s.key, Error: err}, tsk.waiter)
+			}
+			s.lk.Unlock()
+			d.pending.add(-1)
+			continue
+		}
 
 		switch tsk.op {
 		case OpShardRegister:
 			if s.state != ShardStateNew {
 				// sanity check failed
-				_ = d.failShard(s, d.internalCh, "%w: expected shard to be in 'new' state; was: %s", ErrShardInitializationFailed, s.state)
+				_ = d.failShard(s, l.internalCh, tsk.id, "%w: expected shard to be in 'new' state; was: %s", ErrShardInitializationFailed, s.state)
 				break
 			}
 
@@ -86,7 +153,7 @@ func (d *DAGStore) control() {
 
 			// otherwise, park the registration channel and queue the init.
 			s.wRegister = tsk.waiter
-			_ = d.queueTask(&task{op: OpShardInitialize, shard: s, waiter: tsk.waiter}, d.internalCh)
+			_ = d.queueTask(&task{op: OpShardInitialize, shard: s, waiter: tsk.waiter, id: tsk.id}, l.internalCh)
 
 		case OpShardInitialize:
 			s.state = ShardStateInitializing
@@ -94,11 +161,11 @@ func (d *DAGStore) control() {
 			// if we already have the index for this shard, there's nothing to do here.
 			if istat, err := d.indices.StatFullIndex(s.key); err == nil && istat.Exists {
 				log.Debugw("already have an index for shard being initialized, nothing to do", "shard", s.key)
-				_ = d.queueTask(&task{op: OpShardMakeAvailable, shard: s}, d.internalCh)
+				_ = d.queueTask(&task{op: OpShardMakeAvailable, shard: s, id: tsk.id}, l.internalCh)
 				break
 			}
 
-			go d.initializeShard(tsk.ctx, s, s.mount)
+			d.async(tsk.ctx, func(ctx context.Context) { d.initializeShard(ctx, tsk.id, s, s.mount) })
 
 		case OpShardMakeAvailable:
 			// can arrive here after initializing a new shard,
@@ -106,6 +173,9 @@ func (d *DAGStore) control() {
 
 			s.state = ShardStateAvailable
 			s.err = nil // nillify past errors
+			s.recoveries = 0
+
+			s.lastAccessed = time.Now()
 
 			// notify the registration waiter, if there is one.
 			if s.wRegister != nil {
@@ -121,20 +191,23 @@ func (d *DAGStore) control() {
 				s.wRecover = nil
 			}
 
-			// trigger queued acquisition waiters.
+			// trigger queued acquisition waiters, highest priority first.
+			sortByPriority(s.wAcquire)
 			for _, w := range s.wAcquire {
+				w := w
 				s.state = ShardStateServing
 
 				// optimistically increment the refcount to acquire the shard. The go-routine will send an `OpShardRelease` message
 				// to the event loop if it fails to acquire the shard.
 				s.refs++
-				go d.acquireAsync(w.ctx, w, s, s.mount)
+				d.async(w.ctx, func(ctx context.Context) { d.acquireAsync(ctx, w, s, s.mount) })
 			}
 			s.wAcquire = s.wAcquire[:0]
 
 		case OpShardAcquire:
 			log.Debugw("got request to acquire shard", "shard", s.key, "current shard state", s.state)
-			w := &waiter{ctx: tsk.ctx, outCh: tsk.outCh}
+			s.lastAccessed = time.Now()
+			w := tsk.waiter
 
 			// if the shard is errored, fail the acquire immediately.
 			if s.state == ShardStateErrored {
@@ -147,7 +220,9 @@ func (d *DAGStore) control() {
 					// to avoid the first context cancellation interrupting the
 					// recovery that may be blocking other acquirers with longer
 					// contexts.
-					_ = d.queueTask(&task{op: OpShardRecover, shard: s, waiter: &waiter{ctx: d.ctx}}, d.internalCh)
+					wr := &waiter{ctx: d.ctx}
+					wr.prioritize(w.priority)
+					_ = d.queueTask(&task{op: OpShardRecover, shard: s, waiter: wr, id: tsk.id}, l.internalCh)
 				} else {
 					err := fmt.Errorf("shard is in errored state; err: %w", s.err)
 					res := &ShardResult{Key: s.key, Error: err}
@@ -170,8 +245,8 @@ func (d *DAGStore) control() {
 					// because there can be multiple concurrent acquirers, and
 					// if the first one cancels, the entire job would be cancelled.
 					w := *tsk.waiter
-					w.ctx = context.Background()
-					_ = d.queueTask(&task{op: OpShardInitialize, shard: s, waiter: &w}, d.internalCh)
+					w.ctx = throttle.WithPriority(context.Background(), w.priority)
+					_ = d.queueTask(&task{op: OpShardInitialize, shard: s, waiter: &w, id: tsk.id}, l.internalCh)
 				}
 
 				break
@@ -184,7 +259,7 @@ func (d *DAGStore) control() {
 			// The goroutine will send an `OpShardRelease` task
 			// to the event loop if it fails to acquire the shard.
 			s.refs++
-			go d.acquireAsync(tsk.ctx, w, s, s.mount)
+			d.async(tsk.ctx, func(ctx context.Context) { d.acquireAsync(ctx, w, s, s.mount) })
 
 		case OpShardRelease:
 			if (s.state != ShardStateServing && s.state != ShardStateErrored) || s.refs <= 0 {
@@ -202,6 +277,14 @@ func (d *DAGStore) control() {
 			}
 
 		case OpShardFail:
+			// auto-recovery gives up on shards asynchronously; ignore it if
+			// the shard was recovered in the meantime.
+			var perr *PermanentFailureError
+			if errors.As(tsk.err, &perr) && s.state != ShardStateErrored {
+				log.Debugw("ignoring permanent failure of shard that is no longer errored", "shard", s.key, "state", s.state)
+				break
+			}
+
 			s.state = ShardStateErrored
 			s.err = tsk.err
 
@@ -249,10 +332,18 @@ func (d *DAGStore) control() {
 
 			// Notify the application of the failure, if they provided a channel.
 			if ch := d.failureCh; ch != nil {
-				res := &ShardResult{Key: s.key, Error: s.err}
+				res := &ShardResult{Key: s.key, Error: s.err, OpID: tsk.id}
 				d.dispatchFailuresCh <- &dispatch{res: res, w: wFailure}
 			}
 
+			// schedule the automatic recovery of the shard, if enabled.
+			d.superviseFailure(s, tsk.err)
+
+		case OpShardRetry:
+			// a fetch or initialization of the shard failed, and is being
+			// retried; the shard stays in its current state, and the
+			// attempt is only surfaced in the trace.
+
 		case OpShardRecover:
 			if s.state != ShardStateErrored {
 				err := fmt.Errorf("refused to recover shard in state other than errored; current state: %d", s.state)
@@ -285,7 +376,7 @@ func (d *DAGStore) control() {
 			}
 
 			// fetch again and reindex.
-			go d.initializeShard(tsk.ctx, s, s.mount)
+			d.async(tsk.ctx, func(ctx context.Context) { d.initializeShard(ctx, tsk.id, s, s.mount) })
 
 		case OpShardDestroy:
 			if s.state == ShardStateServing || s.refs > 0 {
@@ -295,60 +386,124 @@ func (d *DAGStore) control() {
 				break
 			}
 
-			d.lk.Lock()
-			delete(d.shards, s.key)
-			d.lk.Unlock()
-			// TODO are we guaranteed that there are no queued items for this shard?
+			if s.state == ShardStateInitializing || s.state == ShardStateRecovering {
+				err := fmt.Errorf("failed to destroy shard; shard is busy in state: %s", s.state)
+				res := &ShardResult{Key: s.key, Error: err}
+				d.dispatchResult(res, tsk.waiter)
+				break
+			}
+
+			// mark the shard as destroyed, so that tasks that are already
+			// queued are rejected, and park the waiter. The shard stays in
+			// the catalogue until the teardown completes so that the key
+			// can't be registered again in the meantime.
+			s.destroyed = true
+			s.wDestroy = tsk.waiter
+
+			d.async(d.ctx, func(ctx context.Context) { d.destroyAsync(ctx, tsk.id, s) })
 
 		default:
 			panic(fmt.Sprintf("unrecognized shard operation: %d", tsk.op))
 
 		}
 
-		// persist the current shard state.
-		if err := s.persist(d.ctx, d.config.Datastore); err != nil { // TODO maybe fail shard?
-			log.Warnw("failed to persist shard", "shard", s.key, "error", err)
+		// persist the current shard state, unless the shard is being
+		// destroyed, in which case the teardown will delete it.
+		if !s.destroyed {
+			if err := d.persistShard(s); err != nil { // TODO maybe fail shard?
+				log.Warnw("failed to persist shard", "shard", s.key, "error", err)
+			}
 		}
 
-		// send a notification if the user provided a notification channel.
+		// notify subscribers, and the trace channel if the user provided one.
+		now := time.Now()
+		trace := Trace{
+			Key:    s.key,
+			Op:     tsk.op,
+			OpID:   tsk.id,
+			Before: before,
+			After: ShardInfo{
+				ShardState: s.state,
+				Error:      s.err,
+				refs:       s.refs,
+			},
+			Time:     now,
+			Duration: now.Sub(tsk.queued),
+			Error:    tsk.err,
+			Attempt:  tsk.attempt,
+		}
+		d.publishTrace(trace)
 		if d.traceCh != nil {
 			log.Debugw("will write trace to the trace channel", "shard", s.key)
-			n := Trace{
-				Key: s.key,
-				Op:  tsk.op,
-				After: ShardInfo{
-					ShardState: s.state,
-					Error:      s.err,
-					refs:       s.refs,
-				},
-			}
-			d.traceCh <- n
+			d.traceCh <- trace
 			log.Debugw("finished writing trace to the trace channel", "shard", s.key)
 		}
 
-		log.Debugw("finished processing task", "op", tsk.op, "shard", tsk.shard.key, "prev_state", prevState, "curr_state", s.state, "error", tsk.err)
+		log.Debugw("finished processing task", "op", tsk.op, "op_id", tsk.id, "shard", tsk.shard.key, "prev_state", prevState, "curr_state", s.state, "error", tsk.err)
+		d.metrics.taskDuration.WithLabelValues(tsk.op.String()).Observe(trace.Duration.Seconds())
 
 		s.lk.Unlock()
+		d.pending.add(-1)
+
+		// enforce the transients quota when transients may have been created
+		// or become evictable.
+		if d.quota != nil && (tsk.op == OpShardMakeAvailable || tsk.op == OpShardRelease) {
+			d.requestEviction()
+		}
 	}
 }
 
-func (d *DAGStore) consumeNext() (tsk *task, gc chan *GCResult, error error) {
+func (d *DAGStore) consumeNext(l *eventLoop) (tsk *task, error error) {
 	select {
-	case tsk = <-d.internalCh: // drain internal first; these are tasks emitted from the event loop.
-		return tsk, nil, nil
+	case tsk = <-l.internalCh: // drain internal first; these are tasks emitted from the event loop.
+		return tsk, nil
 	case <-d.ctx.Done():
-		return nil, nil, d.ctx.Err() // TODO drain and process before returning?
+		return nil, d.ctx.Err()
 	default:
 	}
 
 	select {
-	case tsk = <-d.externalCh:
-		return tsk, nil, nil
-	case tsk = <-d.completionCh:
-		return tsk, nil, nil
-	case gc := <-d.gcCh:
-		return nil, gc, nil
+	case tsk = <-l.externalCh:
+		return tsk, nil
+	case tsk = <-l.completionCh:
+		return tsk, nil
 	case <-d.ctx.Done():
-		return nil, nil, d.ctx.Err() // TODO drain and process before returning?
+		return nil, d.ctx.Err()
+	}
+}
+
+// reclaimLoop performs GC and evicts transients to enforce the transients
+// quota on request. It runs alongside the event loops, and only locks the
+// shards it's reclaiming transients from, one at a time, so that it doesn't
+// block operations on other shards.
+func (d *DAGStore) reclaimLoop() {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case gc := <-d.gcCh:
+			d.gc(gc)
+		case <-d.evictCh:
+			d.evict()
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// sortByPriority sorts the waiters by descending priority, preserving the
+// arrival order of waiters with the same priority.
+func sortByPriority(ws []*waiter) {
+	sort.SliceStable(ws, func(i, j int) bool {
+		return ws[i].priority > ws[j].priority
+	})
+}
+
+// requestEviction requests the reclaim loop to enforce the transients quota.
+// Requests are coalesced.
+func (d *DAGStore) requestEviction() {
+	select {
+	case d.evictCh <- struct{}{}:
+	default:
 	}
 }
@@ -1,9 +1,12 @@
 package dagstore
 
 import (
+	"context"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/filecoin-project/dagstore/shard"
 )
@@ -14,6 +17,8 @@ type GCResult struct {
 	// Shards includes an entry for every shard whose transient was reclaimed.
 	// Nil error values indicate success.
 	Shards map[shard.Key]error
+	// ReclaimedBytes is the total size of the transients that were reclaimed.
+	ReclaimedBytes int64
 }
 
 // ShardFailures returns the number of shards whose transient reclaim failed.
@@ -27,11 +32,20 @@ func (e *GCResult) ShardFailures() int {
 	return failures
 }
 
+// gcRequest is a request to perform GC, sent to the event loop.
+type gcRequest struct {
+	// policy selects the transients to reclaim; nil reclaims the transients
+	// of all reclaimable shards.
+	policy GCPolicy
+	resCh  chan *GCResult
+}
+
 // gc performs DAGStore GC. Refer to DAGStore#GC for more information.
 //
-// The event loops gives it exclusive execution rights, so while GC is running,
-// no other events are being processed.
-func (d *DAGStore) gc(resCh chan *GCResult) {
+// It's called from the reclaim loop, alongside the event loops. Shards are
+// locked while their transients are deleted, and are skipped if they're no
+// longer reclaimable by then.
+func (d *DAGStore) gc(req *gcRequest) {
 	res := &GCResult{
 		Shards: make(map[shard.Key]error),
 	}
@@ -39,40 +53,117 @@ func (d *DAGStore) gc(resCh chan *GCResult) {
 	// determine which shards can be reclaimed.
 	d.lk.RLock()
 	var reclaim []*Shard
+	var candidates []GCCandidate
+	state := GCState{Now: time.Now(), FreeDiskSpace: -1}
 	for _, s := range d.shards {
 		s.lk.RLock()
-		if nAcq := len(s.wAcquire); (s.state == ShardStateAvailable || s.state == ShardStateErrored) && nAcq == 0 {
+		size := transientSize(s)
+		if size > 0 {
+			state.Transients++
+			state.TransientsSize += size
+		}
+		if s.reclaimable() {
 			reclaim = append(reclaim, s)
+			if size > 0 {
+				candidates = append(candidates, GCCandidate{Key: s.key, TransientSize: size, LastAccessed: s.lastAccessed})
+			}
 		}
 		s.lk.RUnlock()
 	}
 	d.lk.RUnlock()
 
+	// let the policy select the transients to reclaim out of the candidates.
+	if req.policy != nil {
+		if free, err := freeDiskSpace(d.config.TransientsDir); err == nil {
+			state.FreeDiskSpace = free
+		} else {
+			log.Debugw("failed to determine free disk space", "error", err)
+		}
+
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].LastAccessed.Before(candidates[j].LastAccessed)
+		})
+		selected := make(map[shard.Key]struct{})
+		for _, k := range req.policy.Reclaim(state, candidates) {
+			selected[k] = struct{}{}
+		}
+
+		filtered := reclaim[:0]
+		for _, s := range reclaim {
+			if _, ok := selected[s.key]; ok {
+				filtered = append(filtered, s)
+			}
+		}
+		reclaim = filtered
+	}
+
 	// attempt to delete transients of reclaimed shards.
 	for _, s := range reclaim {
-		// only read lock: we're not modifying state, and the mount has its own lock.
-		s.lk.RLock()
+		// write lock, as persisting the shard records the queued record.
+		s.lk.Lock()
+		if !s.reclaimable() {
+			// the shard was acquired since we selected it.
+			s.lk.Unlock()
+			continue
+		}
+		size := transientSize(s)
 		err := s.mount.DeleteTransient()
 		if err != nil {
 			log.Warnw("failed to delete transient", "shard", s.key, "error", err)
+		} else {
+			res.ReclaimedBytes += size
 		}
 
 		// record the error so we can return it.
 		res.Shards[s.key] = err
 
 		// flush the shard state to the datastore.
-		if err := s.persist(d.ctx, d.config.Datastore); err != nil {
+		if err := d.persistShard(s); err != nil {
 			log.Warnw("failed to persist shard", "shard", s.key, "error", err)
 		}
-		s.lk.RUnlock()
+		s.lk.Unlock()
+	}
+
+	d.metrics.gcReclaimedBytes.Add(float64(res.ReclaimedBytes))
+
+	// wake up fetches waiting for space in the transients quota.
+	if d.quota != nil && res.ReclaimedBytes > 0 {
+		d.quota.signal()
 	}
 
 	select {
-	case resCh <- res:
+	case req.resCh <- res:
 	case <-d.ctx.Done():
 	}
 }
 
+// gcLoop periodically performs GC with the configured policy until the DAG
+// store is closed.
+func (d *DAGStore) gcLoop(interval time.Duration, policy GCPolicy) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			res, err := d.runGC(d.ctx, policy)
+			if err != nil {
+				if d.ctx.Err() == nil {
+					log.Warnw("automatic GC failed", "error", err)
+				}
+				continue
+			}
+			if len(res.Shards) > 0 {
+				log.Infow("automatic GC reclaimed transients", "shards", len(res.Shards), "failures", res.ShardFailures(), "reclaimed_bytes", res.ReclaimedBytes)
+			}
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
 // clearOrphaned removes files that are not referenced by any mount.
 //
 // This is only safe to be called from the constructor, before we have
@@ -81,8 +172,9 @@ func (d *DAGStore) clearOrphaned() error {
 	referenced := make(map[string]struct{})
 
 	for _, s := range d.shards {
-		t := s.mount.TransientPath()
-		referenced[t] = struct{}{}
+		for _, p := range s.mount.OwnedPaths() {
+			referenced[p] = struct{}{}
+		}
 	}
 
 	// Walk the transients dir and delete unreferenced files.
@@ -102,3 +194,43 @@ func (d *DAGStore) clearOrphaned() error {
 
 	return err
 }
+
+// PruneTopLevelIndex sweeps the top-level index and drops references to
+// shards that are no longer known to the DAG store, e.g. leftovers from
+// destroyed shards whose full index was gone by the time of destruction.
+// It returns the keys of the shards whose references were dropped.
+//
+// This operation scans the entire top-level index, so it can be expensive.
+func (d *DAGStore) PruneTopLevelIndex(ctx context.Context) ([]shard.Key, error) {
+	return d.TopLevelIndex.PruneShards(ctx, func(k shard.Key) bool {
+		d.lk.RLock()
+		_, ok := d.shards[k]
+		d.lk.RUnlock()
+		return ok
+	})
+}
+
+// pruneTopLevelIndexLoop periodically prunes the top-level index until the
+// DAG store is closed.
+func (d *DAGStore) pruneTopLevelIndexLoop(interval time.Duration) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pruned, err := d.PruneTopLevelIndex(d.ctx)
+			if err != nil {
+				log.Warnw("failed to prune top-level index", "error", err)
+				continue
+			}
+			if len(pruned) > 0 {
+				log.Infow("pruned unknown shards from top-level index", "shards", len(pruned))
+			}
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
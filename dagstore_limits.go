@@ -0,0 +1,73 @@
+package dagstore
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/dagstore/throttle"
+)
+
+// Limits are the concurrency limits of the DAG store that can be changed at
+// runtime through UpdateLimits. They have the same meaning as the
+// homonymous Config fields; 0 disables throttling.
+type Limits struct {
+	MaxConcurrentIndex           int
+	MaxConcurrentReadyFetches    int
+	MaxConcurrentIndexBytes      int64
+	MaxConcurrentReadyFetchBytes int64
+}
+
+// LimitsStats is a snapshot of the usage of the throttlers enforcing the
+// Limits.
+type LimitsStats struct {
+	Index           throttle.Stats
+	ReadyFetch      throttle.Stats
+	IndexBytes      throttle.Stats
+	ReadyFetchBytes throttle.Stats
+}
+
+// limiters are the resizable throttlers enforcing the Limits.
+type limiters struct {
+	index           throttle.ResizableThrottler
+	readyFetch      throttle.ResizableThrottler
+	indexBytes      throttle.ResizableWeightedThrottler
+	readyFetchBytes throttle.ResizableWeightedThrottler
+}
+
+func newLimiters(cfg Config) limiters {
+	return limiters{
+		index:           throttle.Prioritized(cfg.MaxConcurrentIndex, cfg.PriorityAging),
+		readyFetch:      throttle.Prioritized(cfg.MaxConcurrentReadyFetches, cfg.PriorityAging),
+		indexBytes:      throttle.Weighted(cfg.MaxConcurrentIndexBytes, cfg.PriorityAging),
+		readyFetchBytes: throttle.Weighted(cfg.MaxConcurrentReadyFetchBytes, cfg.PriorityAging),
+	}
+}
+
+// UpdateLimits changes the concurrency limits of the DAG store. The new
+// limits take effect immediately, including for work that is already queued
+// on the throttlers. If a limit is lowered below what is in use, the work in
+// flight runs to completion, but no further work is admitted until usage
+// drops below the new limit.
+func (d *DAGStore) UpdateLimits(l Limits) error {
+	if l.MaxConcurrentIndex < 0 || l.MaxConcurrentReadyFetches < 0 ||
+		l.MaxConcurrentIndexBytes < 0 || l.MaxConcurrentReadyFetchBytes < 0 {
+		return fmt.Errorf("limits must not be negative: %+v", l)
+	}
+
+	d.limiters.index.SetCapacity(int64(l.MaxConcurrentIndex))
+	d.limiters.readyFetch.SetCapacity(int64(l.MaxConcurrentReadyFetches))
+	d.limiters.indexBytes.SetCapacity(l.MaxConcurrentIndexBytes)
+	d.limiters.readyFetchBytes.SetCapacity(l.MaxConcurrentReadyFetchBytes)
+	log.Infow("updated limits", "limits", l)
+	return nil
+}
+
+// LimitsStats returns the current limits, along with the work in flight and
+// the work waiting on each of them.
+func (d *DAGStore) LimitsStats() LimitsStats {
+	return LimitsStats{
+		Index:           d.limiters.index.Stats(),
+		ReadyFetch:      d.limiters.readyFetch.Stats(),
+		IndexBytes:      d.limiters.indexBytes.Stats(),
+		ReadyFetchBytes: d.limiters.readyFetchBytes.Stats(),
+	}
+}
@@ -0,0 +1,180 @@
+package dagstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// DefaultPersistMaxStaleness is the default maximum time shard state changes
+// are buffered before being written to the datastore.
+const DefaultPersistMaxStaleness = 500 * time.Millisecond
+
+// stateWriter buffers shard records, and writes them to the datastore in
+// batches, coalescing successive writes of the same shard.
+//
+// Records are encoded when they're queued, so that flushing doesn't need
+// shard locks. Flushes and deletions are serialized, so that a record queued
+// before the shard is destroyed is never written after its deletion.
+type stateWriter struct {
+	store ds.Datastore
+
+	lk    sync.Mutex
+	dirty map[ds.Key][]byte
+	kick  chan struct{} // len=1; signalled when the first record is queued.
+
+	flushLk sync.Mutex
+}
+
+func newStateWriter(store ds.Datastore) *stateWriter {
+	return &stateWriter{
+		store: store,
+		dirty: make(map[ds.Key][]byte),
+		kick:  make(chan struct{}, 1),
+	}
+}
+
+// put queues a shard record, replacing the one queued previously, if any.
+func (w *stateWriter) put(k ds.Key, v []byte) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	if len(w.dirty) == 0 {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+	w.dirty[k] = v
+}
+
+// flush writes the queued records to the datastore, in a batch if the
+// datastore supports it, and syncs it. Records that fail to be written are
+// queued again, unless they have been superseded in the meantime.
+func (w *stateWriter) flush(ctx context.Context) error {
+	w.flushLk.Lock()
+	defer w.flushLk.Unlock()
+
+	w.lk.Lock()
+	dirty := w.dirty
+	w.dirty = make(map[ds.Key][]byte, len(dirty))
+	w.lk.Unlock()
+
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	err := w.write(ctx, dirty)
+	if err == nil {
+		err = w.store.Sync(ctx, ds.Key{})
+	}
+	if err != nil {
+		w.lk.Lock()
+		for k, v := range dirty {
+			if _, ok := w.dirty[k]; !ok {
+				w.dirty[k] = v
+			}
+		}
+		w.lk.Unlock()
+		return fmt.Errorf("failed to flush %d shard records: %w", len(dirty), err)
+	}
+	return nil
+}
+
+func (w *stateWriter) write(ctx context.Context, records map[ds.Key][]byte) error {
+	var (
+		b   ds.Write = w.store
+		bat ds.Batch
+	)
+	if bs, ok := w.store.(ds.Batching); ok {
+		var err error
+		switch bat, err = bs.Batch(ctx); {
+		case err == nil:
+			b = bat
+		case !errors.Is(err, ds.ErrBatchUnsupported):
+			return err
+		}
+	}
+	for k, v := range records {
+		if err := b.Put(ctx, k, v); err != nil {
+			return err
+		}
+	}
+	if bat != nil {
+		return bat.Commit(ctx)
+	}
+	return nil
+}
+
+// delete drops the queued record of a shard, if any, and deletes its
+// persisted record synchronously.
+func (w *stateWriter) delete(ctx context.Context, k ds.Key) error {
+	w.flushLk.Lock()
+	defer w.flushLk.Unlock()
+
+	w.lk.Lock()
+	delete(w.dirty, k)
+	w.lk.Unlock()
+
+	if err := w.store.Delete(ctx, k); err != nil {
+		return err
+	}
+	return w.store.Sync(ctx, ds.Key{})
+}
+
+// persistLoop flushes the queued shard records once they've been queued for
+// the maximum staleness.
+func (d *DAGStore) persistLoop(maxStaleness time.Duration) {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case <-d.state.kick:
+		case <-d.ctx.Done():
+			return
+		}
+
+		select {
+		case <-time.After(maxStaleness):
+		case <-d.ctx.Done():
+			// the final flush happens on close.
+			return
+		}
+
+		if err := d.state.flush(d.ctx); err != nil {
+			log.Warnw("failed to persist shard state", "error", err)
+			// retry on the next period.
+			select {
+			case d.state.kick <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// persistShard queues the shard record for persistence, unless it's unchanged
+// since it was last queued. Changes that don't survive restarts, such as
+// references, don't alter the record. It must be called with the shard lock
+// held.
+func (d *DAGStore) persistShard(s *Shard) error {
+	ps, err := s.persisted()
+	if err != nil {
+		return fmt.Errorf("failed to serialize shard state: %w", err)
+	}
+	v, err := encodeRecord(ps)
+	if err != nil {
+		return fmt.Errorf("failed to encode shard state: %w", err)
+	}
+	if string(v) == string(s.record) {
+		return nil
+	}
+	s.record = v
+
+	// assuming that the datastore is namespaced if need be.
+	d.state.put(ds.NewKey(s.key.String()), v)
+	return nil
+}
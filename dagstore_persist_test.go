@@ -0,0 +1,140 @@
+package dagstore
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore counts the writes, batches and syncs of a datastore.
+type countingStore struct {
+	*dssync.MutexDatastore
+
+	lk                   sync.Mutex
+	puts, batches, syncs int
+}
+
+func newCountingStore() *countingStore {
+	return &countingStore{MutexDatastore: dssync.MutexWrap(datastore.NewMapDatastore())}
+}
+
+func (c *countingStore) Put(ctx context.Context, k datastore.Key, v []byte) error {
+	c.lk.Lock()
+	c.puts++
+	c.lk.Unlock()
+	return c.MutexDatastore.Put(ctx, k, v)
+}
+
+func (c *countingStore) Batch(_ context.Context) (datastore.Batch, error) {
+	c.lk.Lock()
+	c.batches++
+	c.lk.Unlock()
+	return datastore.NewBasicBatch(c), nil
+}
+
+func (c *countingStore) Sync(ctx context.Context, k datastore.Key) error {
+	c.lk.Lock()
+	c.syncs++
+	c.lk.Unlock()
+	return c.MutexDatastore.Sync(ctx, k)
+}
+
+func (c *countingStore) counts() (puts, batches, syncs int) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.puts, c.batches, c.syncs
+}
+
+func (c *countingStore) records(t *testing.T) map[string]*PersistedShard {
+	res, err := c.Query(context.Background(), query.Query{Prefix: StoreNamespace.String()})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+
+	records := make(map[string]*PersistedShard, len(entries))
+	for _, e := range entries {
+		ps, err := decodeRecord(e.Value)
+		require.NoError(t, err)
+		records[ps.Key] = ps
+	}
+	return records
+}
+
+func TestPersistBatchedOnClose(t *testing.T) {
+	store := newCountingStore()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:       testRegistry(t),
+		TransientsDir:       t.TempDir(),
+		Datastore:           store,
+		PersistMaxStaleness: time.Hour,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	keys := registerShards(t, dagst, 3, carv2mnt, RegisterOpts{})
+	require.Empty(t, store.records(t))
+
+	// the buffered records are written in a single batch on close.
+	require.NoError(t, dagst.Close())
+	puts, batches, syncs := store.counts()
+	require.Equal(t, 3, puts)
+	require.Equal(t, 1, batches)
+	require.Equal(t, 1, syncs)
+
+	records := store.records(t)
+	require.Len(t, records, 3)
+	for _, k := range keys {
+		require.Equal(t, ShardStateAvailable, records[k.String()].State)
+	}
+}
+
+func TestPersistSkipsUnchangedRecords(t *testing.T) {
+	store := newCountingStore()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:       testRegistry(t),
+		TransientsDir:       t.TempDir(),
+		Datastore:           store,
+		PersistMaxStaleness: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	ctx := context.Background()
+	k := registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})[0]
+	require.Eventually(t, func() bool {
+		return len(store.records(t)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	puts, _, _ := store.counts()
+
+	// acquiring and releasing the shard doesn't change its record.
+	for i := 0; i < 5; i++ {
+		sa, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+		require.NoError(t, err)
+		require.NoError(t, sa.Close())
+	}
+	time.Sleep(100 * time.Millisecond)
+	after, _, _ := store.counts()
+	require.Equal(t, puts, after)
+
+	// pins are persisted synchronously.
+	require.NoError(t, dagst.PinTransient(k))
+	require.True(t, store.records(t)[k.String()].Pinned)
+
+	// destroyed shards aren't resurrected by buffered records.
+	require.NoError(t, dagst.UnpinTransient(k))
+	_, err = dagst.DestroyShardSync(ctx, k, DestroyOpts{})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, store.records(t))
+}
@@ -0,0 +1,283 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+const (
+	// defaultTransientsHighWatermark is the default fraction of the transients
+	// quota above which transients are evicted.
+	defaultTransientsHighWatermark = 0.9
+	// defaultTransientsLowWatermark is the default fraction of the transients
+	// quota that eviction brings the transients usage down to.
+	defaultTransientsLowWatermark = 0.7
+)
+
+// transientsQuota holds the limits derived from Config.TransientsQuota, and
+// coordinates fetches waiting for space to free up.
+type transientsQuota struct {
+	limit int64 // fetches wait while the usage is at or above the limit.
+	high  int64 // eviction kicks in above the high watermark.
+	low   int64 // eviction brings the usage down to the low watermark.
+
+	waiting int32 // guarded by atomic; number of fetches waiting for space.
+
+	lk    sync.Mutex
+	freed chan struct{} // guarded by lk; closed and replaced whenever space is freed.
+}
+
+func newTransientsQuota(cfg Config) (*transientsQuota, error) {
+	high, low := cfg.TransientsHighWatermark, cfg.TransientsLowWatermark
+	if high == 0 {
+		high = defaultTransientsHighWatermark
+	}
+	if low == 0 {
+		low = defaultTransientsLowWatermark
+	}
+	if low <= 0 || low > high || high > 1 {
+		return nil, fmt.Errorf("invalid transients watermarks; expected 0 < low (%f) <= high (%f) <= 1", low, high)
+	}
+
+	return &transientsQuota{
+		limit: cfg.TransientsQuota,
+		high:  int64(float64(cfg.TransientsQuota) * high),
+		low:   int64(float64(cfg.TransientsQuota) * low),
+		freed: make(chan struct{}),
+	}, nil
+}
+
+// freedCh returns a channel that will be closed the next time space is freed.
+func (q *transientsQuota) freedCh() <-chan struct{} {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	return q.freed
+}
+
+// signal wakes up fetches waiting for space.
+func (q *transientsQuota) signal() {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	close(q.freed)
+	q.freed = make(chan struct{})
+}
+
+// transientSize returns the size of the shard's transient, or 0 if it has
+// none, or if it was supplied by the user and lives outside the transients
+// directory. Sparse transients only count the chunks that have been fetched.
+func transientSize(s *Shard) int64 {
+	if !s.mount.OwnsTransient() {
+		return 0
+	}
+	if n, ok := s.mount.SparseUsage(); ok {
+		return n
+	}
+	if info := s.mount.TransientInfo(); info != nil {
+		return info.Size
+	}
+	// transients that haven't been verified yet.
+	if path := s.mount.TransientPath(); path != "" {
+		if fi, err := os.Stat(path); err == nil {
+			return fi.Size()
+		}
+	}
+	return 0
+}
+
+// transientsUsage returns the total size of the transients of all shards.
+func (d *DAGStore) transientsUsage() int64 {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+
+	var usage int64
+	for _, s := range d.shards {
+		usage += transientSize(s)
+	}
+	return usage
+}
+
+// fetchWithinQuota waits until there's room for the shard's transient in the
+// transients quota, if the transient needs to be fetched, and then fetches
+// the shard's mount.
+//
+// The quota is soft: a fetch is allowed to proceed as long as the usage is
+// below the quota, even if the fetch itself will take it above the quota.
+// Eviction will then bring the usage back down.
+func (d *DAGStore) fetchWithinQuota(ctx context.Context, s *Shard) (mount.Reader, error) {
+	if q := d.quota; q != nil && !s.mount.Passthrough() && s.mount.TransientPath() == "" {
+		atomic.AddInt32(&q.waiting, 1)
+		defer atomic.AddInt32(&q.waiting, -1)
+
+		for {
+			freed := q.freedCh()
+			usage := d.transientsUsage()
+			if usage < q.limit {
+				break
+			}
+
+			log.Debugw("transients quota exceeded; waiting for space to fetch shard", "shard", s.key, "usage", usage, "quota", q.limit)
+
+			// request an eviction from the reclaim loop.
+			d.requestEviction()
+
+			select {
+			case <-freed:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-d.ctx.Done():
+				return nil, d.ctx.Err()
+			}
+		}
+	}
+	return d.fetch(ctx, s)
+}
+
+// fetch fetches the shard's mount, recording fetch metrics.
+func (d *DAGStore) fetch(ctx context.Context, s *Shard) (mount.Reader, error) {
+	scheme := d.mountScheme(s)
+	before, start := transientSize(s), time.Now()
+	r, err := s.mount.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	d.metrics.fetchDuration.WithLabelValues(scheme).Observe(time.Since(start).Seconds())
+	if n := transientSize(s) - before; n > 0 {
+		d.metrics.fetchBytes.WithLabelValues(scheme).Add(float64(n))
+	}
+	return r, nil
+}
+
+// evict evicts the transients of idle, unpinned shards in least-recently
+// accessed order, if the transients usage is above the high watermark, or if
+// fetches are waiting for space. It evicts until the usage falls to the low
+// watermark.
+//
+// Like GC, it's called from the reclaim loop, alongside the event loops.
+func (d *DAGStore) evict() *GCResult {
+	q := d.quota
+	usage := d.transientsUsage()
+	waiting := atomic.LoadInt32(&q.waiting) > 0
+	if usage <= q.high && !(waiting && usage >= q.limit) {
+		return nil
+	}
+
+	// determine which shards can be evicted.
+	type candidate struct {
+		s            *Shard
+		size         int64
+		lastAccessed time.Time
+	}
+	var candidates []candidate
+	d.lk.RLock()
+	for _, s := range d.shards {
+		s.lk.RLock()
+		if s.reclaimable() {
+			if size := transientSize(s); size > 0 {
+				candidates = append(candidates, candidate{s: s, size: size, lastAccessed: s.lastAccessed})
+			}
+		}
+		s.lk.RUnlock()
+	}
+	d.lk.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastAccessed.Before(candidates[j].lastAccessed)
+	})
+
+	res := &GCResult{Shards: make(map[shard.Key]error)}
+	for _, c := range candidates {
+		if usage <= q.low {
+			break
+		}
+
+		s := c.s
+		s.lk.Lock()
+		if !s.reclaimable() {
+			// the shard was acquired since we selected it.
+			s.lk.Unlock()
+			continue
+		}
+		err := s.mount.DeleteTransient()
+		if err != nil {
+			log.Warnw("failed to evict transient", "shard", s.key, "error", err)
+		} else {
+			res.ReclaimedBytes += c.size
+			usage -= c.size
+		}
+		res.Shards[s.key] = err
+
+		// flush the shard state to the datastore.
+		if err := d.persistShard(s); err != nil {
+			log.Warnw("failed to persist shard", "shard", s.key, "error", err)
+		}
+		s.lk.Unlock()
+	}
+
+	log.Infow("evicted transients to enforce quota", "shards", len(res.Shards), "reclaimed_bytes", res.ReclaimedBytes, "usage", usage, "quota", q.limit)
+
+	d.metrics.gcReclaimedBytes.Add(float64(res.ReclaimedBytes))
+	if res.ReclaimedBytes > 0 {
+		q.signal()
+	}
+	return res
+}
+
+// PinTransient pins the transient of a shard, so that it's never evicted to
+// enforce the transients quota, nor reclaimed by GC. Pins are persisted.
+func (d *DAGStore) PinTransient(key shard.Key) error {
+	return d.setPinned(key, true)
+}
+
+// UnpinTransient unpins the transient of a shard, making it eligible for
+// eviction and GC again.
+func (d *DAGStore) UnpinTransient(key shard.Key) error {
+	return d.setPinned(key, false)
+}
+
+func (d *DAGStore) setPinned(key shard.Key, pinned bool) error {
+	d.lk.RLock()
+	s, ok := d.shards[key]
+	d.lk.RUnlock()
+	if !ok {
+		return ErrShardUnknown
+	}
+
+	s.lk.Lock()
+	if s.destroyed {
+		s.lk.Unlock()
+		return fmt.Errorf("%s: shard is being destroyed: %w", key, ErrShardUnknown)
+	}
+	s.pinned = pinned
+	err := d.persistShard(s)
+	s.lk.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to persist shard: %w", err)
+	}
+
+	// flush outside the shard lock, as it waits for the persistence loop.
+	if err := d.state.flush(d.ctx); err != nil {
+		return fmt.Errorf("failed to persist shard: %w", err)
+	}
+	return nil
+}
+
+// shardSize returns the size of the shard, as reported by its mount, or the
+// size of its transient if the mount can't report it. It's used to weigh
+// the shard against byte budgets.
+func (d *DAGStore) shardSize(ctx context.Context, s *Shard) int64 {
+	if stat, err := s.mount.Stat(ctx); err == nil && stat.Size > 0 {
+		return stat.Size
+	}
+	return transientSize(s)
+}
@@ -0,0 +1,236 @@
+package dagstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/throttle"
+)
+
+const (
+	// defaultAutoRecoveryInitialBackoff is the default delay before the first
+	// automatic recovery of a shard.
+	defaultAutoRecoveryInitialBackoff = 10 * time.Second
+	// defaultAutoRecoveryMaxBackoff is the default cap on the delay between
+	// automatic recoveries of a shard.
+	defaultAutoRecoveryMaxBackoff = 10 * time.Minute
+	// autoRecoveryStatTimeout bounds the time spent checking whether the mount
+	// of a failed shard is gone.
+	autoRecoveryStatTimeout = 30 * time.Second
+)
+
+// FailureClass classifies the failure of a shard for automatic recovery.
+type FailureClass int
+
+const (
+	// FailureTransient is a failure that may go away by itself, e.g. a
+	// network error. The shard is recovered with backoff.
+	FailureTransient FailureClass = iota
+
+	// FailureIndexCorrupt is a failure to read, generate or load the index of
+	// the shard. Recovery regenerates the index, so the first recovery is
+	// attempted right away.
+	FailureIndexCorrupt
+
+	// FailureMountGone is a failure caused by the mount no longer existing,
+	// being unrestorable, or reporting the error as permanent through
+	// mount.Retryable. Recovery can't succeed, so the shard is marked as
+	// permanently failed right away.
+	FailureMountGone
+)
+
+func (c FailureClass) String() string {
+	return [...]string{
+		"FailureTransient",
+		"FailureIndexCorrupt",
+		"FailureMountGone"}[c]
+}
+
+// ErrIndexCorrupt is wrapped by the errors of shards that failed because
+// their index couldn't be read, generated or loaded.
+var ErrIndexCorrupt = errors.New("shard index is corrupt or missing")
+
+// indexError marks a failure to read, generate or load the index of a shard,
+// so that it matches ErrIndexCorrupt while preserving the original error.
+type indexError struct {
+	error
+}
+
+func (e *indexError) Unwrap() error {
+	return e.error
+}
+
+func (e *indexError) Is(target error) bool {
+	return target == ErrIndexCorrupt
+}
+
+// destroyError marks a failure to tear down a shard that the user asked to
+// destroy. Such shards are not recovered automatically.
+type destroyError struct {
+	error
+}
+
+func (e *destroyError) Unwrap() error {
+	return e.error
+}
+
+// PermanentFailureError is the error of shards that automatic recovery gave
+// up on, either because their mount is gone, or because they exhausted the
+// recovery attempts. It wraps the error of the last failure.
+type PermanentFailureError struct {
+	// Class is the classification of the last failure.
+	Class FailureClass
+	// Attempts is the number of recoveries that were attempted.
+	Attempts int
+	// Err is the error of the last failure.
+	Err error
+}
+
+func (e *PermanentFailureError) Error() string {
+	return fmt.Sprintf("shard permanently failed after %d recovery attempts (%s): %s", e.Attempts, e.Class, e.Err)
+}
+
+func (e *PermanentFailureError) Unwrap() error {
+	return e.Err
+}
+
+// AutoRecoveryPolicy configures the automatic recovery of shards that enter
+// ShardStateErrored. The zero value disables automatic recovery.
+//
+// Failed shards are classified (see FailureClass), and recovered through
+// OpShardRecover operations with low priority, backing off between
+// attempts. Once a shard exhausts its attempts, or its mount is gone, it's
+// marked as permanently failed: it stays in ShardStateErrored with a
+// PermanentFailureError, which is also notified through Config.FailureCh.
+// Permanently failed shards can still be recovered through RecoverShard.
+//
+// The attempts are reset once the shard becomes available. They're not
+// persisted, so they're reset on restart too.
+type AutoRecoveryPolicy struct {
+	// MaxAttempts is the maximum number of recoveries attempted for a shard
+	// before it's marked as permanently failed. 0 disables automatic
+	// recovery.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first recovery. Defaults to 10s.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between recoveries. Defaults to 10m.
+	MaxBackoff time.Duration
+	// Multiplier is the factor by which the delay grows after every
+	// recovery. Defaults to 2.
+	Multiplier float64
+	// Jitter randomizes every delay by up to this fraction of it, in either
+	// direction. 0 disables jitter.
+	Jitter float64
+}
+
+// backoff returns the delay before the supplied recovery attempt, counting
+// from 1.
+func (p *AutoRecoveryPolicy) backoff(attempt int) time.Duration {
+	initial, max := p.InitialBackoff, p.MaxBackoff
+	if initial <= 0 {
+		initial = defaultAutoRecoveryInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultAutoRecoveryMaxBackoff
+	}
+	rp := RetryPolicy{InitialBackoff: initial, MaxBackoff: max, Multiplier: p.Multiplier, Jitter: p.Jitter}
+	return rp.backoff(attempt)
+}
+
+// superviseFailure hands a shard that just failed over to the auto-recovery
+// supervisor, unless auto-recovery is disabled, or it already gave up on the
+// shard. It must be called from the event loop, with the shard lock held.
+func (d *DAGStore) superviseFailure(s *Shard, err error) {
+	if d.config.AutoRecovery.MaxAttempts <= 0 {
+		return
+	}
+	var perr *PermanentFailureError
+	if errors.As(err, &perr) {
+		return
+	}
+	// recovering a shard that failed to be destroyed would resurrect it.
+	var derr *destroyError
+	if errors.As(err, &derr) {
+		return
+	}
+
+	s.recoveries++
+	d.wg.Add(1)
+	go d.supervise(s, err, s.recoveries)
+}
+
+// supervise classifies the failure of the shard, and schedules its recovery
+// after backing off, or marks it as permanently failed.
+func (d *DAGStore) supervise(s *Shard, err error, attempt int) {
+	defer d.wg.Done()
+
+	p := &d.config.AutoRecovery
+	class := d.classifyFailure(s, err)
+	if class == FailureMountGone || attempt > p.MaxAttempts {
+		perr := &PermanentFailureError{Class: class, Attempts: attempt - 1, Err: err}
+		log.Warnw("auto-recovery: giving up on shard", "shard", s.key, "class", class, "attempts", attempt-1, "error", err)
+		_ = d.submitInternal(&task{op: OpShardFail, shard: s, err: perr})
+		return
+	}
+
+	var backoff time.Duration
+	if class != FailureIndexCorrupt || attempt > 1 {
+		backoff = p.backoff(attempt)
+	}
+	log.Infow("auto-recovery: scheduling recovery of shard", "shard", s.key, "class", class, "attempt", attempt, "backoff", backoff, "error", err)
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-d.ctx.Done():
+		return
+	}
+
+	// recovery is background work; don't let it hold up acquisitions.
+	w := &waiter{ctx: d.ctx}
+	w.prioritize(throttle.PriorityLow)
+	if _, err := d.submit(OpShardRecover, s, w); err != nil {
+		log.Debugw("auto-recovery: failed to submit recovery", "shard", s.key, "error", err)
+	}
+}
+
+// classifyFailure classifies the error the shard failed with. Failures of the
+// index, and failures of the Upgrader or the local filesystem, are classified
+// before the mount is asked, as mounts can only classify their own errors.
+func (d *DAGStore) classifyFailure(s *Shard, err error) FailureClass {
+	if errors.Is(err, ErrMountUnrestorable) {
+		return FailureMountGone
+	}
+	if errors.Is(err, ErrIndexCorrupt) {
+		return FailureIndexCorrupt
+	}
+	var ierr *mount.TransientIntegrityError
+	if errors.As(err, &ierr) {
+		return FailureTransient
+	}
+	if retryable, ok := mountRetryable(s, err); ok && !retryable {
+		return FailureMountGone
+	}
+
+	ctx, cancel := context.WithTimeout(d.ctx, autoRecoveryStatTimeout)
+	defer cancel()
+	if stat, serr := s.mount.Underlying().Stat(ctx); serr == nil && !stat.Exists {
+		return FailureMountGone
+	}
+	return FailureTransient
+}
+
+// submitInternal queues a task that doesn't originate from the application,
+// unless the DAG store is closing.
+func (d *DAGStore) submitInternal(tsk *task) error {
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closing {
+		return ErrDAGStoreClosed
+	}
+	return d.queueTask(tsk, tsk.shard.loop.externalCh)
+}
@@ -0,0 +1,268 @@
+package dagstore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// closeGracePeriod is how long closing waits for the cancelled asynchronous
+// operations to return. It's a variable so that tests can shorten it.
+var closeGracePeriod = 5 * time.Second
+
+// pendingWork counts the tasks queued to or being processed by the event
+// loop, and the operations running asynchronously on its behalf.
+//
+// Asynchronous operations queue their completion tasks before finishing, and
+// the event loop launches them before finishing the task at hand, so the
+// count only drops to zero once the DAG store is idle.
+type pendingWork struct {
+	lk   sync.Mutex
+	n    int
+	idle chan struct{} // closed when n drops to zero.
+}
+
+func (p *pendingWork) add(delta int) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	prev := p.n
+	p.n += delta
+	switch {
+	case prev == 0 && p.n > 0:
+		p.idle = make(chan struct{})
+	case prev > 0 && p.n == 0:
+		close(p.idle)
+	}
+}
+
+// wait returns a channel that is closed once there is no pending work.
+func (p *pendingWork) wait() <-chan struct{} {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if p.n == 0 {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	return p.idle
+}
+
+// async runs an operation on behalf of the event loop in a goroutine,
+// accounting for it as pending work. The operation's context is cancelled
+// when the DAG store closes.
+func (d *DAGStore) async(ctx context.Context, fn func(ctx context.Context)) {
+	d.pending.add(1)
+	d.asyncWg.Add(1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-d.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	go func() {
+		defer d.asyncWg.Done()
+		defer d.pending.add(-1)
+		defer cancel()
+		fn(ctx)
+	}()
+}
+
+// ctxErr returns ErrDAGStoreClosed if the DAG store is closed, or the error
+// of the operation's context otherwise.
+func (d *DAGStore) ctxErr(ctx context.Context) error {
+	if d.ctx.Err() != nil {
+		return ErrDAGStoreClosed
+	}
+	return ctx.Err()
+}
+
+// Shutdown closes the DAG store gracefully.
+//
+// It stops accepting operations, and waits for those already accepted to
+// complete, and for their results to be delivered. If the context is done
+// first, the operations still in flight are cancelled, and Shutdown returns
+// the context's error once they have returned, or after a grace period.
+//
+// Either way, operations still waiting for a result receive
+// ErrDAGStoreClosed, the shard state is flushed to the datastore, and the
+// mounts are closed. Delivering the final results is bounded by the
+// context, too.
+func (d *DAGStore) Shutdown(ctx context.Context) error {
+	d.closeLk.Lock()
+	d.closing = true
+	started := d.started
+	d.closeLk.Unlock()
+
+	var err error
+	select {
+	case <-d.pending.wait():
+		if started {
+			err = d.flushDispatchers(ctx)
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		log.Warnw("shutdown: failed to wait for pending operations; cancelling them", "error", err)
+	}
+
+	d.close(ctx)
+	return err
+}
+
+// Close closes the DAG store immediately, cancelling the operations in
+// flight. Operations still waiting for a result receive ErrDAGStoreClosed.
+// Use Shutdown to wait for operations to complete.
+func (d *DAGStore) Close() error {
+	d.closeLk.Lock()
+	d.closing = true
+	d.closeLk.Unlock()
+
+	// don't wait for the final results to be delivered.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.close(ctx)
+	return nil
+}
+
+func (d *DAGStore) flushDispatchers(ctx context.Context) error {
+	if err := d.flushDispatcher(ctx, d.dispatchResultsCh); err != nil {
+		return err
+	}
+	if d.dispatchFailuresCh != nil {
+		return d.flushDispatcher(ctx, d.dispatchFailuresCh)
+	}
+	return nil
+}
+
+// close stops the event loop and all other goroutines, waits for the
+// cancelled asynchronous operations to return, for closeGracePeriod at most,
+// then fails the remaining waiters, closes the mounts and flushes the shard
+// state. Final results are delivered until the context is done.
+func (d *DAGStore) close(ctx context.Context) {
+	d.closeOnce.Do(func() {
+		// cancel under the subscriptions lock, so that no subscriptions are
+		// added after we start waiting for goroutines to exit.
+		d.subsLk.Lock()
+		d.cancelFn()
+		d.subsLk.Unlock()
+
+		d.wg.Wait()
+
+		// asynchronous operations have been cancelled, but they may still be
+		// updating shards and queueing completions.
+		done := make(chan struct{})
+		go func() {
+			d.asyncWg.Wait()
+			close(done)
+		}()
+		timer := time.NewTimer(closeGracePeriod)
+		select {
+		case <-done:
+		case <-timer.C:
+			log.Warnw("shutdown: gave up waiting for asynchronous operations", "grace_period", closeGracePeriod)
+		}
+		timer.Stop()
+
+		// the event loop has exited, so the shards are ours now.
+		d.failWaiters(ctx)
+
+		d.lk.RLock()
+		for _, s := range d.shards {
+			s.lk.Lock()
+			if !s.destroyed {
+				if err := d.persistShard(s); err != nil {
+					log.Warnw("shutdown: failed to persist shard", "shard", s.key, "error", err)
+				}
+			}
+			s.lk.Unlock()
+
+			if err := s.mount.Close(); err != nil {
+				log.Warnw("shutdown: failed to close mount", "shard", s.key, "error", err)
+			}
+		}
+		d.lk.RUnlock()
+
+		if err := d.state.flush(context.Background()); err != nil {
+			log.Warnw("shutdown: failed to flush shard state", "error", err)
+		}
+	})
+}
+
+// failWaiters delivers ErrDAGStoreClosed to the waiters still parked on the
+// shards, and to those of the tasks left in the event loops' queues. Results
+// are delivered without blocking where possible; the rest are delivered until
+// the context is done, so that full or abandoned channels don't leak
+// goroutines. It must only be called once the event loop has exited.
+func (d *DAGStore) failWaiters(ctx context.Context) {
+	type parked struct {
+		w   *waiter
+		key shard.Key
+	}
+	var waiters []parked
+	seen := make(map[*waiter]struct{})
+	park := func(w *waiter, s *Shard) {
+		if w == nil || w.outCh == nil {
+			return
+		}
+		if _, ok := seen[w]; ok {
+			return
+		}
+		seen[w] = struct{}{}
+		p := parked{w: w}
+		if s != nil {
+			p.key = s.key
+		}
+		waiters = append(waiters, p)
+	}
+
+	d.lk.RLock()
+	for _, s := range d.shards {
+		s.lk.Lock()
+		for _, w := range append([]*waiter{s.wRegister, s.wRecover, s.wDestroy}, s.wAcquire...) {
+			park(w, s)
+		}
+		s.wRegister, s.wRecover, s.wDestroy, s.wAcquire = nil, nil, nil, nil
+		s.lk.Unlock()
+	}
+	d.lk.RUnlock()
+
+	// tasks that were queued but never processed.
+	for _, l := range d.loops {
+		for _, ch := range []chan *task{l.externalCh, l.internalCh, l.completionCh} {
+		drain:
+			for {
+				select {
+				case tsk := <-ch:
+					d.pending.add(-1)
+					park(tsk.waiter, tsk.shard)
+				default:
+					break drain
+				}
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range waiters {
+		log.Debugw("shutdown: failing waiter", "shard", p.key, "op_id", p.w.id)
+		res := p.w.stamp(ShardResult{Key: p.key, Error: ErrDAGStoreClosed}, time.Now())
+		if p.w.tryDeliver(res) {
+			continue
+		}
+		wg.Add(1)
+		go func(w *waiter) {
+			defer wg.Done()
+			w.deliverWithin(ctx, res)
+		}(p.w)
+	}
+	wg.Wait()
+}
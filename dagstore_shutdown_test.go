@@ -0,0 +1,224 @@
+package dagstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/testdata"
+)
+
+func TestShutdownDrains(t *testing.T) {
+	r := testRegistry(t)
+	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.FS}))
+	require.NoError(t, err)
+
+	store := datastore.NewMapDatastore()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: r,
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// the registration blocks on the mount.
+	k := shard.KeyFromString("foo")
+	mnt := newBlockingMount(carv2mnt)
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), k, mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+
+	errCh := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		errCh <- dagst.Shutdown(ctx)
+	}()
+
+	// new operations are rejected, and unknown shards are not registered.
+	require.Eventually(t, func() bool {
+		err := dagst.RegisterShard(context.Background(), shard.KeyFromString("bar"), carv2mnt, ch, RegisterOpts{})
+		return err == ErrDAGStoreClosed
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, dagst.AllShardsInfo(), 1)
+
+	// shutdown waits for the registration to complete.
+	select {
+	case err := <-errCh:
+		t.Fatalf("shutdown returned before the registration completed: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	mnt.UnblockNext(1)
+
+	res := <-ch
+	require.NoError(t, res.Error)
+	require.NoError(t, <-errCh)
+
+	// the final state was persisted.
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateAvailable, info.ShardState)
+
+	v, err := store.Get(context.Background(), StoreNamespace.ChildString(k.String()))
+	require.NoError(t, err)
+	ps, err := decodeRecord(v)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateAvailable, ps.State)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	// the blocked mount ignores cancellation; don't wait for it on close.
+	defer shortenCloseGracePeriod(100 * time.Millisecond)()
+
+	r := testRegistry(t)
+	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.FS}))
+	require.NoError(t, err)
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: r,
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	mnt := newBlockingMount(carv2mnt)
+	defer mnt.UnblockNext(2)
+
+	// park a registration waiter, and an acquisition waiter behind a lazy
+	// initialization.
+	a, b := shard.KeyFromString("a"), shard.KeyFromString("b")
+	regCh := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), a, mnt, regCh, RegisterOpts{})
+	require.NoError(t, err)
+
+	err = dagst.RegisterShardSync(context.Background(), b, mnt, RegisterOpts{LazyInitialization: true})
+	require.NoError(t, err)
+	acqCh := make(chan ShardResult, 1)
+	err = dagst.AcquireShard(context.Background(), b, acqCh, AcquireOpts{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = dagst.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	res := <-regCh
+	require.ErrorIs(t, res.Error, ErrDAGStoreClosed)
+	res = <-acqCh
+	require.ErrorIs(t, res.Error, ErrDAGStoreClosed)
+	require.NotZero(t, res.OpID)
+
+	// the interrupted initialization will be resumed on restart.
+	info, err := dagst.GetShardInfo(a)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateInitializing, info.ShardState)
+
+	// closing again is a no-op.
+	require.NoError(t, dagst.Close())
+}
+
+func TestShutdownAbandonedWaiter(t *testing.T) {
+	// the blocked mount ignores cancellation; don't wait for it on close.
+	defer shortenCloseGracePeriod(100 * time.Millisecond)()
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	mnt := newBlockingMount(carv2mnt)
+	defer mnt.UnblockNext(1)
+
+	// park an acquisition waiter whose channel is never read from.
+	k := shard.KeyFromString("foo")
+	err = dagst.RegisterShardSync(context.Background(), k, mnt, RegisterOpts{LazyInitialization: true})
+	require.NoError(t, err)
+	acqCh := make(chan ShardResult)
+	err = dagst.AcquireShard(context.Background(), k, acqCh, AcquireOpts{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = dagst.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the delivery was abandoned along with the shutdown, rather than left
+	// blocked on the channel.
+	select {
+	case res := <-acqCh:
+		t.Fatalf("unexpected delivery after shutdown: %v", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCloseFailsQueuedTasks(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	// the event loop isn't running, so the registration stays queued.
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), shard.KeyFromString("foo"), carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+
+	require.NoError(t, dagst.Close())
+	res := <-ch
+	require.ErrorIs(t, res.Error, ErrDAGStoreClosed)
+	require.NotZero(t, res.OpID)
+}
+
+func TestShutdownWaitsForAsync(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// the mount ignores cancellation, so the registration outlives the
+	// shutdown deadline.
+	mnt := newBlockingMount(carv2mnt)
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), shard.KeyFromString("foo"), mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+
+	const unblockAfter = 300 * time.Millisecond
+	time.AfterFunc(unblockAfter, func() { mnt.UnblockNext(1) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = dagst.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// shutdown waited for the registration to return before closing.
+	require.GreaterOrEqual(t, time.Since(start), unblockAfter)
+	res := <-ch
+	require.Error(t, res.Error)
+}
+
+// shortenCloseGracePeriod sets closeGracePeriod, and returns a function that
+// restores it.
+func shortenCloseGracePeriod(d time.Duration) (restore func()) {
+	prev := closeGracePeriod
+	closeGracePeriod = d
+	return func() { closeGracePeriod = prev }
+}
@@ -0,0 +1,158 @@
+package dagstore
+
+import (
+	"context"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+//
+// This file contains blocking companions of the channel-based shard
+// operations, and their batch variants.
+//
+
+// ShardRegistration describes a shard to register with RegisterShardsSync.
+type ShardRegistration struct {
+	Key   shard.Key
+	Mount mount.Mount
+	Opts  RegisterOpts
+}
+
+// RegisterShardSync registers a shard like RegisterShard, and blocks until
+// the registration completes, or the context is done.
+func (d *DAGStore) RegisterShardSync(ctx context.Context, key shard.Key, mnt mount.Mount, opts RegisterOpts) error {
+	res := d.RegisterShardsSync(ctx, []ShardRegistration{{Key: key, Mount: mnt, Opts: opts}})
+	return res[key].Error
+}
+
+// AcquireShardSync acquires a shard like AcquireShard, and blocks until the
+// accessor is available, or the context is done. If the context is done
+// first, the shard is released as soon as the acquisition completes.
+func (d *DAGStore) AcquireShardSync(ctx context.Context, key shard.Key, opts AcquireOpts) (*ShardAccessor, error) {
+	res := d.AcquireShardsSync(ctx, []shard.Key{key}, opts)[key]
+	return res.Accessor, res.Error
+}
+
+// RecoverShardSync recovers a shard like RecoverShard, and blocks until the
+// recovery completes, or the context is done.
+func (d *DAGStore) RecoverShardSync(ctx context.Context, key shard.Key, _ RecoverOpts) error {
+	res := d.awaitAll(ctx, []shard.Key{key}, func(_ int, w *waiter) (OpID, error) {
+		return d.recoverShard(key, w)
+	})
+	return res[key].Error
+}
+
+// DestroyShardSync destroys a shard like DestroyShard, and blocks until the
+// teardown completes, or the context is done.
+func (d *DAGStore) DestroyShardSync(ctx context.Context, key shard.Key, _ DestroyOpts) (*DestroyResult, error) {
+	res := d.awaitAll(ctx, []shard.Key{key}, func(_ int, w *waiter) (OpID, error) {
+		return d.destroyShard(key, w)
+	})[key]
+	return res.Destroyed, res.Error
+}
+
+// RegisterShardsSync registers the shards concurrently, and blocks until all
+// registrations complete, or the context is done.
+//
+// It returns the result of every registration by shard key. Registrations
+// that fail validation, or that haven't completed by the time the context is
+// done, carry the corresponding error. Only the first registration of every
+// key is submitted.
+func (d *DAGStore) RegisterShardsSync(ctx context.Context, regs []ShardRegistration) map[shard.Key]ShardResult {
+	keys := make([]shard.Key, len(regs))
+	for i, r := range regs {
+		keys[i] = r.Key
+	}
+	return d.awaitAll(ctx, keys, func(i int, w *waiter) (OpID, error) {
+		r := regs[i]
+		return d.registerShard(r.Key, r.Mount, r.Opts, w)
+	})
+}
+
+// AcquireShardsSync acquires the shards concurrently, and blocks until all
+// acquisitions complete, or the context is done.
+//
+// It returns the result of every acquisition by shard key, like
+// RegisterShardsSync. The caller must close the accessors of successful
+// acquisitions; acquisitions that complete after the context is done are
+// released automatically. Every key is acquired once.
+func (d *DAGStore) AcquireShardsSync(ctx context.Context, keys []shard.Key, opts AcquireOpts) map[shard.Key]ShardResult {
+	return d.awaitAll(ctx, keys, func(i int, w *waiter) (OpID, error) {
+		w.prioritize(opts.Priority)
+		return d.acquireShard(keys[i], w)
+	})
+}
+
+// awaitAll submits an operation for every distinct key through submit, and
+// waits for their results until ctx is done, or the DAG store is closed.
+//
+// The results are delivered to a channel with room for all of them, so they
+// are delivered even after ctx is done; that way, those still pending when
+// awaitAll returns can be drained in the background, and their accessors
+// released.
+func (d *DAGStore) awaitAll(ctx context.Context, keys []shard.Key, submit func(i int, w *waiter) (OpID, error)) map[shard.Key]ShardResult {
+	var (
+		ch      = make(chan ShardResult, len(keys))
+		results = make(map[shard.Key]ShardResult, len(keys))
+		pending = make(map[shard.Key]OpID, len(keys))
+	)
+
+	for i, k := range keys {
+		if _, ok := pending[k]; ok {
+			continue
+		}
+		if _, ok := results[k]; ok {
+			continue
+		}
+		id, err := submit(i, &waiter{ctx: ctx, outCh: ch, buffered: true})
+		if err != nil {
+			results[k] = ShardResult{Key: k, Error: err}
+			continue
+		}
+		pending[k] = id
+	}
+
+	for len(pending) > 0 {
+		select {
+		case res := <-ch:
+			delete(pending, res.Key)
+			results[res.Key] = res
+		case <-ctx.Done():
+			d.abandon(ch, results, pending, ctx.Err())
+			return results
+		case <-d.ctx.Done():
+			d.abandon(ch, results, pending, ErrDAGStoreClosed)
+			return results
+		}
+	}
+	return results
+}
+
+// abandon fails the pending operations with err, and drains their results in
+// the background.
+func (d *DAGStore) abandon(ch <-chan ShardResult, results map[shard.Key]ShardResult, pending map[shard.Key]OpID, err error) {
+	for k, id := range pending {
+		results[k] = ShardResult{Key: k, Error: err, OpID: id}
+	}
+	go d.drainAbandoned(ch, len(pending))
+}
+
+// drainAbandoned receives the n results still due on ch after the caller
+// stopped waiting for them, and releases the shards that were acquired.
+func (d *DAGStore) drainAbandoned(ch <-chan ShardResult, n int) {
+	for ; n > 0; n-- {
+		select {
+		case res := <-ch:
+			if res.Accessor == nil {
+				continue
+			}
+			log.Debugw("releasing abandoned shard acquisition", "shard", res.Key, "op_id", res.OpID)
+			if err := res.Accessor.Close(); err != nil {
+				log.Warnw("failed to release abandoned shard acquisition", "shard", res.Key, "op_id", res.OpID, "error", err)
+			}
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
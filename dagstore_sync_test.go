@@ -0,0 +1,137 @@
+package dagstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+func TestSyncOperations(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	k := shard.KeyFromString("foo")
+	err = dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{})
+	require.NoError(t, err)
+
+	err = dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{})
+	require.ErrorIs(t, err, ErrShardExists)
+
+	sa, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.NoError(t, err)
+	require.EqualValues(t, k, sa.Shard())
+
+	_, err = dagst.AcquireShardSync(ctx, shard.KeyFromString("bar"), AcquireOpts{})
+	require.ErrorIs(t, err, ErrShardUnknown)
+
+	// the shard can't be destroyed while acquired.
+	_, err = dagst.DestroyShardSync(ctx, k, DestroyOpts{})
+	require.Error(t, err)
+	require.NoError(t, sa.Close())
+
+	// the shard is not errored, so it can't be recovered.
+	err = dagst.RecoverShardSync(ctx, k, RecoverOpts{})
+	require.Error(t, err)
+
+	res, err := dagst.DestroyShardSync(ctx, k, DestroyOpts{})
+	require.NoError(t, err)
+	require.True(t, res.FullIndex)
+	require.Empty(t, dagst.AllShardsInfo())
+}
+
+func TestBatchOperations(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	a, b, c := shard.KeyFromString("a"), shard.KeyFromString("b"), shard.KeyFromString("c")
+	err = dagst.RegisterShardSync(ctx, a, carv2mnt, RegisterOpts{})
+	require.NoError(t, err)
+
+	// a already exists, and b is registered twice.
+	results := dagst.RegisterShardsSync(ctx, []ShardRegistration{
+		{Key: a, Mount: carv2mnt},
+		{Key: b, Mount: carv2mnt},
+		{Key: b, Mount: carv2mnt},
+		{Key: c, Mount: carv2mnt, Opts: RegisterOpts{LazyInitialization: true}},
+	})
+	require.Len(t, results, 3)
+	require.ErrorIs(t, results[a].Error, ErrShardExists)
+	require.NoError(t, results[b].Error)
+	require.NoError(t, results[c].Error)
+	require.Len(t, dagst.AllShardsInfo(), 3)
+
+	unknown := shard.KeyFromString("unknown")
+	results = dagst.AcquireShardsSync(ctx, []shard.Key{a, b, c, c, unknown}, AcquireOpts{})
+	require.Len(t, results, 4)
+	require.ErrorIs(t, results[unknown].Error, ErrShardUnknown)
+	for _, k := range []shard.Key{a, b, c} {
+		res := results[k]
+		require.NoError(t, res.Error)
+		require.NotZero(t, res.OpID)
+		require.EqualValues(t, k, res.Accessor.Shard())
+
+		info, err := dagst.GetShardInfo(k)
+		require.NoError(t, err)
+		require.EqualValues(t, 1, info.refs)
+		require.NoError(t, res.Accessor.Close())
+	}
+}
+
+func TestAcquireSyncAbandoned(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// register with lazy init, so that the acquisition blocks on the mount.
+	k := shard.KeyFromString("foo")
+	mnt := newBlockingMount(carv2mnt)
+	err = dagst.RegisterShardSync(context.Background(), k, mnt, RegisterOpts{LazyInitialization: true})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// acquire again, deliberately ignoring the caller's context in the
+	// operation itself, so that it completes with an accessor after the
+	// caller gives up.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	results := dagst.awaitAll(ctx, []shard.Key{k}, func(_ int, w *waiter) (OpID, error) {
+		w.ctx = context.Background()
+		return dagst.acquireShard(k, w)
+	})
+	require.ErrorIs(t, results[k].Error, context.Canceled)
+
+	// once the mount unblocks, both abandoned acquisitions are released.
+	mnt.UnblockNext(1)
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(k)
+		require.NoError(t, err)
+		return info.ShardState == ShardStateAvailable && info.refs == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
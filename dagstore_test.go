@@ -1,18 +1,26 @@
 package dagstore
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/multiformats/go-multihash"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
 	dssync "github.com/ipfs/go-datastore/sync"
@@ -24,6 +32,7 @@ import (
 	"github.com/filecoin-project/dagstore/mount"
 	"github.com/filecoin-project/dagstore/shard"
 	"github.com/filecoin-project/dagstore/testdata"
+	"github.com/filecoin-project/dagstore/throttle"
 )
 
 var (
@@ -257,6 +266,78 @@ func TestAcquireAfterRegisterWait(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestOperationIDs(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	sub, err := dagst.Subscribe(TraceFilter{}, SubscribeOpts{})
+	require.NoError(t, err)
+	defer sub.Cancel()
+
+	requireResult := func(ch chan ShardResult) ShardResult {
+		res := <-ch
+		require.NoError(t, res.Error)
+		require.NotZero(t, res.OpID)
+		require.False(t, res.Queued.IsZero())
+		require.False(t, res.Started.Before(res.Queued))
+		require.False(t, res.Finished.Before(res.Started))
+		return res
+	}
+
+	ch := make(chan ShardResult, 1)
+	k := shard.KeyFromString("foo")
+	err = dagst.RegisterShard(context.Background(), k, carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	regID := requireResult(ch).OpID
+
+	err = dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
+	require.NoError(t, err)
+	res := requireResult(ch)
+	acqID := res.OpID
+	require.NotEqual(t, regID, acqID)
+	require.NoError(t, res.Accessor.Close())
+
+	// unknown shards are rejected synchronously, without allocating an
+	// operation id.
+	err = dagst.AcquireShard(context.Background(), shard.KeyFromString("bar"), ch, AcquireOpts{})
+	require.ErrorIs(t, err, ErrShardUnknown)
+	err = dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
+	require.NoError(t, err)
+	res = requireResult(ch)
+	require.Equal(t, acqID+1, res.OpID)
+	require.NoError(t, res.Accessor.Close())
+
+	// the tasks spawned by an operation carry its id; the release was not
+	// submitted as an operation.
+	expected := []struct {
+		op OpType
+		id OpID
+	}{
+		{OpShardRegister, regID},
+		{OpShardInitialize, regID},
+		{OpShardMakeAvailable, regID},
+		{OpShardAcquire, acqID},
+		{OpShardRelease, 0},
+		{OpShardAcquire, acqID + 1},
+		{OpShardRelease, 0},
+	}
+	for _, e := range expected {
+		select {
+		case tr := <-sub.C:
+			require.Equal(t, e.op, tr.Op)
+			require.Equal(t, e.id, tr.OpID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s trace", e.op)
+		}
+	}
+}
+
 func TestConcurrentAcquires(t *testing.T) {
 	dagst, err := NewDAGStore(Config{
 		MountRegistry: testRegistry(t),
@@ -299,6 +380,328 @@ func TestConcurrentAcquires(t *testing.T) {
 	}
 }
 
+func TestEventLoopsPartitionShards(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		EventLoops:    4,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	keys := registerShards(t, dagst, 16, carv2mnt, RegisterOpts{})
+
+	// find two shards processed by different event loops.
+	a := dagst.shards[keys[0]]
+	var b *Shard
+	for _, k := range keys[1:] {
+		if s := dagst.shards[k]; s.loop != a.loop {
+			b = s
+			break
+		}
+	}
+	require.NotNil(t, b)
+
+	// stall the event loop of a by holding its lock, and acquire both shards;
+	// b is acquired while a's acquisition waits.
+	a.lk.Lock()
+	ch := make(chan ShardResult, 1)
+	err = dagst.AcquireShard(context.Background(), a.key, ch, AcquireOpts{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sa, err := dagst.AcquireShardSync(ctx, b.key, AcquireOpts{})
+	require.NoError(t, err)
+	require.NoError(t, sa.Close())
+
+	select {
+	case res := <-ch:
+		t.Fatalf("acquired shard while its event loop was stalled: %v", res)
+	default:
+	}
+	a.lk.Unlock()
+
+	res := <-ch
+	require.NoError(t, res.Error)
+	require.NoError(t, res.Accessor.Close())
+}
+
+func TestUpdateLimits(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:      testRegistry(t),
+		TransientsDir:      t.TempDir(),
+		MaxConcurrentIndex: 1,
+	})
+	require.NoError(t, err)
+
+	stats := dagst.LimitsStats()
+	require.EqualValues(t, 1, stats.Index.Capacity)
+	require.Zero(t, stats.ReadyFetch.Capacity) // unlimited.
+
+	// occupy the only index spot, and queue two more jobs.
+	release := make(chan struct{})
+	var grp errgroup.Group
+	for i := 0; i < 3; i++ {
+		grp.Go(func() error {
+			return dagst.throttleIndex.Do(context.Background(), func(ctx context.Context) error {
+				<-release
+				return nil
+			})
+		})
+	}
+	require.Eventually(t, func() bool {
+		s := dagst.LimitsStats().Index
+		return s.InUse == 1 && s.Waiting == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// raising the limit admits the queued jobs immediately.
+	require.NoError(t, dagst.UpdateLimits(Limits{MaxConcurrentIndex: 3, MaxConcurrentIndexBytes: 1 << 30}))
+	stats = dagst.LimitsStats()
+	require.Equal(t, throttle.Stats{Capacity: 3, InUse: 3}, stats.Index)
+	require.EqualValues(t, 1<<30, stats.IndexBytes.Capacity)
+
+	close(release)
+	require.NoError(t, grp.Wait())
+	require.Zero(t, dagst.LimitsStats().Index.InUse)
+
+	require.Error(t, dagst.UpdateLimits(Limits{MaxConcurrentReadyFetches: -1}))
+}
+
+func TestRetryPolicy(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		RetryPolicy:   RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, Jitter: 0.5},
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	sub, err := dagst.Subscribe(TraceFilter{Ops: []OpType{OpShardRetry}}, SubscribeOpts{})
+	require.NoError(t, err)
+	defer sub.Cancel()
+
+	register := func(name string, mnt mount.Mount) error {
+		ch := make(chan ShardResult, 1)
+		err := dagst.RegisterShard(context.Background(), shard.KeyFromString(name), mnt, ch, RegisterOpts{})
+		require.NoError(t, err)
+		return (<-ch).Error
+	}
+
+	// the mount fails twice before succeeding; both retries are traced.
+	mnt := &flakyMount{Mount: carv2mnt, failures: 2}
+	require.NoError(t, register("flaky", mnt))
+	require.EqualValues(t, 3, atomic.LoadInt32(&mnt.fetches))
+	for attempt := 1; attempt <= 2; attempt++ {
+		tr := <-sub.C
+		require.Equal(t, attempt, tr.Attempt)
+		require.Error(t, tr.Error)
+		require.Equal(t, ShardStateInitializing, tr.After.ShardState)
+	}
+
+	// exhausting the attempts fails the shard.
+	mnt = &flakyMount{Mount: carv2mnt, failures: 3}
+	require.Error(t, register("exhausted", mnt))
+	require.EqualValues(t, 3, atomic.LoadInt32(&mnt.fetches))
+
+	// permanent errors aren't retried.
+	mnt = &flakyMount{Mount: carv2mnt, failures: 3, permanent: true}
+	require.Error(t, register("permanent", mnt))
+	require.EqualValues(t, 1, atomic.LoadInt32(&mnt.fetches))
+
+	info, err := dagst.GetShardInfo(shard.KeyFromString("permanent"))
+	require.NoError(t, err)
+	require.Equal(t, ShardStateErrored, info.ShardState)
+
+	// index failures and unrestorable mounts are permanent, even if the mount
+	// considers every error transient.
+	s := dagst.shards[shard.KeyFromString("flaky")]
+	require.True(t, dagst.retryable(s, errors.New("flaky mount failure")))
+	require.False(t, dagst.retryable(s, &indexError{errors.New("bad index")}))
+	require.False(t, dagst.retryable(s, fmt.Errorf("restore: %w", ErrMountUnrestorable)))
+}
+
+func TestRetryableHTTPMount(t *testing.T) {
+	status := http.StatusForbidden
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	mnt := &mount.HTTPMount{URL: srv.URL, Client: srv.Client()}
+	u, err := mount.Upgrade(mnt, throttle.Noop(), t.TempDir(), "foo", "")
+	require.NoError(t, err)
+	s := &Shard{key: shard.KeyFromString("foo"), mount: u}
+
+	// the mount classifies the errors it produced.
+	_, err = u.Fetch(context.Background())
+	require.Error(t, err)
+	require.False(t, dagst.retryable(s, err))
+	status = http.StatusServiceUnavailable
+	_, err = u.Fetch(context.Background())
+	require.Error(t, err)
+	require.True(t, dagst.retryable(s, err))
+
+	// but not failures of the upgrader or the local filesystem.
+	require.True(t, dagst.retryable(s, &mount.TransientIntegrityError{Path: "foo", Reason: "size mismatch"}))
+	_, err = os.Open(t.TempDir() + "/missing")
+	require.True(t, dagst.retryable(s, fmt.Errorf("failed to open partial transient: %w", err)))
+}
+
+func TestAutoRecovery(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		AutoRecovery:  AutoRecoveryPolicy{MaxAttempts: 2, InitialBackoff: 10 * time.Millisecond},
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	register := func(name string, mnt mount.Mount) shard.Key {
+		k := shard.KeyFromString(name)
+		ch := make(chan ShardResult, 1)
+		err := dagst.RegisterShard(context.Background(), k, mnt, ch, RegisterOpts{})
+		require.NoError(t, err)
+		require.Error(t, (<-ch).Error)
+		return k
+	}
+	permanentFailure := func(k shard.Key) *PermanentFailureError {
+		var perr *PermanentFailureError
+		require.Eventually(t, func() bool {
+			info, err := dagst.GetShardInfo(k)
+			require.NoError(t, err)
+			return info.ShardState == ShardStateErrored && errors.As(info.Error, &perr)
+		}, 5*time.Second, 10*time.Millisecond)
+		return perr
+	}
+
+	// the shard is recovered after failing twice.
+	flaky := &flakyMount{Mount: carv2mnt, failures: 2}
+	k := register("flaky", flaky)
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(k)
+		require.NoError(t, err)
+		return info.ShardState == ShardStateAvailable
+	}, 5*time.Second, 10*time.Millisecond)
+	require.EqualValues(t, 3, atomic.LoadInt32(&flaky.fetches))
+
+	// the shard is marked as permanently failed once it exhausts the
+	// recovery attempts.
+	flaky = &flakyMount{Mount: carv2mnt, failures: 10}
+	perr := permanentFailure(register("exhausted", flaky))
+	require.Equal(t, FailureTransient, perr.Class)
+	require.Equal(t, 2, perr.Attempts)
+	require.EqualValues(t, 3, atomic.LoadInt32(&flaky.fetches))
+
+	// shards that can't be indexed are classified as such.
+	perr = permanentFailure(register("junk", junkmnt))
+	require.Equal(t, FailureIndexCorrupt, perr.Class)
+	require.ErrorIs(t, perr, ErrIndexCorrupt)
+
+	// shards whose mount is gone aren't recovered.
+	perr = permanentFailure(register("gone", &mount.FSMount{FS: testdata.FS, Path: "missing.car"}))
+	require.Equal(t, FailureMountGone, perr.Class)
+	require.Zero(t, perr.Attempts)
+}
+
+func TestAutoRecoveryHTTPMount(t *testing.T) {
+	// the server serves junk on the first download, and the CAR afterwards.
+	var gets int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bz := testdata.CarV2
+		if r.Method == http.MethodGet && atomic.AddInt32(&gets, 1) == 1 {
+			bz = bytes.Repeat([]byte{0xff}, len(testdata.CarV2))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(bz)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(bz)
+		}
+	}))
+	defer srv.Close()
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		AutoRecovery:  AutoRecoveryPolicy{MaxAttempts: 2, InitialBackoff: 10 * time.Millisecond},
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	// the index failure is recovered from, rather than blamed on the mount.
+	k := shard.KeyFromString("http")
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), k, &mount.HTTPMount{URL: srv.URL, Client: srv.Client()}, ch, RegisterOpts{})
+	require.NoError(t, err)
+	require.ErrorIs(t, (<-ch).Error, ErrIndexCorrupt)
+
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(k)
+		require.NoError(t, err)
+		return info.ShardState == ShardStateAvailable
+	}, 5*time.Second, 10*time.Millisecond)
+	require.EqualValues(t, 2, atomic.LoadInt32(&gets))
+}
+
+func TestAcquirePriority(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:             testRegistry(t),
+		TransientsDir:             t.TempDir(),
+		MaxConcurrentReadyFetches: 1,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	// the initialization triggered by an acquisition fetches with its
+	// priority.
+	ctx := context.Background()
+	lazy := &priorityMount{Mount: carv2mnt}
+	err = dagst.RegisterShardSync(ctx, shard.KeyFromString("lazy"), lazy, RegisterOpts{LazyInitialization: true})
+	require.NoError(t, err)
+	sa, err := dagst.AcquireShardSync(ctx, shard.KeyFromString("lazy"), AcquireOpts{Priority: throttle.PriorityHigh})
+	require.NoError(t, err)
+	require.NoError(t, sa.Close())
+	require.Equal(t, []throttle.Priority{throttle.PriorityHigh}, lazy.fetches())
+
+	// registrations fetch with their own priority.
+	eager := &priorityMount{Mount: carv2mnt}
+	err = dagst.RegisterShardSync(ctx, shard.KeyFromString("eager"), eager, RegisterOpts{Priority: throttle.PriorityLow})
+	require.NoError(t, err)
+	require.Equal(t, []throttle.Priority{throttle.PriorityLow}, eager.fetches())
+
+	// parked acquirers are served by priority, then in arrival order.
+	ws := []*waiter{
+		{id: 1, priority: throttle.PriorityLow},
+		{id: 2},
+		{id: 3, priority: throttle.PriorityHigh},
+		{id: 4},
+	}
+	sortByPriority(ws)
+	var ids []OpID
+	for _, w := range ws {
+		ids = append(ids, w.id)
+	}
+	require.Equal(t, []OpID{3, 2, 4, 1}, ids)
+}
+
 func TestRestartRestoresState(t *testing.T) {
 	dir := t.TempDir()
 	store := datastore.NewLogDatastore(dssync.MutexWrap(datastore.NewMapDatastore()), "trace")
@@ -365,160 +768,846 @@ func TestRestartRestoresState(t *testing.T) {
 	}
 }
 
-func TestRestartResumesRegistration(t *testing.T) {
+func TestRestoreUnrestorableShards(t *testing.T) {
 	dir := t.TempDir()
-	store := datastore.NewLogDatastore(dssync.MutexWrap(datastore.NewMapDatastore()), "trace")
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: dir,
+		Datastore:     store,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	keys := registerShards(t, dagst, 2, carv2mnt, RegisterOpts{})
+	err = dagst.Close()
+	require.NoError(t, err)
+
+	// make the mount of the second shard unrestorable by changing its
+	// scheme, and add a record that can't be parsed at all.
+	ctx := context.Background()
+	dsKey := StoreNamespace.ChildString(keys[1].String())
+	v, err := store.Get(ctx, dsKey)
+	require.NoError(t, err)
+	ps, err := decodeRecord(v)
+	require.NoError(t, err)
+	ps.URL = strings.Replace(ps.URL, "fs://", "gone://", 1)
+	v, err = json.Marshal(ps)
+	require.NoError(t, err)
+	require.NoError(t, store.Put(ctx, dsKey, v))
+	require.NoError(t, store.Put(ctx, StoreNamespace.ChildString("garbage"), []byte("{")))
+
+	config := Config{
+		MountRegistry:  testRegistry(t),
+		TransientsDir:  dir,
+		Datastore:      store,
+		RecoverOnStart: RecoverOnAcquire,
+		RestorePolicy:  RestoreStrict,
+	}
+
+	// strict restore fails to start.
+	dagst, err = NewDAGStore(config)
+	require.NoError(t, err)
+	err = dagst.Start(ctx)
+	require.Error(t, err)
+	require.NoError(t, dagst.Close())
+
+	// lenient restore loads the shard in errored state, and quarantines the
+	// garbage record.
+	config.RestorePolicy = RestoreLenient
+	dagst, err = NewDAGStore(config)
+	require.NoError(t, err)
+	err = dagst.Start(ctx)
+	require.NoError(t, err)
+
+	info := dagst.AllShardsInfo()
+	require.Len(t, info, 2)
+	require.Equal(t, ShardStateAvailable, info[keys[0]].ShardState)
+	require.Equal(t, ShardStateErrored, info[keys[1]].ShardState)
+	require.ErrorIs(t, info[keys[1]].Error, ErrMountUnrestorable)
+
+	quarantined := dagst.QuarantinedShards()
+	require.Len(t, quarantined, 1)
+	require.Equal(t, "/garbage", quarantined[0].Key)
+	require.Equal(t, []byte("{"), quarantined[0].Record)
+	require.Error(t, quarantined[0].Error)
+
+	// the shard isn't recovered on acquire, and its original mount URL is
+	// preserved when its state is persisted.
+	_, err = dagst.AcquireShardSync(ctx, keys[1], AcquireOpts{})
+	require.ErrorIs(t, err, ErrMountUnrestorable)
+	v, err = store.Get(ctx, dsKey)
+	require.NoError(t, err)
+	ps, err = decodeRecord(v)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(ps.URL, "gone://"))
+
+	// the shard can be destroyed.
+	_, err = dagst.DestroyShardSync(ctx, keys[1], DestroyOpts{})
+	require.NoError(t, err)
+	require.Len(t, dagst.AllShardsInfo(), 1)
+	_, err = store.Get(ctx, dsKey)
+	require.ErrorIs(t, err, datastore.ErrNotFound)
+}
+
+func TestMigrateLegacyRecords(t *testing.T) {
+	dir := t.TempDir()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: dir,
+		Datastore:     store,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	keys := registerShards(t, dagst, 2, carv2mnt, RegisterOpts{})
+	err = dagst.Close()
+	require.NoError(t, err)
+
+	// rewrite the records in the legacy JSON format, as older versions did.
+	ctx := context.Background()
+	legacy := func() {
+		for _, k := range keys {
+			dsKey := StoreNamespace.ChildString(k.String())
+			v, err := store.Get(ctx, dsKey)
+			require.NoError(t, err)
+			require.Equal(t, recordVersion1, v[0])
+			ps, err := decodeRecord(v)
+			require.NoError(t, err)
+			v, err = json.Marshal(ps)
+			require.NoError(t, err)
+			require.NoError(t, store.Put(ctx, dsKey, v))
+		}
+	}
+	legacy()
+	require.NoError(t, store.Put(ctx, StoreNamespace.ChildString("garbage"), []byte("{")))
+
+	// the offline migration rewrites the legacy records, and leaves the
+	// garbage record untouched.
+	n, err := MigrateDatastore(ctx, store)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	n, err = MigrateDatastore(ctx, store)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	v, err := store.Get(ctx, StoreNamespace.ChildString("garbage"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("{"), v)
+
+	// legacy records are also readable, and migrated on start.
+	legacy()
+	dagst, err = NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: dir,
+		Datastore:     store,
+	})
+	require.NoError(t, err)
+	err = dagst.Start(ctx)
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	info := dagst.AllShardsInfo()
+	require.Len(t, info, 2)
+	for _, k := range keys {
+		require.Equal(t, ShardStateAvailable, info[k].ShardState)
+
+		v, err := store.Get(ctx, StoreNamespace.ChildString(k.String()))
+		require.NoError(t, err)
+		require.Equal(t, recordVersion1, v[0])
+	}
+	require.Len(t, dagst.QuarantinedShards(), 1)
+}
+
+func TestRestoreLegacyJSONRecord(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
 	r := testRegistry(t)
+	u, err := r.Represent(carv2mnt)
+	require.NoError(t, err)
 
-	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.FS}))
+	// a record as written by versions that persisted shards as JSON.
+	k := shard.KeyFromString("legacy")
+	dsKey := StoreNamespace.ChildString(k.String())
+	v := fmt.Sprintf(`{"k":%q,"u":%q,"t":"","s":%d,"l":true,"e":""}`, k.String(), u.String(), ShardStateNew)
+	require.NoError(t, store.Put(ctx, dsKey, []byte(v)))
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: r,
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+	})
 	require.NoError(t, err)
+	err = dagst.Start(ctx)
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	// the shard is loaded...
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateNew, info.ShardState)
+	require.NoError(t, info.Error)
+	require.Empty(t, dagst.QuarantinedShards())
+
+	// ...and its record is rewritten in the versioned CBOR format.
+	b, err := store.Get(ctx, dsKey)
+	require.NoError(t, err)
+	require.Equal(t, recordVersion1, b[0])
+	ps := new(PersistedShard)
+	require.NoError(t, ps.UnmarshalCBOR(bytes.NewReader(b[1:])))
+	require.Equal(t, k.String(), ps.Key)
+	require.Equal(t, u.String(), ps.URL)
+	require.Equal(t, ShardStateNew, ps.State)
+	require.True(t, ps.Lazy)
+
+	// the shard is usable.
+	acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.NoError(t, err)
+	require.NoError(t, acc.Close())
+}
+
+func TestRestartResumesRegistration(t *testing.T) {
+	// the blocked mount ignores cancellation; don't wait for it on close.
+	defer shortenCloseGracePeriod(100 * time.Millisecond)()
+
+	dir := t.TempDir()
+	store := datastore.NewLogDatastore(dssync.MutexWrap(datastore.NewMapDatastore()), "trace")
+	r := testRegistry(t)
+
+	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.FS}))
+	require.NoError(t, err)
+
+	sink := tracer(128)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: r,
+		TransientsDir: dir,
+		Datastore:     store,
+		TraceCh:       sink,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// start registering a shard -> registration will not complete as mount.Fetch will hang.
+	k := shard.KeyFromString("test")
+	ch := make(chan ShardResult, 1)
+	block := newBlockingMount(carv2mnt)
+	err = dagst.RegisterShard(context.Background(), k, block, ch, RegisterOpts{})
+	require.NoError(t, err)
+
+	// receive at most two traces in 1 second.
+	traces := make([]Trace, 16)
+	n, timedOut := sink.Read(traces, 1*time.Second)
+	require.Equal(t, 2, n)
+	require.True(t, timedOut)
+
+	// no OpMakeAvailable trace; shard state is initializing.
+	require.Equal(t, OpShardRegister, traces[0].Op)
+	require.Equal(t, ShardStateNew, traces[0].After.ShardState)
+
+	require.Equal(t, OpShardInitialize, traces[1].Op)
+	require.Equal(t, ShardStateInitializing, traces[1].After.ShardState)
+
+	// corroborate we see the same through the API.
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.EqualValues(t, ShardStateInitializing, info.ShardState)
+
+	t.Log("closing")
+
+	// close the dagstore and remove the transients.
+	err = dagst.Close()
+	require.NoError(t, err)
+
+	// start a new DAGStore and do not block the fetch this time -> registration should work.
+	// create a new dagstore with the same datastore.
+	//
+	// Instantiate a new registry using a blocking mount that we control as
+	// a template. Because UnblockCh is exported, it is a templated field, so
+	// all mounts will await for tokens on that shared channel.
+	r = testRegistry(t)
+	bm := newBlockingMount(&mount.FSMount{FS: testdata.FS})
+	err = r.Register("block", bm)
+	require.NoError(t, err)
+
+	// unblock the mount this time!
+	bm.UnblockNext(1)
+
+	dagst, err = NewDAGStore(Config{
+		MountRegistry: r,
+		TransientsDir: dir,
+		Datastore:     store,
+		TraceCh:       sink,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// this time we will receive three traces; OpShardInitialize, and OpShardMakeAvailable.
+	n, timedOut = sink.Read(traces, 1*time.Second)
+	require.Equal(t, 3, n)
+	require.True(t, timedOut)
+
+	// trace 1.
+	require.Equal(t, OpShardRegister, traces[0].Op)
+	require.Equal(t, ShardStateNew, traces[0].After.ShardState)
+
+	// trace 2.
+	require.Equal(t, OpShardInitialize, traces[1].Op)
+	require.Equal(t, ShardStateInitializing, traces[1].After.ShardState)
+
+	// trace 3.
+	require.Equal(t, OpShardMakeAvailable, traces[2].Op)
+	require.Equal(t, ShardStateAvailable, traces[2].After.ShardState)
+
+	// ensure we have indices.
+	idx, err := dagst.indices.GetFullIndex(k)
+	require.NoError(t, err)
+	require.NotNil(t, idx)
+
+	// now let's acquire the shard, and ensure we receive two more traces.
+	// one for OpAcquire, one for OpRelease.
+	accessors := acquireShard(t, dagst, k, 1)
+	releaseAll(t, dagst, k, accessors)
+
+	n, timedOut = sink.Read(traces, 1*time.Second)
+	require.Equal(t, 2, n)
+	require.True(t, timedOut)
+
+	// trace 1.
+	require.Equal(t, OpShardAcquire, traces[0].Op)
+	require.Equal(t, ShardStateServing, traces[0].After.ShardState)
+
+	// trace 2.
+	require.Equal(t, OpShardRelease, traces[1].Op)
+	require.Equal(t, ShardStateAvailable, traces[1].After.ShardState)
+}
+
+func TestGC(t *testing.T) {
+	dir := t.TempDir()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: dir,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// register 100 shards
+	// acquire 25 with 5 acquirers, release 2 acquirers (refcount 3); non reclaimable
+	// acquire another 25, release them all, they're reclaimable
+	shards := registerShards(t, dagst, 100, carv2mnt, RegisterOpts{})
+	for _, k := range shards[0:25] {
+		accessors := acquireShard(t, dagst, k, 5)
+		for _, acc := range accessors[:2] {
+			err := acc.Close()
+			require.NoError(t, err)
+		}
+	}
+	for _, k := range shards[25:50] {
+		accessors := acquireShard(t, dagst, k, 5)
+		releaseAll(t, dagst, k, accessors)
+	}
+
+	results, err := dagst.GC(context.Background())
+	require.NoError(t, err)
+	require.Len(t, results.Shards, 75) // all but the second batch of 25 have been reclaimed.
+	require.Zero(t, results.ShardFailures())
+
+	for i := 25; i < 100; i++ {
+		k := shard.KeyFromString(fmt.Sprintf("shard-%d", i))
+		err, ok := results.Shards[k]
+		require.True(t, ok)
+		require.NoError(t, err)
+	}
+}
+
+// gatedGCPolicy delegates to a policy once enabled, and reclaims nothing
+// until then.
+type gatedGCPolicy struct {
+	enabled int32
+	GCPolicy
+}
+
+func (p *gatedGCPolicy) Reclaim(state GCState, candidates []GCCandidate) []shard.Key {
+	if atomic.LoadInt32(&p.enabled) == 0 {
+		return nil
+	}
+	return p.GCPolicy.Reclaim(state, candidates)
+}
+
+func TestAutomaticGC(t *testing.T) {
+	policy := &gatedGCPolicy{GCPolicy: &DefaultGCPolicy{MaxTransients: 2}}
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		GCInterval:    50 * time.Millisecond,
+		GCPolicy:      policy,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// register 4 shards, and access them so that the second and third ones
+	// are the least recently accessed.
+	shards := registerShards(t, dagst, 4, carv2mnt, RegisterOpts{})
+	for _, i := range []int{1, 2, 3, 0} {
+		releaseAll(t, dagst, shards[i], acquireShard(t, dagst, shards[i], 1))
+	}
+
+	hasTransient := func(k shard.Key) bool {
+		dagst.lk.RLock()
+		defer dagst.lk.RUnlock()
+		return dagst.shards[k].mount.TransientPath() != ""
+	}
+
+	// the transients of the two least recently accessed shards are reclaimed.
+	atomic.StoreInt32(&policy.enabled, 1)
+	require.Eventually(t, func() bool {
+		return !hasTransient(shards[1]) && !hasTransient(shards[2])
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, hasTransient(shards[0]))
+	require.True(t, hasTransient(shards[3]))
+}
+
+func TestTransientsQuotaEviction(t *testing.T) {
+	size := int64(len(testdata.CarV2))
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:           testRegistry(t),
+		TransientsDir:           t.TempDir(),
+		TransientsQuota:         2*size + size/2,
+		TransientsHighWatermark: 1,
+		TransientsLowWatermark:  0.81, // room for two transients.
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	register := func(k shard.Key) {
+		ch := make(chan ShardResult, 1)
+		err := dagst.RegisterShard(context.Background(), k, carv2mnt, ch, RegisterOpts{})
+		require.NoError(t, err)
+		res := <-ch
+		require.NoError(t, res.Error)
+	}
+	hasTransient := func(k shard.Key) bool {
+		return dagst.shards[k].mount.TransientPath() != ""
+	}
+
+	a, b, c, d := shard.KeyFromString("a"), shard.KeyFromString("b"), shard.KeyFromString("c"), shard.KeyFromString("d")
+	register(a)
+	register(b)
+
+	// access a, so that b is the least recently accessed shard.
+	releaseAll(t, dagst, a, acquireShard(t, dagst, a, 1))
+
+	// registering c goes over the quota, and evicts b. The eviction runs
+	// after the registration result is dispatched, so wait for it.
+	register(c)
+	require.Eventually(t, func() bool { return !hasTransient(b) }, 5*time.Second, 10*time.Millisecond)
+	require.True(t, hasTransient(a))
+	require.True(t, hasTransient(c))
+	require.EqualValues(t, 2*size, dagst.transientsUsage())
+
+	// pin a, which is now the least recently accessed shard; registering d
+	// evicts c instead.
+	require.NoError(t, dagst.PinTransient(a))
+	register(d)
+	require.Eventually(t, func() bool { return !hasTransient(c) }, 5*time.Second, 10*time.Millisecond)
+	require.True(t, hasTransient(a))
+	require.True(t, hasTransient(d))
+
+	// GC doesn't reclaim pinned transients.
+	res, err := dagst.GC(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, res.ShardFailures())
+	require.EqualValues(t, size, res.ReclaimedBytes)
+	require.NotContains(t, res.Shards, a)
+	require.True(t, hasTransient(a))
+	require.False(t, hasTransient(d))
+
+	require.NoError(t, dagst.UnpinTransient(a))
+	res, err = dagst.GC(context.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, size, res.ReclaimedBytes)
+	require.False(t, hasTransient(a))
+
+	// pinning unknown shards fails.
+	require.ErrorIs(t, dagst.PinTransient(shard.KeyFromString("unknown")), ErrShardUnknown)
+}
+
+func TestExistingTransientSurvivesEviction(t *testing.T) {
+	ctx := context.Background()
+	size := int64(len(testdata.CarV2))
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:           testRegistry(t),
+		TransientsDir:           t.TempDir(),
+		TransientsQuota:         size + size/2,
+		TransientsHighWatermark: 1,
+		TransientsLowWatermark:  0.5,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(ctx)
+	require.NoError(t, err)
+
+	// the existing transient lives outside the transients directory.
+	existing := t.TempDir() + "/existing.car"
+	require.NoError(t, os.WriteFile(existing, testdata.CarV2, 0644))
+
+	register := func(k shard.Key, opts RegisterOpts) {
+		ch := make(chan ShardResult, 1)
+		err := dagst.RegisterShard(ctx, k, carv2mnt, ch, opts)
+		require.NoError(t, err)
+		res := <-ch
+		require.NoError(t, res.Error)
+	}
+
+	ext, a, b := shard.KeyFromString("ext"), shard.KeyFromString("a"), shard.KeyFromString("b")
+	register(ext, RegisterOpts{ExistingTransient: existing})
+	require.Zero(t, dagst.transientsUsage())
+
+	// registering b goes over the quota, and evicts our own transients only.
+	register(a, RegisterOpts{})
+	register(b, RegisterOpts{})
+	require.Eventually(t, func() bool { return dagst.transientsUsage() == 0 }, 5*time.Second, 10*time.Millisecond)
+	_, err = os.Stat(existing)
+	require.NoError(t, err)
+
+	// neither does GC remove it...
+	_, err = dagst.GC(ctx)
+	require.NoError(t, err)
+	_, err = os.Stat(existing)
+	require.NoError(t, err)
+
+	// ...nor destroying the shard.
+	ch := make(chan ShardResult, 1)
+	err = dagst.DestroyShard(ctx, ext, ch, DestroyOpts{})
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Error)
+	require.False(t, res.Destroyed.Transient)
+	_, err = os.Stat(existing)
+	require.NoError(t, err)
+}
+
+func TestTransientsQuotaBlocksFetches(t *testing.T) {
+	size := int64(len(testdata.CarV2))
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:           testRegistry(t),
+		TransientsDir:           t.TempDir(),
+		TransientsQuota:         size,
+		TransientsHighWatermark: 1,
+		TransientsLowWatermark:  0.5,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	a, b := shard.KeyFromString("a"), shard.KeyFromString("b")
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), a, carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Error)
+
+	// hold a, so that its transient can't be evicted.
+	accs := acquireShard(t, dagst, a, 1)
+
+	// registering b needs to fetch its transient, which has to wait until
+	// there's room.
+	err = dagst.RegisterShard(context.Background(), b, carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	select {
+	case res := <-ch:
+		t.Fatalf("registration completed while over quota: %v", res)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// releasing a makes it evictable; b's registration then proceeds.
+	releaseAll(t, dagst, a, accs)
+	select {
+	case res := <-ch:
+		require.NoError(t, res.Error)
+	case <-time.After(5 * time.Second):
+		t.Fatal("registration didn't complete after space was freed")
+	}
+	require.Empty(t, dagst.shards[a].mount.TransientPath())
+	require.NotEmpty(t, dagst.shards[b].mount.TransientPath())
+}
+
+func TestTransientsQuotaInvalidWatermarks(t *testing.T) {
+	_, err := NewDAGStore(Config{
+		TransientsDir:           t.TempDir(),
+		TransientsQuota:         1 << 20,
+		TransientsHighWatermark: 0.5,
+		TransientsLowWatermark:  0.8,
+	})
+	require.Error(t, err)
+}
+
+func TestManifests(t *testing.T) {
+	ctx := context.Background()
+	repo, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:      testRegistry(t),
+		TransientsDir:      t.TempDir(),
+		IndexRepo:          repo,
+		ManifestGenerators: []ManifestGenerator{RootsManifestGenerator{}, AllCIDsManifestGenerator{}, DAGManifestGenerator{}},
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	k := registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})[0]
+
+	keys, err := dagst.ListManifests(k)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []index.ManifestKey{
+		{Shard: k, GenRule: "roots", GenVersion: 1},
+		{Shard: k, GenRule: "all-cids", GenVersion: 1},
+		{Shard: k, GenRule: "dag", GenVersion: 1},
+	}, keys)
+
+	// the roots manifest only contains the root.
+	roots, err := dagst.GetManifest(index.ManifestKey{Shard: k, GenRule: "roots", GenVersion: 1})
+	require.NoError(t, err)
+	l, err := roots.Len()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, l)
+	ok, err := roots.Contains(testdata.RootCID)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// the all-cids manifest covers every block in the index.
+	ii, err := dagst.GetIterableIndex(k)
+	require.NoError(t, err)
+	distinct := make(map[string]struct{})
+	err = ii.ForEach(func(h multihash.Multihash, _ uint64) error {
+		distinct[string(h)] = struct{}{}
+		return nil
+	})
+	require.NoError(t, err)
+
+	all, err := dagst.GetManifest(index.ManifestKey{Shard: k, GenRule: "all-cids", GenVersion: 1})
+	require.NoError(t, err)
+	err = all.ForEach(func(c cid.Cid) (bool, error) {
+		delete(distinct, string(c.Hash()))
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.Empty(t, distinct)
+	count, err := all.Len()
+	require.NoError(t, err)
+
+	// the test CAR holds a single complete DAG, so the dag manifest contains
+	// every block, starting from the root.
+	dag, err := dagst.GetManifest(index.ManifestKey{Shard: k, GenRule: "dag", GenVersion: 1})
+	require.NoError(t, err)
+	l, err = dag.Len()
+	require.NoError(t, err)
+	require.Equal(t, count, l)
+	err = all.ForEach(func(c cid.Cid) (bool, error) {
+		return dag.Contains(c)
+	})
+	require.NoError(t, err)
+
+	// unknown shards and manifests.
+	_, err = dagst.ListManifests(shard.KeyFromString("unknown"))
+	require.ErrorIs(t, err, ErrShardUnknown)
+	_, err = dagst.GetManifest(index.ManifestKey{Shard: k, GenRule: "roots", GenVersion: 2})
+	require.ErrorIs(t, err, index.ErrNotFound)
+
+	// destroying the shard drops its manifests.
+	ch := make(chan ShardResult, 1)
+	err = dagst.DestroyShard(ctx, k, ch, DestroyOpts{})
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Error)
+	require.True(t, res.Destroyed.Manifests)
+
+	keys, err = repo.ListManifests(k)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+}
+
+func TestManifestGeneratorsRequireRepo(t *testing.T) {
+	_, err := NewDAGStore(Config{
+		TransientsDir:      t.TempDir(),
+		IndexRepo:          fullIndexRepoOnly{index.NewMemoryRepo()},
+		ManifestGenerators: []ManifestGenerator{RootsManifestGenerator{}},
+	})
+	require.Error(t, err)
+
+	_, err = NewDAGStore(Config{
+		TransientsDir:      t.TempDir(),
+		ManifestGenerators: []ManifestGenerator{RootsManifestGenerator{}, RootsManifestGenerator{}},
+	})
+	require.Error(t, err)
+}
 
-	sink := tracer(128)
+// fullIndexRepoOnly hides the manifest methods of a repo.
+type fullIndexRepoOnly struct {
+	index.FullIndexRepo
+}
+
+func TestDestroyShard(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
 	dagst, err := NewDAGStore(Config{
-		MountRegistry: r,
-		TransientsDir: dir,
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
 		Datastore:     store,
-		TraceCh:       sink,
 	})
 	require.NoError(t, err)
 
 	err = dagst.Start(context.Background())
 	require.NoError(t, err)
 
-	// start registering a shard -> registration will not complete as mount.Fetch will hang.
-	k := shard.KeyFromString("test")
-	ch := make(chan ShardResult, 1)
-	block := newBlockingMount(carv2mnt)
-	err = dagst.RegisterShard(context.Background(), k, block, ch, RegisterOpts{})
-	require.NoError(t, err)
+	keys := registerShards(t, dagst, 2, carv2mnt, RegisterOpts{})
+	k, other := keys[0], keys[1]
 
-	// receive at most two traces in 1 second.
-	traces := make([]Trace, 16)
-	n, timedOut := sink.Read(traces, 1*time.Second)
-	require.Equal(t, 2, n)
-	require.True(t, timedOut)
+	ii, err := dagst.GetIterableIndex(k)
+	require.NoError(t, err)
+	var mhs []multihash.Multihash
+	err = ii.ForEach(func(h multihash.Multihash, _ uint64) error {
+		mhs = append(mhs, h)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, mhs)
 
-	// no OpMakeAvailable trace; shard state is initializing.
-	require.Equal(t, OpShardRegister, traces[0].Op)
-	require.Equal(t, ShardStateNew, traces[0].After.ShardState)
+	// destroying a shard with active acquirers fails.
+	accessors := acquireShard(t, dagst, k, 1)
+	ch := make(chan ShardResult, 1)
+	err = dagst.DestroyShard(ctx, k, ch, DestroyOpts{})
+	require.NoError(t, err)
+	res := <-ch
+	require.Error(t, res.Error)
+	releaseAll(t, dagst, k, accessors)
 
-	require.Equal(t, OpShardInitialize, traces[1].Op)
-	require.Equal(t, ShardStateInitializing, traces[1].After.ShardState)
+	transient := dagst.shards[k].mount.TransientPath()
+	require.NotEmpty(t, transient)
 
-	// corroborate we see the same through the API.
-	info, err := dagst.GetShardInfo(k)
+	err = dagst.DestroyShard(ctx, k, ch, DestroyOpts{})
 	require.NoError(t, err)
-	require.EqualValues(t, ShardStateInitializing, info.ShardState)
+	res = <-ch
+	require.NoError(t, res.Error)
+	require.Equal(t, &DestroyResult{TopLevelIndex: true, FullIndex: true, Transient: true, State: true}, res.Destroyed)
 
-	t.Log("closing")
+	// the shard is gone from the catalogue.
+	_, err = dagst.GetShardInfo(k)
+	require.ErrorIs(t, err, ErrShardUnknown)
+	require.Len(t, dagst.AllShardsInfo(), 1)
 
-	// close the dagstore and remove the transients.
-	err = dagst.Close()
+	// the full index and transient are gone.
+	istat, err := dagst.indices.StatFullIndex(k)
 	require.NoError(t, err)
+	require.False(t, istat.Exists)
+	_, err = os.Stat(transient)
+	require.ErrorIs(t, err, os.ErrNotExist)
 
-	// start a new DAGStore and do not block the fetch this time -> registration should work.
-	// create a new dagstore with the same datastore.
-	//
-	// Instantiate a new registry using a blocking mount that we control as
-	// a template. Because UnblockCh is exported, it is a templated field, so
-	// all mounts will await for tokens on that shared channel.
-	r = testRegistry(t)
-	bm := newBlockingMount(&mount.FSMount{FS: testdata.FS})
-	err = r.Register("block", bm)
+	// the persisted state is gone.
+	has, err := store.Has(ctx, StoreNamespace.ChildString(k.String()))
 	require.NoError(t, err)
+	require.False(t, has)
 
-	// unblock the mount this time!
-	bm.UnblockNext(1)
+	// the top-level index only reports the remaining shard.
+	for _, h := range mhs {
+		ks, err := dagst.ShardsContainingMultihash(ctx, h)
+		require.NoError(t, err)
+		require.Equal(t, []shard.Key{other}, ks)
+	}
 
-	dagst, err = NewDAGStore(Config{
-		MountRegistry: r,
-		TransientsDir: dir,
-		Datastore:     store,
-		TraceCh:       sink,
+	// the key can be registered again.
+	err = dagst.RegisterShard(ctx, k, carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	res = <-ch
+	require.NoError(t, res.Error)
+}
+
+func TestDestroyShardRemovesSidecarFiles(t *testing.T) {
+	ctx := context.Background()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
 	})
 	require.NoError(t, err)
 
 	err = dagst.Start(context.Background())
 	require.NoError(t, err)
+	defer dagst.Close()
 
-	// this time we will receive three traces; OpShardInitialize, and OpShardMakeAvailable.
-	n, timedOut = sink.Read(traces, 1*time.Second)
-	require.Equal(t, 3, n)
-	require.True(t, timedOut)
-
-	// trace 1.
-	require.Equal(t, OpShardRegister, traces[0].Op)
-	require.Equal(t, ShardStateNew, traces[0].After.ShardState)
-
-	// trace 2.
-	require.Equal(t, OpShardInitialize, traces[1].Op)
-	require.Equal(t, ShardStateInitializing, traces[1].After.ShardState)
+	keys := registerShards(t, dagst, 1, &seekableMount{Mount: carv2mnt}, RegisterOpts{})
+	k := keys[0]
 
-	// trace 3.
-	require.Equal(t, OpShardMakeAvailable, traces[2].Op)
-	require.Equal(t, ShardStateAvailable, traces[2].After.ShardState)
+	// simulate the leftovers of an interrupted download.
+	paths := dagst.shards[k].mount.OwnedPaths()
+	require.Greater(t, len(paths), 1)
+	for _, p := range paths {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			err = os.WriteFile(p, []byte("leftover"), 0644)
+			require.NoError(t, err)
+		}
+	}
 
-	// ensure we have indices.
-	idx, err := dagst.indices.GetFullIndex(k)
+	ch := make(chan ShardResult, 1)
+	err = dagst.DestroyShard(ctx, k, ch, DestroyOpts{})
 	require.NoError(t, err)
-	require.NotNil(t, idx)
-
-	// now let's acquire the shard, and ensure we receive two more traces.
-	// one for OpAcquire, one for OpRelease.
-	accessors := acquireShard(t, dagst, k, 1)
-	releaseAll(t, dagst, k, accessors)
-
-	n, timedOut = sink.Read(traces, 1*time.Second)
-	require.Equal(t, 2, n)
-	require.True(t, timedOut)
-
-	// trace 1.
-	require.Equal(t, OpShardAcquire, traces[0].Op)
-	require.Equal(t, ShardStateServing, traces[0].After.ShardState)
+	res := <-ch
+	require.NoError(t, res.Error)
 
-	// trace 2.
-	require.Equal(t, OpShardRelease, traces[1].Op)
-	require.Equal(t, ShardStateAvailable, traces[1].After.ShardState)
+	for _, p := range paths {
+		_, err = os.Stat(p)
+		require.ErrorIs(t, err, os.ErrNotExist, p)
+	}
 }
 
-func TestGC(t *testing.T) {
-	dir := t.TempDir()
+func TestPruneTopLevelIndex(t *testing.T) {
+	ctx := context.Background()
 	dagst, err := NewDAGStore(Config{
 		MountRegistry: testRegistry(t),
-		TransientsDir: dir,
+		TransientsDir: t.TempDir(),
 	})
 	require.NoError(t, err)
 
 	err = dagst.Start(context.Background())
 	require.NoError(t, err)
 
-	// register 100 shards
-	// acquire 25 with 5 acquirers, release 2 acquirers (refcount 3); non reclaimable
-	// acquire another 25, release them all, they're reclaimable
-	shards := registerShards(t, dagst, 100, carv2mnt, RegisterOpts{})
-	for _, k := range shards[0:25] {
-		accessors := acquireShard(t, dagst, k, 5)
-		for _, acc := range accessors[:2] {
-			err := acc.Close()
-			require.NoError(t, err)
-		}
-	}
-	for _, k := range shards[25:50] {
-		accessors := acquireShard(t, dagst, k, 5)
-		releaseAll(t, dagst, k, accessors)
-	}
+	keys := registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})
 
-	results, err := dagst.GC(context.Background())
+	ii, err := dagst.GetIterableIndex(keys[0])
 	require.NoError(t, err)
-	require.Len(t, results.Shards, 75) // all but the second batch of 25 have been reclaimed.
-	require.Zero(t, results.ShardFailures())
 
-	for i := 25; i < 100; i++ {
-		k := shard.KeyFromString(fmt.Sprintf("shard-%d", i))
-		err, ok := results.Shards[k]
-		require.True(t, ok)
+	// add references to a shard the DAG store doesn't know about.
+	ghost := shard.KeyFromString("ghost")
+	err = dagst.TopLevelIndex.AddMultihashesForShard(ctx, &mhIdx{iterableIdx: ii}, ghost)
+	require.NoError(t, err)
+
+	pruned, err := dagst.PruneTopLevelIndex(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []shard.Key{ghost}, pruned)
+
+	err = ii.ForEach(func(h multihash.Multihash, _ uint64) error {
+		ks, err := dagst.ShardsContainingMultihash(ctx, h)
 		require.NoError(t, err)
-	}
+		require.Equal(t, keys, ks)
+		return nil
+	})
+	require.NoError(t, err)
 }
 
 func TestOrphansRemovedOnStartup(t *testing.T) {
@@ -989,6 +2078,7 @@ func TestRecoveryOnStart(t *testing.T) {
 
 		err = dagst.Start(context.Background())
 		require.NoError(t, err)
+		defer dagst.Close()
 
 		// no events.
 		evts := make([]Trace, 16)
@@ -1012,6 +2102,7 @@ func TestRecoveryOnStart(t *testing.T) {
 
 		err = dagst.Start(context.Background())
 		require.NoError(t, err)
+		defer dagst.Close()
 
 		// 32 events: recovery and failure.
 		evts := make([]Trace, 32)
@@ -1042,6 +2133,7 @@ func TestRecoveryOnStart(t *testing.T) {
 
 		err = dagst.Start(context.Background())
 		require.NoError(t, err)
+		defer dagst.Close()
 
 		// 0 events.
 		evts := make([]Trace, 32)
@@ -1142,11 +2234,10 @@ func TestFailingAcquireErrorPropagates(t *testing.T) {
 	require.NoError(t, res.Error)
 
 	// request five acquires back to back.
-	require.NoError(t, dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{}))
-	require.NoError(t, dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{}))
-	require.NoError(t, dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{}))
-	require.NoError(t, dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{}))
-	require.NoError(t, dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{}))
+	for i := 0; i < 5; i++ {
+		err = dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
+		require.NoError(t, err)
+	}
 
 	select {
 	case <-ch:
@@ -1224,6 +2315,142 @@ func TestTransientReusedOnRestart(t *testing.T) {
 	require.Zero(t, dagst.shards[k].mount.TimesFetched())
 }
 
+func TestCorruptedTransientRefetchedOnRestart(t *testing.T) {
+	ds := datastore.NewMapDatastore()
+	dir := t.TempDir()
+	cfg := Config{
+		MountRegistry:    testRegistry(t),
+		TransientsDir:    dir,
+		Datastore:        ds,
+		IndexRepo:        index.NewMemoryRepo(),
+		TransientDigests: true,
+	}
+	dagst, err := NewDAGStore(cfg)
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	ch := make(chan ShardResult, 1)
+	k := shard.KeyFromString("foo")
+	err = dagst.RegisterShard(context.Background(), k, carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Error)
+
+	err = dagst.Close()
+	require.NoError(t, err)
+
+	// the transient integrity information was persisted.
+	bz, err := ds.Get(context.Background(), StoreNamespace.Child(datastore.NewKey(k.String())))
+	require.NoError(t, err)
+	ps, err := decodeRecord(bz)
+	require.NoError(t, err)
+	require.NotEmpty(t, ps.TransientPath)
+	require.EqualValues(t, len(testdata.CarV2), ps.TransientSize)
+	require.NotEmpty(t, ps.TransientDigest)
+
+	// corrupt the transient, keeping its size.
+	corrupted := append([]byte{}, testdata.CarV2...)
+	for i := range corrupted[len(corrupted)/2:] {
+		corrupted[len(corrupted)/2+i] = 0
+	}
+	require.NoError(t, os.WriteFile(ps.TransientPath, corrupted, 0644))
+
+	dagst, err = NewDAGStore(cfg)
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// acquire the shard; the corrupted transient is refetched, and blocks
+	// can be read.
+	err = dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
+	require.NoError(t, err)
+	res = <-ch
+	require.NoError(t, res.Error)
+	require.NotNil(t, res.Accessor)
+	defer res.Accessor.Close()
+
+	bs, err := res.Accessor.Blockstore()
+	require.NoError(t, err)
+	blk, err := bs.Get(context.Background(), testdata.RootCID)
+	require.NoError(t, err)
+	require.Equal(t, testdata.RootCID, blk.Cid())
+
+	bz, err = os.ReadFile(dagst.shards[k].mount.TransientPath())
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2, bz)
+}
+
+func TestSparseTransientReusedOnRestart(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.car", time.Time{}, bytes.NewReader(testdata.CarV2))
+	}))
+	defer srv.Close()
+
+	ds := datastore.NewMapDatastore()
+	dir := t.TempDir()
+	r := testRegistry(t)
+	require.NoError(t, r.Register("http", &mount.HTTPMount{Client: srv.Client()}))
+	idx := index.NewMemoryRepo()
+	cfg := Config{
+		MountRegistry:    r,
+		TransientsDir:    dir,
+		Datastore:        ds,
+		IndexRepo:        idx,
+		SparseTransients: true,
+	}
+	dagst, err := NewDAGStore(cfg)
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	mnt, err := mount.NewHTTPMount(context.Background(), srv.Client(), srv.URL)
+	require.NoError(t, err)
+
+	ch := make(chan ShardResult, 1)
+	k := shard.KeyFromString("foo")
+	err = dagst.RegisterShard(context.Background(), k, mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Error)
+
+	// the shard was indexed through a sparse transient.
+	path := dagst.shards[k].mount.TransientPath()
+	require.True(t, strings.HasSuffix(path, ".sparse"))
+
+	err = dagst.Close()
+	require.NoError(t, err)
+
+	dagst, err = NewDAGStore(cfg)
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// the sparse transient is resumed, and its bitmap survived the orphan
+	// sweep on startup.
+	require.Equal(t, path, dagst.shards[k].mount.TransientPath())
+	_, err = os.Stat(path + ".bitmap")
+	require.NoError(t, err)
+
+	// acquire the shard and read a block.
+	err = dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
+	require.NoError(t, err)
+	res = <-ch
+	require.NoError(t, res.Error)
+	require.NotNil(t, res.Accessor)
+	defer res.Accessor.Close()
+
+	bs, err := res.Accessor.Blockstore()
+	require.NoError(t, err)
+	blk, err := bs.Get(context.Background(), testdata.RootCID)
+	require.NoError(t, err)
+	require.Equal(t, testdata.RootCID, blk.Cid())
+}
+
 func TestAcquireFailsWhenIndexGone(t *testing.T) {
 	ds := datastore.NewMapDatastore()
 	dir := t.TempDir()
@@ -1482,6 +2709,59 @@ func (m Tracer) Read(dst []Trace, timeout time.Duration) (n int, timedOut bool)
 	return len(dst), false
 }
 
+// flakyMount is a mount that fails the first fetches, with errors it
+// classifies as transient unless permanent is set.
+type flakyMount struct {
+	mount.Mount
+	failures  int32
+	permanent bool
+	fetches   int32
+}
+
+func (f *flakyMount) Fetch(ctx context.Context) (mount.Reader, error) {
+	if atomic.AddInt32(&f.fetches, 1) <= f.failures {
+		return nil, errors.New("flaky mount failure")
+	}
+	return f.Mount.Fetch(ctx)
+}
+
+func (f *flakyMount) Retryable(err error) bool {
+	return !f.permanent
+}
+
+// seekableMount is a mount that claims to support seeking, so that its
+// downloads are resumable.
+type seekableMount struct {
+	mount.Mount
+}
+
+func (m *seekableMount) Info() mount.Info {
+	info := m.Mount.Info()
+	info.AccessSeek = true
+	return info
+}
+
+// priorityMount records the priority of every fetch.
+type priorityMount struct {
+	mount.Mount
+
+	lk         sync.Mutex
+	priorities []throttle.Priority
+}
+
+func (p *priorityMount) Fetch(ctx context.Context) (mount.Reader, error) {
+	p.lk.Lock()
+	p.priorities = append(p.priorities, throttle.PriorityFrom(ctx))
+	p.lk.Unlock()
+	return p.Mount.Fetch(ctx)
+}
+
+func (p *priorityMount) fetches() []throttle.Priority {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return append([]throttle.Priority(nil), p.priorities...)
+}
+
 // blockingMount is a mount that proxies to another mount, but it blocks by
 // default, unless unblock tokens are added via UnblockNext.
 type blockingMount struct {
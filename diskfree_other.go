@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package dagstore
+
+import "errors"
+
+// freeDiskSpace is unsupported on this platform.
+func freeDiskSpace(path string) (int64, error) {
+	return 0, errors.New("free disk space unsupported on this platform")
+}
@@ -1,5 +1,10 @@
 package dagstore
 
+import (
+	"context"
+	"time"
+)
+
 // dispatcher takes care of dispatching results back to the application.
 //
 // These can be results of API operations, or shard failures.
@@ -13,16 +18,51 @@ func (d *DAGStore) dispatcher(ch chan *dispatch) {
 		case <-d.ctx.Done():
 			return
 		}
+		if di.flushed != nil {
+			close(di.flushed)
+			continue
+		}
 		di.w.deliver(di.res)
 	}
 }
 
+// dispatchResult dispatches the result to the waiters, stamping it with
+// each waiter's operation id and timestamps.
+//
+// Once the DAG store is closed, the dispatchers are gone, so results are
+// delivered only if the waiter's channel can take them without blocking, and
+// dropped otherwise.
 func (d *DAGStore) dispatchResult(res *ShardResult, waiters ...*waiter) {
+	now := time.Now()
 	for _, w := range waiters {
 		if w.outCh == nil {
 			// no return channel; skip.
 			continue
 		}
-		d.dispatchResultsCh <- &dispatch{w: w, res: res}
+		di := &dispatch{w: w, res: w.stamp(*res, now)}
+		select {
+		case d.dispatchResultsCh <- di:
+		case <-d.ctx.Done():
+			if !di.w.tryDeliver(di.res) {
+				log.Debugw("dropped result after close", "shard", res.Key, "op_id", w.id)
+			}
+		}
+	}
+}
+
+// flushDispatcher waits until the dispatcher has delivered all results
+// queued so far, or the context is done.
+func (d *DAGStore) flushDispatcher(ctx context.Context, ch chan *dispatch) error {
+	di := &dispatch{flushed: make(chan struct{})}
+	select {
+	case ch <- di:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-di.flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
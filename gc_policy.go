@@ -0,0 +1,95 @@
+package dagstore
+
+import (
+	"time"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// GCCandidate is a shard whose transient can be reclaimed by GC, i.e. an
+// idle, unpinned shard with a local transient.
+type GCCandidate struct {
+	// Key is the key of the shard.
+	Key shard.Key
+	// TransientSize is the size of the shard's transient.
+	TransientSize int64
+	// LastAccessed is the last time the shard was acquired or became
+	// available. Zero if the shard hasn't been accessed since the DAG store
+	// started.
+	LastAccessed time.Time
+}
+
+// GCState describes the transients held by the DAG store at the time of GC.
+type GCState struct {
+	// Now is the time at which GC started.
+	Now time.Time
+	// Transients is the number of shards with a local transient, including
+	// shards that aren't GC candidates (e.g. because they're in use).
+	Transients int
+	// TransientsSize is the total size of all transients.
+	TransientsSize int64
+	// FreeDiskSpace is the number of bytes available to the transients
+	// directory on its filesystem, or -1 if it can't be determined.
+	FreeDiskSpace int64
+}
+
+// GCPolicy decides which transients are reclaimed by automatic GC, so that
+// the transients of hot shards can be kept while those of cold shards are
+// reclaimed.
+type GCPolicy interface {
+	// Reclaim returns the keys of the shards whose transients should be
+	// reclaimed. Candidates are sorted in least-recently accessed order.
+	// Keys that aren't candidates are ignored.
+	Reclaim(state GCState, candidates []GCCandidate) []shard.Key
+}
+
+// DefaultGCPolicy is the GCPolicy used by automatic GC unless
+// Config.GCPolicy is set. It's configured through the GC fields in Config.
+//
+// Transients of shards accessed within MinIdle are always kept. If neither
+// FreeDiskTarget nor MaxTransients is set, all other transients are
+// reclaimed. Otherwise, they're reclaimed in least-recently accessed order
+// only until both targets are met.
+type DefaultGCPolicy struct {
+	// MinIdle is the minimum time a shard must have gone unaccessed for its
+	// transient to be reclaimed.
+	MinIdle time.Duration
+	// FreeDiskTarget is the number of bytes that should be available to the
+	// transients directory. 0 disables the target. Ignored if the free disk
+	// space can't be determined.
+	FreeDiskTarget int64
+	// MaxTransients is the maximum number of transients to keep. 0 disables
+	// the target.
+	MaxTransients int
+}
+
+var _ GCPolicy = (*DefaultGCPolicy)(nil)
+
+func (p *DefaultGCPolicy) Reclaim(state GCState, candidates []GCCandidate) []shard.Key {
+	targeted := p.MaxTransients > 0 || (p.FreeDiskTarget > 0 && state.FreeDiskSpace >= 0)
+	satisfied := func() bool {
+		if p.MaxTransients > 0 && state.Transients > p.MaxTransients {
+			return false
+		}
+		if p.FreeDiskTarget > 0 && state.FreeDiskSpace >= 0 && state.FreeDiskSpace < p.FreeDiskTarget {
+			return false
+		}
+		return true
+	}
+
+	var reclaim []shard.Key
+	for _, c := range candidates {
+		if targeted && satisfied() {
+			break
+		}
+		if state.Now.Sub(c.LastAccessed) < p.MinIdle {
+			continue
+		}
+		reclaim = append(reclaim, c.Key)
+		state.Transients--
+		if state.FreeDiskSpace >= 0 {
+			state.FreeDiskSpace += c.TransientSize
+		}
+	}
+	return reclaim
+}
@@ -0,0 +1,82 @@
+package dagstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultGCPolicy(t *testing.T) {
+	now := time.Now()
+	a, b, c := shard.KeyFromString("a"), shard.KeyFromString("b"), shard.KeyFromString("c")
+	candidates := []GCCandidate{
+		{Key: a, TransientSize: 100, LastAccessed: now.Add(-time.Hour)},
+		{Key: b, TransientSize: 100, LastAccessed: now.Add(-time.Minute)},
+		{Key: c, TransientSize: 100, LastAccessed: now.Add(-time.Second)},
+	}
+	state := GCState{Now: now, Transients: 4, TransientsSize: 400, FreeDiskSpace: 1000}
+
+	testCases := []struct {
+		name     string
+		policy   DefaultGCPolicy
+		state    GCState
+		expected []shard.Key
+	}{
+		{
+			name:     "no constraints reclaims all",
+			policy:   DefaultGCPolicy{},
+			state:    state,
+			expected: []shard.Key{a, b, c},
+		},
+		{
+			name:     "min idle keeps hot shards",
+			policy:   DefaultGCPolicy{MinIdle: 30 * time.Second},
+			state:    state,
+			expected: []shard.Key{a, b},
+		},
+		{
+			name:     "max transients reclaims cold shards first",
+			policy:   DefaultGCPolicy{MaxTransients: 3},
+			state:    state,
+			expected: []shard.Key{a},
+		},
+		{
+			name:     "max transients can't reclaim hot shards",
+			policy:   DefaultGCPolicy{MaxTransients: 1, MinIdle: 30 * time.Second},
+			state:    state,
+			expected: []shard.Key{a, b},
+		},
+		{
+			name:     "free disk target reclaims until met",
+			policy:   DefaultGCPolicy{FreeDiskTarget: 1150},
+			state:    state,
+			expected: []shard.Key{a, b},
+		},
+		{
+			name:     "free disk target already met",
+			policy:   DefaultGCPolicy{FreeDiskTarget: 1000},
+			state:    state,
+			expected: nil,
+		},
+		{
+			name:     "unknown free disk space with no other targets reclaims all",
+			policy:   DefaultGCPolicy{FreeDiskTarget: 1000},
+			state:    GCState{Now: now, Transients: 4, TransientsSize: 400, FreeDiskSpace: -1},
+			expected: []shard.Key{a, b, c},
+		},
+		{
+			name:     "both targets must be met",
+			policy:   DefaultGCPolicy{FreeDiskTarget: 1050, MaxTransients: 2},
+			state:    state,
+			expected: []shard.Key{a, b},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.policy.Reclaim(tc.state, candidates))
+		})
+	}
+}
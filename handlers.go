@@ -33,7 +33,7 @@ func RecoverImmediately(ctx context.Context, dagst *DAGStore, failureCh chan Sha
 				continue
 			}
 
-			log.Infow("failure handler: recovering shard", "key", key, "from_error", res.Error, "attempt", att)
+			log.Infow("failure handler: recovering shard", "key", key, "from_error", res.Error, "from_op_id", res.OpID, "attempt", att)
 
 			// queue the recovery for this key.
 			if err := dagst.RecoverShard(ctx, key, recResCh, RecoverOpts{}); err != nil {
@@ -48,10 +48,10 @@ func RecoverImmediately(ctx context.Context, dagst *DAGStore, failureCh chan Sha
 			// above for retry.
 			key := res.Key
 			if res.Error == nil {
-				log.Infow("failure handler: successfully recovered shard", "key", key)
+				log.Infow("failure handler: successfully recovered shard", "key", key, "op_id", res.OpID)
 				delete(attempts, key)
 			} else {
-				log.Warnw("failure handler: failed to recover shard", "key", key, "attempt", attempts[key])
+				log.Warnw("failure handler: failed to recover shard", "key", key, "op_id", res.OpID, "attempt", attempts[key])
 			}
 			continue
 
@@ -0,0 +1,256 @@
+package index
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// Values in the inverted index are lists of shards. They used to be stored as
+// JSON arrays of shard keys; they are now stored in a compact binary format:
+//
+//	[version byte][uvarint shard id][uvarint shard id]...
+//
+// where shard ids are assigned by a shard dictionary persisted alongside the
+// index. Legacy JSON values are still readable, and are rewritten in the
+// binary format whenever the value is updated.
+const (
+	// valueVersion1 is the version byte of the current value format.
+	valueVersion1 byte = 0x01
+
+	// legacyJSONPrefix is the first byte of legacy JSON-encoded values.
+	legacyJSONPrefix byte = '['
+)
+
+var errUnknownValueFormat = errors.New("unknown inverted index value format")
+
+// isLegacyValue returns whether the value is encoded in the legacy JSON format.
+func isLegacyValue(b []byte) bool {
+	return len(b) > 0 && b[0] == legacyJSONPrefix
+}
+
+// encodeShardIDs encodes the shard ids in the current value format.
+func encodeShardIDs(ids []uint64) []byte {
+	buf := make([]byte, 1+len(ids)*binary.MaxVarintLen64)
+	buf[0] = valueVersion1
+	n := 1
+	for _, id := range ids {
+		n += binary.PutUvarint(buf[n:], id)
+	}
+	return buf[:n]
+}
+
+// decodeShardIDs decodes the shard ids from a value in the current value
+// format.
+func decodeShardIDs(b []byte) ([]uint64, error) {
+	if len(b) == 0 || b[0] != valueVersion1 {
+		return nil, errUnknownValueFormat
+	}
+	b = b[1:]
+	ids := make([]uint64, 0, len(b))
+	for len(b) > 0 {
+		id, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("malformed shard id in inverted index value")
+		}
+		ids = append(ids, id)
+		b = b[n:]
+	}
+	return ids, nil
+}
+
+// shardDict assigns compact numeric ids to shard keys. The mapping is
+// persisted in the datastore as (id -> shard key) entries and is held
+// entirely in memory after being loaded on first use. Entries are deleted
+// once no index value references them; the id of a deleted entry may be
+// reused after a restart.
+type shardDict struct {
+	ds ds.Datastore
+
+	lk     sync.RWMutex
+	loaded bool
+	ids    map[shard.Key]uint64
+	keys   map[uint64]shard.Key
+	next   uint64
+}
+
+func newShardDict(dts ds.Datastore) *shardDict {
+	return &shardDict{
+		ds:   dts,
+		ids:  make(map[shard.Key]uint64),
+		keys: make(map[uint64]shard.Key),
+	}
+}
+
+// load loads the dictionary from the datastore, if it hasn't been loaded yet.
+// It must be called with the write lock held.
+func (d *shardDict) load(ctx context.Context) error {
+	if d.loaded {
+		return nil
+	}
+
+	results, err := d.ds.Query(ctx, query.Query{})
+	if err != nil {
+		return fmt.Errorf("failed to query shard dictionary: %w", err)
+	}
+	defer results.Close()
+
+	for res := range results.Next() {
+		if res.Error != nil {
+			return fmt.Errorf("failed to iterate over shard dictionary: %w", res.Error)
+		}
+		id, err := strconv.ParseUint(ds.RawKey(res.Key).BaseNamespace(), 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed shard dictionary key %s: %w", res.Key, err)
+		}
+		k := shard.KeyFromString(string(res.Value))
+		d.ids[k] = id
+		d.keys[id] = k
+		if id >= d.next {
+			d.next = id + 1
+		}
+	}
+
+	d.loaded = true
+	return nil
+}
+
+// ID returns the id for the shard key, assigning and persisting a new one if
+// the key is not known yet.
+func (d *shardDict) ID(ctx context.Context, k shard.Key) (uint64, error) {
+	d.lk.RLock()
+	id, ok := d.ids[k]
+	d.lk.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	if err := d.load(ctx); err != nil {
+		return 0, err
+	}
+	if id, ok := d.ids[k]; ok {
+		return id, nil
+	}
+
+	// the entry must be durable before any index value references it.
+	id = d.next
+	key := ds.NewKey(strconv.FormatUint(id, 10))
+	if err := d.ds.Put(ctx, key, []byte(k.String())); err != nil {
+		return 0, fmt.Errorf("failed to persist shard dictionary entry: %w", err)
+	}
+	if err := d.ds.Sync(ctx, key); err != nil {
+		return 0, fmt.Errorf("failed to sync shard dictionary entry: %w", err)
+	}
+	d.next++
+	d.ids[k] = id
+	d.keys[id] = k
+	return id, nil
+}
+
+// Key returns the shard key for the id.
+func (d *shardDict) Key(ctx context.Context, id uint64) (shard.Key, error) {
+	d.lk.RLock()
+	k, ok := d.keys[id]
+	loaded := d.loaded
+	d.lk.RUnlock()
+	if ok {
+		return k, nil
+	}
+	if loaded {
+		return shard.Key{}, fmt.Errorf("unknown shard id %d", id)
+	}
+
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	if err := d.load(ctx); err != nil {
+		return shard.Key{}, err
+	}
+	if k, ok := d.keys[id]; ok {
+		return k, nil
+	}
+	return shard.Key{}, fmt.Errorf("unknown shard id %d", id)
+}
+
+// Drop deletes the entries of the shard keys for which drop returns true. The
+// caller must guarantee that no index value references them.
+func (d *shardDict) Drop(ctx context.Context, drop func(shard.Key) bool) error {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	if err := d.load(ctx); err != nil {
+		return err
+	}
+
+	var dropped bool
+	for k, id := range d.ids {
+		if !drop(k) {
+			continue
+		}
+		if err := d.ds.Delete(ctx, ds.NewKey(strconv.FormatUint(id, 10))); err != nil {
+			return fmt.Errorf("failed to delete shard dictionary entry: %w", err)
+		}
+		delete(d.ids, k)
+		delete(d.keys, id)
+		dropped = true
+	}
+
+	if dropped {
+		if err := d.ds.Sync(ctx, ds.Key{}); err != nil {
+			return fmt.Errorf("failed to sync shard dictionary: %w", err)
+		}
+	}
+	return nil
+}
+
+// decodeValue decodes an inverted index value in either the current or the
+// legacy format into a list of shard keys.
+func (d *invertedIndexImpl) decodeValue(ctx context.Context, b []byte) ([]shard.Key, error) {
+	if isLegacyValue(b) {
+		var es []shard.Key
+		if err := json.Unmarshal(b, &es); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal shard keys: %w", err)
+		}
+		return es, nil
+	}
+
+	ids, err := decodeShardIDs(b)
+	if err != nil {
+		return nil, err
+	}
+	es := make([]shard.Key, 0, len(ids))
+	for _, id := range ids {
+		k, err := d.dict.Key(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, k)
+	}
+	return es, nil
+}
+
+// encodeValue encodes a list of shard keys into an inverted index value in the
+// current format.
+func (d *invertedIndexImpl) encodeValue(ctx context.Context, es []shard.Key) ([]byte, error) {
+	ids := make([]uint64, 0, len(es))
+	for _, k := range es {
+		id, err := d.dict.ID(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return encodeShardIDs(ids), nil
+}
@@ -2,11 +2,15 @@ package index
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"sort"
 	"sync"
 
+	"golang.org/x/sync/errgroup"
+
 	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
 
 	ds "github.com/ipfs/go-datastore"
 
@@ -15,88 +19,441 @@ import (
 	"github.com/filecoin-project/dagstore/shard"
 )
 
+const (
+	// defaultBatchSize is the default maximum number of multihashes that are
+	// read and written to the datastore in a single batch.
+	defaultBatchSize = 1024
+
+	// defaultConcurrency is the default number of batches that are processed
+	// in parallel when adding or removing the multihashes of a shard.
+	defaultConcurrency = 4
+
+	// stripes is the number of locks that guard the read-modify-write cycle
+	// of index entries. Each entry is guarded by the stripe its key hashes to.
+	stripes = 1024
+
+	// readConcurrency is the number of entries of a batch that are read from
+	// the datastore in parallel.
+	readConcurrency = 16
+)
+
 var _ Inverted = (*invertedIndexImpl)(nil)
 
+// InvertedOpts configures the inverted index.
+type InvertedOpts struct {
+	// BatchSize is the maximum number of multihashes that are read and written
+	// to the datastore in a single batch. 0 (default) uses 1024.
+	BatchSize int
+
+	// Concurrency is the number of batches that are processed in parallel
+	// when adding or removing the multihashes of a shard. 0 (default) uses 4.
+	Concurrency int
+}
+
 type invertedIndexImpl struct {
-	mu sync.Mutex
-	ds ds.Batching
+	// mu is held for reading by operations that update a set of entries, and
+	// for writing by sweeps while they drop shards from the dictionary.
+	mu sync.RWMutex
+	// stripes guard the read-modify-write cycle of individual entries, so that
+	// multiple shards can be loaded concurrently.
+	stripes [stripes]sync.Mutex
+
+	ds   ds.Batching
+	dict *shardDict
+
+	// lk guards the tracking of the shards being added, which sweeps use to
+	// avoid dropping dictionary entries that are about to be referenced.
+	lk sync.Mutex
+	// adding counts the in-flight additions of each shard.
+	adding map[shard.Key]int
+	// sweeps is the number of sweeps in progress.
+	sweeps int
+	// added are the shards that were added while sweeps were in progress.
+	added map[shard.Key]struct{}
+
+	batchSize   int
+	concurrency int
 }
 
 // NewInverted returns a new inverted index that uses `go-indexer-core`
 // as it's storage backend. We use `go-indexer-core` as the backend here
 // as it's been optimized to store (multihash -> Value) kind of data and
 // supports bulk updates via context ID and metadata-deduplication which are useful properties for our use case here.
+//
+// Values are encoded in a compact binary format that refers to shards through
+// a dictionary of numeric ids, which is stored in the same datastore.
 func NewInverted(dts ds.Batching) *invertedIndexImpl {
-	dts = namespace.Wrap(dts, ds.NewKey("/inverted/index"))
+	return NewInvertedWithOpts(dts, InvertedOpts{})
+}
+
+// NewInvertedWithOpts is like NewInverted, but it allows tuning how
+// multihashes are loaded into the index.
+func NewInvertedWithOpts(dts ds.Batching, opts InvertedOpts) *invertedIndexImpl {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultConcurrency
+	}
 	return &invertedIndexImpl{
-		ds: dts,
+		ds:          namespace.Wrap(dts, ds.NewKey("/inverted/index")),
+		dict:        newShardDict(namespace.Wrap(dts, ds.NewKey("/inverted/shards"))),
+		adding:      make(map[shard.Key]int),
+		added:       make(map[shard.Key]struct{}),
+		batchSize:   opts.BatchSize,
+		concurrency: opts.Concurrency,
 	}
 }
 
 func (d *invertedIndexImpl) AddMultihashesForShard(ctx context.Context, mhIter MultihashIterator, s shard.Key) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+	d.lk.Lock()
+	d.adding[s]++
+	if d.sweeps > 0 {
+		d.added[s] = struct{}{}
+	}
+	d.lk.Unlock()
+
+	defer func() {
+		d.lk.Lock()
+		if d.adding[s]--; d.adding[s] == 0 {
+			delete(d.adding, s)
+		}
+		d.lk.Unlock()
+	}()
+
+	err := d.update(ctx, mhIter, func(es []shard.Key) ([]shard.Key, bool) {
+		// if we already have the shard key indexed for the multihash, nothing to do here.
+		if has(es, s) {
+			return es, false
+		}
+		return append(es, s), true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add index entry: %w", err)
+	}
+	return nil
+}
+
+func (d *invertedIndexImpl) RemoveMultihashesForShard(ctx context.Context, mhIter MultihashIterator, s shard.Key) error {
+	err := d.update(ctx, mhIter, func(es []shard.Key) ([]shard.Key, bool) {
+		// if the shard key is not indexed for the multihash, nothing to do here.
+		if !has(es, s) {
+			return es, false
+		}
+		return remove(es, s), true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove index entry: %w", err)
+	}
+	return nil
+}
+
+// entryKey is the datastore key of the entry for a multihash.
+type entryKey struct {
+	mh  multihash.Multihash
+	key ds.Key
+}
+
+// update applies fn to the entries of all multihashes returned by mhIter.
+// fn receives the shard list of the multihash (nil if there's no entry), and
+// returns the updated list and whether it changed. Entries whose list becomes
+// empty are deleted.
+//
+// Multihashes are sorted and deduplicated upfront, and then split in batches
+// that are read, updated and written by a pool of workers. Only the entries in
+// a batch are locked while it's being processed, so concurrent calls for
+// different shards are merged into the index in parallel.
+func (d *invertedIndexImpl) update(ctx context.Context, mhIter MultihashIterator, fn func([]shard.Key) ([]shard.Key, bool)) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var keys []entryKey
+	if err := mhIter.ForEach(func(mh multihash.Multihash) error {
+		keys = append(keys, entryKey{mh: mh, key: ds.NewKey(string(mh))})
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to iterate over multihashes: %w", err)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].key.String() < keys[j].key.String()
+	})
+	keys = dedup(keys)
+
+	grp, gctx := errgroup.WithContext(ctx)
+	batches := make(chan []entryKey)
+	for i := 0; i < d.concurrency; i++ {
+		grp.Go(func() error {
+			for batch := range batches {
+				if err := d.updateBatch(gctx, batch, fn); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	grp.Go(func() error {
+		defer close(batches)
+		for len(keys) > 0 {
+			n := d.batchSize
+			if n > len(keys) {
+				n = len(keys)
+			}
+			select {
+			case batches <- keys[:n]:
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+			keys = keys[n:]
+		}
+		return nil
+	})
+
+	if err := grp.Wait(); err != nil {
+		return err
+	}
+
+	if err := d.ds.Sync(ctx, ds.Key{}); err != nil {
+		return fmt.Errorf("failed to sync updates: %w", err)
+	}
+
+	return nil
+}
+
+// updateBatch applies fn to the entries in the batch, and commits the changes
+// in a single datastore batch. The stripes covering the batch are held for the
+// duration of the read-modify-write cycle. Entries in the legacy format are
+// rewritten in the current one even if fn leaves them unchanged.
+func (d *invertedIndexImpl) updateBatch(ctx context.Context, keys []entryKey, fn func([]shard.Key) ([]shard.Key, bool)) error {
+	unlock := d.lockStripes(keys)
+	defer unlock()
+
+	vals, err := d.getBatch(ctx, keys)
+	if err != nil {
+		return err
+	}
 
 	batch, err := d.ds.Batch(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to create ds batch: %w", err)
 	}
 
-	if err := mhIter.ForEach(func(mh multihash.Multihash) error {
-		key := ds.NewKey(string(mh))
+	for i, k := range keys {
 		// do we already have an entry for this multihash ?
-		val, err := d.ds.Get(ctx, key)
-		if err != nil && err != ds.ErrNotFound {
-			return fmt.Errorf("failed to get value for multihash %s, err: %w", mh, err)
+		var es []shard.Key
+		if vals[i] != nil {
+			if es, err = d.decodeValue(ctx, vals[i]); err != nil {
+				return fmt.Errorf("failed to decode shard keys for mh=%s, err=%w", k.mh, err)
+			}
 		}
 
-		// if we don't have an existing entry for this mh, create one
-		if err == ds.ErrNotFound {
-			s := []shard.Key{s}
-			bz, err := json.Marshal(s)
-			if err != nil {
-				return fmt.Errorf("failed to marshal shard list to bytes: %w", err)
-			}
-			if err := batch.Put(ctx, key, bz); err != nil {
-				return fmt.Errorf("failed to put mh=%s, err=%w", mh, err)
+		es, changed := fn(es)
+		if !changed && !(vals[i] != nil && isLegacyValue(vals[i])) {
+			continue
+		}
+
+		if len(es) == 0 {
+			if err := batch.Delete(ctx, k.key); err != nil {
+				return fmt.Errorf("failed to delete mh=%s, err=%w", k.mh, err)
 			}
-			return nil
+			continue
 		}
 
-		// else , append the shard key to the existing list
-		var es []shard.Key
-		if err := json.Unmarshal(val, &es); err != nil {
-			return fmt.Errorf("failed to unmarshal shard keys: %w", err)
+		bz, err := d.encodeValue(ctx, es)
+		if err != nil {
+			return fmt.Errorf("failed to encode shard keys: %w", err)
+		}
+		if err := batch.Put(ctx, k.key, bz); err != nil {
+			return fmt.Errorf("failed to put mh=%s, err=%w", k.mh, err)
 		}
+	}
 
-		// if we already have the shard key indexed for the multihash, nothing to do here.
-		if has(es, s) {
+	if err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit batch: %w", err)
+	}
+	return nil
+}
+
+// getBatch reads the values of the entries in the batch; the value of missing
+// entries is nil. go-datastore has no multi-key read, so the reads are issued
+// in parallel, which amortises the round trips of remote and disk-backed
+// datastores over the batch.
+func (d *invertedIndexImpl) getBatch(ctx context.Context, keys []entryKey) ([][]byte, error) {
+	vals := make([][]byte, len(keys))
+	grp, gctx := errgroup.WithContext(ctx)
+	next := make(chan int)
+	for i := 0; i < readConcurrency; i++ {
+		grp.Go(func() error {
+			for i := range next {
+				val, err := d.ds.Get(gctx, keys[i].key)
+				switch err {
+				case nil:
+					vals[i] = val
+				case ds.ErrNotFound:
+				default:
+					return fmt.Errorf("failed to get value for multihash %s, err: %w", keys[i].mh, err)
+				}
+			}
 			return nil
+		})
+	}
+	grp.Go(func() error {
+		defer close(next)
+		for i := range keys {
+			select {
+			case next <- i:
+			case <-gctx.Done():
+				return gctx.Err()
+			}
 		}
+		return nil
+	})
+	if err := grp.Wait(); err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
 
-		es = append(es, s)
-		bz, err := json.Marshal(es)
-		if err != nil {
-			return fmt.Errorf("failed to marshal shard keys: %w", err)
+// lockStripes locks the stripes covering the supplied keys, in ascending
+// order to prevent deadlocks, and returns a function that unlocks them.
+func (d *invertedIndexImpl) lockStripes(keys []entryKey) (unlock func()) {
+	var covered [stripes]bool
+	for _, k := range keys {
+		h := fnv.New32a()
+		_, _ = h.Write(k.key.Bytes())
+		covered[h.Sum32()%stripes] = true
+	}
+	for i := range covered {
+		if covered[i] {
+			d.stripes[i].Lock()
 		}
-		if err := batch.Put(ctx, key, bz); err != nil {
-			return fmt.Errorf("failed to put mh=%s, err%w", mh, err)
+	}
+	return func() {
+		for i := range covered {
+			if covered[i] {
+				d.stripes[i].Unlock()
+			}
+		}
+	}
+}
+
+func (d *invertedIndexImpl) DropShard(ctx context.Context, s shard.Key) error {
+	_, err := d.PruneShards(ctx, func(k shard.Key) bool { return k != s })
+	return err
+}
+
+// PruneShards sweeps the index in batches of keys, which are updated like the
+// batches of AddMultihashesForShard, so the sweep only locks the entries of
+// the batch being processed and runs concurrently with other updates. Once
+// the sweep is done, the dictionary entries of the pruned shards are dropped,
+// unless the shards were added concurrently.
+func (d *invertedIndexImpl) PruneShards(ctx context.Context, keep func(shard.Key) bool) ([]shard.Key, error) {
+	d.lk.Lock()
+	d.sweeps++
+	for k := range d.adding {
+		d.added[k] = struct{}{}
+	}
+	d.lk.Unlock()
+
+	defer func() {
+		d.lk.Lock()
+		if d.sweeps--; d.sweeps == 0 {
+			d.added = make(map[shard.Key]struct{})
+		}
+		d.lk.Unlock()
+	}()
+
+	pruned, err := d.sweep(ctx, keep)
+	if err != nil {
+		return nil, err
+	}
+
+	// no update is in flight while we hold the write lock, so the shards that
+	// weren't added since the sweep started are no longer referenced.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lk.Lock()
+	added := make(map[shard.Key]struct{}, len(d.added))
+	for k := range d.added {
+		added[k] = struct{}{}
+	}
+	d.lk.Unlock()
+
+	err = d.dict.Drop(ctx, func(k shard.Key) bool {
+		_, ok := added[k]
+		return !ok && !keep(k)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pruned, nil
+}
+
+// sweep removes the shard keys for which keep returns false from every entry
+// of the index, and returns them.
+func (d *invertedIndexImpl) sweep(ctx context.Context, keep func(shard.Key) bool) ([]shard.Key, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	results, err := d.ds.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query inverted index: %w", err)
+	}
+	defer results.Close()
+
+	pruned := make(map[shard.Key]struct{})
+	prune := func(es []shard.Key) ([]shard.Key, bool) {
+		kept := make([]shard.Key, 0, len(es))
+		for _, k := range es {
+			if keep(k) {
+				kept = append(kept, k)
+			} else {
+				pruned[k] = struct{}{}
+			}
 		}
+		return kept, len(kept) != len(es)
+	}
 
+	keys := make([]entryKey, 0, d.batchSize)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if err := d.updateBatch(ctx, keys, prune); err != nil {
+			return err
+		}
+		keys = keys[:0]
 		return nil
-	}); err != nil {
-		return fmt.Errorf("failed to add index entry: %w", err)
 	}
 
-	if err := batch.Commit(ctx); err != nil {
-		return fmt.Errorf("failed to commit batch: %w", err)
+	for res := range results.Next() {
+		if res.Error != nil {
+			return nil, fmt.Errorf("failed to iterate over inverted index: %w", res.Error)
+		}
+		key := ds.RawKey(res.Key)
+		keys = append(keys, entryKey{mh: multihash.Multihash(res.Key[1:]), key: key})
+		if len(keys) == d.batchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
 	}
 
 	if err := d.ds.Sync(ctx, ds.Key{}); err != nil {
-		return fmt.Errorf("failed to sync puts: %w", err)
+		return nil, fmt.Errorf("failed to sync pruned entries: %w", err)
 	}
 
-	return nil
+	ret := make([]shard.Key, 0, len(pruned))
+	for k := range pruned {
+		ret = append(ret, k)
+	}
+	return ret, nil
 }
 
 func (d *invertedIndexImpl) GetShardsForMultihash(ctx context.Context, mh multihash.Multihash) ([]shard.Key, error) {
@@ -106,9 +463,9 @@ func (d *invertedIndexImpl) GetShardsForMultihash(ctx context.Context, mh multih
 		return nil, fmt.Errorf("failed to lookup index for mh %s, err: %w", mh, err)
 	}
 
-	var shardKeys []shard.Key
-	if err := json.Unmarshal(sbz, &shardKeys); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal shard keys for mh=%s, err=%w", mh, err)
+	shardKeys, err := d.decodeValue(ctx, sbz)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode shard keys for mh=%s, err=%w", mh, err)
 	}
 
 	return shardKeys, nil
@@ -122,3 +479,27 @@ func has(es []shard.Key, k shard.Key) bool {
 	}
 	return false
 }
+
+// dedup removes consecutive duplicate keys from a sorted slice.
+func dedup(keys []entryKey) []entryKey {
+	if len(keys) == 0 {
+		return keys
+	}
+	ret := keys[:1]
+	for _, k := range keys[1:] {
+		if k.key != ret[len(ret)-1].key {
+			ret = append(ret, k)
+		}
+	}
+	return ret
+}
+
+func remove(es []shard.Key, k shard.Key) []shard.Key {
+	ret := es[:0]
+	for _, s := range es {
+		if s != k {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
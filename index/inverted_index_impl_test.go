@@ -2,7 +2,13 @@ package index
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
 	"testing"
+	"time"
+
+	"golang.org/x/sync/errgroup"
 
 	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
 
@@ -119,6 +125,343 @@ func TestDatastoreIndex(t *testing.T) {
 	req.Equal(shards[0], sk1)
 }
 
+func TestDatastoreIndexRemove(t *testing.T) {
+	ctx := context.Background()
+	req := require.New(t)
+
+	mhs := GenerateMhs(3)
+	h1, h2, h3 := mhs[0], mhs[1], mhs[2]
+
+	idx := NewInverted(sync.MutexWrap(ds.NewMapDatastore()))
+
+	// h1 -> [shard-key-1, shard-key-2]
+	// h2 -> [shard-key-1]
+	// h3 -> [shard-key-2]
+	sk1 := shard.KeyFromString("shard-key-1")
+	err := idx.AddMultihashesForShard(ctx, &mhIt{[]multihash.Multihash{h1, h2}}, sk1)
+	req.NoError(err)
+	sk2 := shard.KeyFromString("shard-key-2")
+	err = idx.AddMultihashesForShard(ctx, &mhIt{[]multihash.Multihash{h1, h3}}, sk2)
+	req.NoError(err)
+
+	// remove shard-key-1; h3 is not mapped to it, so it's left untouched.
+	err = idx.RemoveMultihashesForShard(ctx, &mhIt{[]multihash.Multihash{h1, h2, h3}}, sk1)
+	req.NoError(err)
+
+	// h1 -> [shard-key-2]
+	shards, err := idx.GetShardsForMultihash(ctx, h1)
+	req.NoError(err)
+	req.Equal([]shard.Key{sk2}, shards)
+
+	// h2 has no shards left, so it's gone.
+	_, err = idx.GetShardsForMultihash(ctx, h2)
+	req.True(xerrors.Is(err, ds.ErrNotFound))
+
+	// h3 -> [shard-key-2]
+	shards, err = idx.GetShardsForMultihash(ctx, h3)
+	req.NoError(err)
+	req.Equal([]shard.Key{sk2}, shards)
+
+	// removing again is a noop.
+	err = idx.RemoveMultihashesForShard(ctx, &mhIt{[]multihash.Multihash{h1, h2, h3}}, sk1)
+	req.NoError(err)
+}
+
+func TestDatastoreIndexPrune(t *testing.T) {
+	ctx := context.Background()
+	req := require.New(t)
+
+	idx := NewInverted(sync.MutexWrap(ds.NewMapDatastore()))
+
+	// span more than a single batch.
+	mhs := GenerateMhs(3 * defaultBatchSize)
+	sk1 := shard.KeyFromString("shard-key-1")
+	sk2 := shard.KeyFromString("shard-key-2")
+	sk3 := shard.KeyFromString("shard-key-3")
+	req.NoError(idx.AddMultihashesForShard(ctx, &mhIt{mhs}, sk1))
+	req.NoError(idx.AddMultihashesForShard(ctx, &mhIt{mhs[:defaultBatchSize]}, sk2))
+	req.NoError(idx.AddMultihashesForShard(ctx, &mhIt{mhs[defaultBatchSize:]}, sk3))
+
+	// drop shard-key-2.
+	req.NoError(idx.DropShard(ctx, sk2))
+	for _, mh := range mhs {
+		shards, err := idx.GetShardsForMultihash(ctx, mh)
+		req.NoError(err)
+		req.NotContains(shards, sk2)
+	}
+
+	// prune everything but shard-key-3.
+	pruned, err := idx.PruneShards(ctx, func(k shard.Key) bool { return k == sk3 })
+	req.NoError(err)
+	req.Equal([]shard.Key{sk1}, pruned)
+
+	for i, mh := range mhs {
+		shards, err := idx.GetShardsForMultihash(ctx, mh)
+		if i < defaultBatchSize {
+			// these were only mapped to shard-key-1 and shard-key-2.
+			req.True(xerrors.Is(err, ds.ErrNotFound))
+			continue
+		}
+		req.NoError(err)
+		req.Equal([]shard.Key{sk3}, shards)
+	}
+
+	// nothing left to prune.
+	pruned, err = idx.PruneShards(ctx, func(k shard.Key) bool { return k == sk3 })
+	req.NoError(err)
+	req.Empty(pruned)
+}
+
+func TestDatastoreIndexPruneDictionary(t *testing.T) {
+	ctx := context.Background()
+	req := require.New(t)
+
+	dstore := sync.MutexWrap(ds.NewMapDatastore())
+	idx := NewInverted(dstore)
+
+	mhs := GenerateMhs(10)
+	sk1 := shard.KeyFromString("shard-key-1")
+	sk2 := shard.KeyFromString("shard-key-2")
+	sk3 := shard.KeyFromString("shard-key-3")
+	for _, k := range []shard.Key{sk1, sk2, sk3} {
+		req.NoError(idx.AddMultihashesForShard(ctx, &mhIt{mhs}, k))
+	}
+
+	// read the dictionary through a fresh instance, to check what's persisted.
+	dictKeys := func() []shard.Key {
+		return NewInverted(dstore).dictKeys(ctx, t)
+	}
+	req.ElementsMatch([]shard.Key{sk1, sk2, sk3}, dictKeys())
+
+	// dropping a shard drops its dictionary entry.
+	req.NoError(idx.DropShard(ctx, sk1))
+	req.ElementsMatch([]shard.Key{sk2, sk3}, dictKeys())
+
+	// removing the multihashes of a shard leaves its dictionary entry behind,
+	// until the next prune.
+	req.NoError(idx.RemoveMultihashesForShard(ctx, &mhIt{mhs}, sk2))
+	req.ElementsMatch([]shard.Key{sk2, sk3}, dictKeys())
+	pruned, err := idx.PruneShards(ctx, func(k shard.Key) bool { return k == sk3 })
+	req.NoError(err)
+	req.Empty(pruned)
+	req.ElementsMatch([]shard.Key{sk3}, dictKeys())
+
+	// re-adding a dropped shard works.
+	req.NoError(idx.AddMultihashesForShard(ctx, &mhIt{mhs}, sk1))
+	shards, err := idx.GetShardsForMultihash(ctx, mhs[0])
+	req.NoError(err)
+	req.ElementsMatch([]shard.Key{sk1, sk3}, shards)
+}
+
+// dictKeys returns the shard keys in the persisted dictionary.
+func (d *invertedIndexImpl) dictKeys(ctx context.Context, t *testing.T) []shard.Key {
+	d.dict.lk.Lock()
+	defer d.dict.lk.Unlock()
+	require.NoError(t, d.dict.load(ctx))
+	ret := make([]shard.Key, 0, len(d.dict.ids))
+	for k := range d.dict.ids {
+		ret = append(ret, k)
+	}
+	return ret
+}
+
+func TestShardIDsCodec(t *testing.T) {
+	for _, ids := range [][]uint64{{}, {0}, {1, 127, 128, 1 << 40}} {
+		bz := encodeShardIDs(ids)
+		require.Equal(t, valueVersion1, bz[0])
+		dec, err := decodeShardIDs(bz)
+		require.NoError(t, err)
+		require.Equal(t, ids, dec)
+	}
+
+	_, err := decodeShardIDs([]byte{0x7f})
+	require.ErrorIs(t, err, errUnknownValueFormat)
+
+	_, err = decodeShardIDs([]byte{valueVersion1, 0xff})
+	require.Error(t, err)
+}
+
+func TestDatastoreIndexLegacyValues(t *testing.T) {
+	ctx := context.Background()
+	req := require.New(t)
+
+	dstore := sync.MutexWrap(ds.NewMapDatastore())
+	idx := NewInverted(dstore)
+
+	mhs := GenerateMhs(2)
+	h1, h2 := mhs[0], mhs[1]
+	sk1 := shard.KeyFromString("shard-key-1")
+	sk2 := shard.KeyFromString("shard-key-2")
+
+	// write legacy JSON values by hand.
+	legacy, err := json.Marshal([]shard.Key{sk1})
+	req.NoError(err)
+	for _, mh := range mhs {
+		req.NoError(idx.ds.Put(ctx, ds.NewKey(string(mh)), legacy))
+	}
+
+	// legacy values are readable.
+	shards, err := idx.GetShardsForMultihash(ctx, h1)
+	req.NoError(err)
+	req.Equal([]shard.Key{sk1}, shards)
+
+	// updating a legacy value rewrites it in the binary format.
+	req.NoError(idx.AddMultihashesForShard(ctx, &mhIt{[]multihash.Multihash{h1}}, sk2))
+	val, err := idx.ds.Get(ctx, ds.NewKey(string(h1)))
+	req.NoError(err)
+	req.Equal(valueVersion1, val[0])
+	req.Less(len(val), len(legacy))
+	shards, err = idx.GetShardsForMultihash(ctx, h1)
+	req.NoError(err)
+	req.Equal([]shard.Key{sk1, sk2}, shards)
+
+	// pruning upgrades the remaining legacy values, even if nothing is pruned.
+	pruned, err := idx.PruneShards(ctx, func(shard.Key) bool { return true })
+	req.NoError(err)
+	req.Empty(pruned)
+	val, err = idx.ds.Get(ctx, ds.NewKey(string(h2)))
+	req.NoError(err)
+	req.Equal(valueVersion1, val[0])
+
+	// the shard dictionary survives across instances.
+	idx = NewInverted(dstore)
+	shards, err = idx.GetShardsForMultihash(ctx, h1)
+	req.NoError(err)
+	req.Equal([]shard.Key{sk1, sk2}, shards)
+	shards, err = idx.GetShardsForMultihash(ctx, h2)
+	req.NoError(err)
+	req.Equal([]shard.Key{sk1}, shards)
+
+	// new shards get fresh ids.
+	sk3 := shard.KeyFromString("shard-key-3")
+	req.NoError(idx.AddMultihashesForShard(ctx, &mhIt{[]multihash.Multihash{h2}}, sk3))
+	shards, err = idx.GetShardsForMultihash(ctx, h2)
+	req.NoError(err)
+	req.Equal([]shard.Key{sk1, sk3}, shards)
+}
+
+func TestDatastoreIndexConcurrentShards(t *testing.T) {
+	ctx := context.Background()
+	idx := NewInvertedWithOpts(sync.MutexWrap(ds.NewMapDatastore()), InvertedOpts{BatchSize: 64, Concurrency: 4})
+
+	// all shards contain the same multihashes, in different orders and with
+	// duplicates, so their updates contend on every entry.
+	mhs := GenerateMhs(2000)
+	var keys []shard.Key
+	grp, _ := errgroup.WithContext(ctx)
+	for i := 0; i < 8; i++ {
+		k := shard.KeyFromString(fmt.Sprintf("shard-key-%d", i))
+		keys = append(keys, k)
+
+		shuffled := make([]multihash.Multihash, 0, 2*len(mhs))
+		shuffled = append(shuffled, mhs...)
+		shuffled = append(shuffled, mhs[:100]...)
+		rand.New(rand.NewSource(int64(i))).Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		grp.Go(func() error {
+			return idx.AddMultihashesForShard(ctx, &mhIt{shuffled}, k)
+		})
+	}
+	require.NoError(t, grp.Wait())
+
+	for _, mh := range mhs {
+		shards, err := idx.GetShardsForMultihash(ctx, mh)
+		require.NoError(t, err)
+		require.ElementsMatch(t, keys, shards)
+	}
+}
+
+func TestDatastoreIndexPruneConcurrentShards(t *testing.T) {
+	ctx := context.Background()
+	idx := NewInvertedWithOpts(sync.MutexWrap(ds.NewMapDatastore()), InvertedOpts{BatchSize: 64, Concurrency: 4})
+
+	mhs := GenerateMhs(2000)
+	ghost := shard.KeyFromString("ghost")
+	require.NoError(t, idx.AddMultihashesForShard(ctx, &mhIt{mhs}, ghost))
+
+	// prune the ghost shard while other shards are being loaded on the same
+	// entries; the sweep must not clobber their updates.
+	var keys []shard.Key
+	grp, _ := errgroup.WithContext(ctx)
+	for i := 0; i < 4; i++ {
+		k := shard.KeyFromString(fmt.Sprintf("shard-key-%d", i))
+		keys = append(keys, k)
+		grp.Go(func() error {
+			return idx.AddMultihashesForShard(ctx, &mhIt{mhs}, k)
+		})
+	}
+	grp.Go(func() error {
+		_, err := idx.PruneShards(ctx, func(k shard.Key) bool { return k != ghost })
+		return err
+	})
+	require.NoError(t, grp.Wait())
+
+	for _, mh := range mhs {
+		shards, err := idx.GetShardsForMultihash(ctx, mh)
+		require.NoError(t, err)
+		require.ElementsMatch(t, keys, shards)
+	}
+}
+
+// BenchmarkAddMultihashesForShard measures the throughput of loading multiple
+// shards with partially overlapping multihashes into a LevelDB-backed index.
+func BenchmarkAddMultihashesForShard(b *testing.B) {
+	ctx := context.Background()
+	const nShards, nMhs = 8, 10000
+
+	shared := GenerateMhs(nMhs / 2)
+	shards := make([][]multihash.Multihash, nShards)
+	for i := range shards {
+		shards[i] = append(GenerateMhs(nMhs/2), shared...)
+	}
+
+	run := func(b *testing.B, opts InvertedOpts, concurrentShards bool) {
+		var elapsed time.Duration
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			// disable syncing, so that we measure the cost of indexing and not
+			// that of fsync.
+			dstore, err := levelds.NewDatastore(b.TempDir(), &levelds.Options{Compression: ldbopts.NoCompression, NoSync: true})
+			require.NoError(b, err)
+			idx := NewInvertedWithOpts(dstore, opts)
+			start := time.Now()
+			b.StartTimer()
+
+			grp, _ := errgroup.WithContext(ctx)
+			for j, mhs := range shards {
+				k := shard.KeyFromString(fmt.Sprintf("shard-key-%d", j))
+				mhs := mhs
+				load := func() error { return idx.AddMultihashesForShard(ctx, &mhIt{mhs}, k) }
+				if concurrentShards {
+					grp.Go(load)
+				} else {
+					require.NoError(b, load())
+				}
+			}
+			require.NoError(b, grp.Wait())
+
+			b.StopTimer()
+			elapsed += time.Since(start)
+			require.NoError(b, dstore.Close())
+			b.StartTimer()
+		}
+		b.ReportMetric(float64(nShards*nMhs*b.N)/elapsed.Seconds(), "mhs/s")
+	}
+
+	// sequential loads every shard in a single batch, one shard at a time,
+	// which is equivalent to the behaviour of a single global lock.
+	b.Run("sequential", func(b *testing.B) {
+		run(b, InvertedOpts{BatchSize: nMhs, Concurrency: 1}, false)
+	})
+	b.Run("pipelined", func(b *testing.B) {
+		run(b, InvertedOpts{}, false)
+	})
+	b.Run("pipelined-concurrent-shards", func(b *testing.B) {
+		run(b, InvertedOpts{}, true)
+	})
+}
+
 type mhIt struct {
 	mhs []multihash.Multihash
 }
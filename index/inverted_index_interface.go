@@ -15,6 +15,15 @@ type MultihashIterator interface {
 type Inverted interface {
 	// AddMultihashesForShard adds a (multihash -> shard key) mapping for all multihashes returned by the given MultihashIterator.
 	AddMultihashesForShard(ctx context.Context, mhIter MultihashIterator, s shard.Key) error
+	// RemoveMultihashesForShard removes the (multihash -> shard key) mapping for all multihashes returned by the given MultihashIterator.
+	// Multihashes that are left without any shard are removed from the index altogether.
+	RemoveMultihashesForShard(ctx context.Context, mhIter MultihashIterator, s shard.Key) error
+	// DropShard removes the shard key from every multihash in the index, without
+	// requiring the multihashes of the shard to be known. It scans the whole index.
+	DropShard(ctx context.Context, s shard.Key) error
+	// PruneShards scans the whole index and removes every shard key for which keep returns false.
+	// It returns the shard keys that were pruned. Entries stored in legacy formats are upgraded along the way.
+	PruneShards(ctx context.Context, keep func(shard.Key) bool) ([]shard.Key, error)
 	// GetShardsForMultihash returns keys for all the shards that has the given multihash.
 	GetShardsForMultihash(ctx context.Context, h multihash.Multihash) ([]shard.Key, error)
 }
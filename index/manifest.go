@@ -1,6 +1,14 @@
 package index
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
 	"github.com/filecoin-project/dagstore/shard"
 	"github.com/ipfs/go-cid"
 )
@@ -13,6 +21,10 @@ type ManifestKey struct {
 	GenVersion uint
 }
 
+func (k ManifestKey) String() string {
+	return fmt.Sprintf("%s/%s@v%d", k.Shard, k.GenRule, k.GenVersion)
+}
+
 // Manifest are sets of CIDs with no offset indication.
 type Manifest interface {
 	// Contains checks whether a given CID is contained in the manifest.
@@ -31,3 +43,121 @@ type Manifest interface {
 	// propagated to the caller.
 	ForEach(func(c cid.Cid) (ok bool, err error)) error
 }
+
+// SetManifest is a Manifest backed by an in-memory set of CIDs.
+type SetManifest struct {
+	lk   sync.RWMutex
+	cids map[cid.Cid]struct{}
+}
+
+var _ Manifest = (*SetManifest)(nil)
+
+// NewSetManifest creates a SetManifest containing the supplied CIDs.
+func NewSetManifest(cids ...cid.Cid) *SetManifest {
+	m := &SetManifest{cids: make(map[cid.Cid]struct{}, len(cids))}
+	for _, c := range cids {
+		m.cids[c] = struct{}{}
+	}
+	return m
+}
+
+// Add adds a CID to the manifest.
+func (m *SetManifest) Add(c cid.Cid) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	m.cids[c] = struct{}{}
+}
+
+func (m *SetManifest) Contains(c cid.Cid) (bool, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	_, ok := m.cids[c]
+	return ok, nil
+}
+
+func (m *SetManifest) Len() (int64, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	return int64(len(m.cids)), nil
+}
+
+func (m *SetManifest) ForEach(f func(c cid.Cid) (bool, error)) error {
+	m.lk.RLock()
+	cids := make([]cid.Cid, 0, len(m.cids))
+	for c := range m.cids {
+		cids = append(cids, c)
+	}
+	m.lk.RUnlock()
+
+	for _, c := range cids {
+		ok, err := f(c)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	}
+	return nil
+}
+
+// WriteManifest serializes a manifest as a sequence of length-prefixed CIDs,
+// sorted so that equal manifests have equal encodings. It returns the number
+// of bytes written.
+func WriteManifest(w io.Writer, m Manifest) (int64, error) {
+	var cids [][]byte
+	err := m.ForEach(func(c cid.Cid) (bool, error) {
+		cids = append(cids, c.Bytes())
+		return true, nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to traverse manifest: %w", err)
+	}
+	sort.Slice(cids, func(i, j int) bool {
+		return bytes.Compare(cids[i], cids[j]) < 0
+	})
+
+	var n int64
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, c := range cids {
+		l := binary.PutUvarint(buf, uint64(len(c)))
+		written, err := w.Write(buf[:l])
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+		written, err = w.Write(c)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ReadManifest deserializes a manifest written by WriteManifest.
+func ReadManifest(r io.Reader) (*SetManifest, error) {
+	br := bufio.NewReader(r)
+	m := NewSetManifest()
+	for {
+		l, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest entry length: %w", err)
+		}
+		b := make([]byte, l)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, fmt.Errorf("failed to read manifest entry: %w", err)
+		}
+		c, err := cid.Cast(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse manifest entry: %w", err)
+		}
+		m.cids[c] = struct{}{}
+	}
+}
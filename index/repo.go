@@ -51,19 +51,23 @@ type FullIndexRepo interface {
 	Size() (uint64, error)
 }
 
-// TODO unimplemented.
+// ManifestRepo stores manifests, i.e. sets of CIDs derived from shards by
+// generation rules.
 type ManifestRepo interface {
 	// ListManifests returns the available manifests for a given shard,
-	// identified by their ManifestKey.
+	// identified by their ManifestKey. It returns an empty slice if there
+	// are none.
 	ListManifests(key shard.Key) ([]ManifestKey, error)
 
-	// GetManifest returns the Manifest identified by a given ManifestKey.
+	// GetManifest returns the Manifest identified by a given ManifestKey, or
+	// ErrNotFound if it doesn't exist.
 	GetManifest(key ManifestKey) (Manifest, error)
 
 	// AddManifest adds a Manifest to the ManifestRepo.
 	AddManifest(key ManifestKey, manifest Manifest) error
 
-	// DropManifest drops a Manifest from the ManifestRepo.
+	// DropManifest drops a Manifest from the ManifestRepo. If the error is
+	// nil, it returns whether a manifest was effectively dropped.
 	DropManifest(key ManifestKey) (bool, error)
 
 	// StatManifest stats a Manifest.
@@ -17,13 +17,13 @@ const (
 	indexSuffix = ".full.idx"
 )
 
-// FSIndexRepo implements FullIndexRepo using the local file system to store
-// the indices
+// FSIndexRepo implements Repo using the local file system to store the
+// indices and manifests
 type FSIndexRepo struct {
 	baseDir string
 }
 
-var _ FullIndexRepo = (*FSIndexRepo)(nil)
+var _ Repo = (*FSIndexRepo)(nil)
 
 // NewFSRepo creates a new index repo that stores indices on the local
 // filesystem with the given base directory as the root
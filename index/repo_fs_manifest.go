@@ -0,0 +1,147 @@
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+const (
+	manifestsDir   = "manifests"
+	manifestSuffix = ".manifest"
+)
+
+var _ ManifestRepo = (*FSIndexRepo)(nil)
+
+// ListManifests lists the manifest files in the shard's manifest directory.
+func (l *FSIndexRepo) ListManifests(key shard.Key) ([]ManifestKey, error) {
+	entries, err := ioutil.ReadDir(l.manifestsPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []ManifestKey{}, nil
+		}
+		return nil, err
+	}
+
+	ret := make([]ManifestKey, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, manifestSuffix) {
+			continue
+		}
+		// file names are <rule>.v<version>.manifest.
+		name = name[:len(name)-len(manifestSuffix)]
+		i := strings.LastIndex(name, ".v")
+		if i < 0 {
+			continue
+		}
+		version, err := strconv.ParseUint(name[i+2:], 10, 0)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, ManifestKey{Shard: key, GenRule: name[:i], GenVersion: uint(version)})
+	}
+	return ret, nil
+}
+
+func (l *FSIndexRepo) GetManifest(key ManifestKey) (Manifest, error) {
+	path, err := l.manifestPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("manifest %s: %w", key, ErrNotFound)
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadManifest(f)
+}
+
+// AddManifest writes the manifest to a temporary file, and moves it into
+// place once complete, so that partial manifests are never observed.
+func (l *FSIndexRepo) AddManifest(key ManifestKey, manifest Manifest) error {
+	path, err := l.manifestPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create manifest dir: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := WriteManifest(f, manifest); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write manifest %s: %w", key, err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (l *FSIndexRepo) DropManifest(key ManifestKey) (bool, error) {
+	path, err := l.manifestPath(key)
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// remove the shard's manifest directory if it's now empty; this fails
+	// harmlessly otherwise.
+	_ = os.Remove(filepath.Dir(path))
+	return true, nil
+}
+
+func (l *FSIndexRepo) StatManifest(key ManifestKey) (Stat, error) {
+	path, err := l.manifestPath(key)
+	if err != nil {
+		return Stat{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Stat{Exists: false}, nil
+		}
+		return Stat{}, err
+	}
+
+	return Stat{
+		Exists: true,
+		Size:   uint64(info.Size()),
+	}, nil
+}
+
+func (l *FSIndexRepo) manifestsPath(key shard.Key) string {
+	return filepath.Join(l.baseDir, manifestsDir, key.String())
+}
+
+func (l *FSIndexRepo) manifestPath(key ManifestKey) (string, error) {
+	if key.GenRule == "" || strings.ContainsAny(key.GenRule, `/\`) {
+		return "", fmt.Errorf("invalid manifest generation rule: %q", key.GenRule)
+	}
+	name := fmt.Sprintf("%s.v%d%s", key.GenRule, key.GenVersion, manifestSuffix)
+	return filepath.Join(l.manifestsPath(key.Shard), name), nil
+}
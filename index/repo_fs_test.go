@@ -18,6 +18,7 @@ func TestFSRepo(t *testing.T) {
 	require.NoError(t, err)
 
 	suite.Run(t, &fullIndexRepoSuite{impl: repo})
+	suite.Run(t, &manifestRepoSuite{impl: repo})
 }
 
 func TestFSRepoVersions(t *testing.T) {
@@ -74,3 +75,39 @@ func TestFSRepoLoadFromDisk(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, offset1, offset)
 }
+
+func TestFSRepoManifestsLoadFromDisk(t *testing.T) {
+	basePath := t.TempDir()
+
+	cid1, err := cid.Parse("bafykbzaceaeqhm77anl5mv2wjkmh4ofyf6s6eww3ujfmhtsfab65vi3rlccaq")
+	require.NoError(t, err)
+	mk := ManifestKey{Shard: shard.KeyFromString("shard-key-1"), GenRule: "roots", GenVersion: 1}
+
+	repo1, err := NewFSRepo(basePath)
+	require.NoError(t, err)
+	err = repo1.AddManifest(mk, NewSetManifest(cid1))
+	require.NoError(t, err)
+
+	// Manifests don't count as indices
+	l, err := repo1.Len()
+	require.NoError(t, err)
+	require.Zero(t, l)
+
+	// Verify that a new repo at the same path lists and serves the manifest
+	repo2, err := NewFSRepo(basePath)
+	require.NoError(t, err)
+
+	keys, err := repo2.ListManifests(mk.Shard)
+	require.NoError(t, err)
+	require.Equal(t, []ManifestKey{mk}, keys)
+
+	m, err := repo2.GetManifest(mk)
+	require.NoError(t, err)
+	ok, err := m.Contains(cid1)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Rules that would escape the shard's manifest directory are rejected
+	err = repo2.AddManifest(ManifestKey{Shard: mk.Shard, GenRule: "../roots"}, NewSetManifest(cid1))
+	require.Error(t, err)
+}
@@ -8,14 +8,18 @@ import (
 	"github.com/ipld/go-car/v2/index"
 )
 
-// MemIndexRepo implements FullIndexRepo with an in-memory map.
+// MemIndexRepo implements Repo with in-memory maps.
 type MemIndexRepo struct {
-	lk   sync.RWMutex
-	idxs map[shard.Key]index.Index
+	lk        sync.RWMutex
+	idxs      map[shard.Key]index.Index
+	manifests map[ManifestKey]Manifest
 }
 
 func NewMemoryRepo() *MemIndexRepo {
-	return &MemIndexRepo{idxs: make(map[shard.Key]index.Index)}
+	return &MemIndexRepo{
+		idxs:      make(map[shard.Key]index.Index),
+		manifests: make(map[ManifestKey]Manifest),
+	}
 }
 
 func (m *MemIndexRepo) GetFullIndex(key shard.Key) (idx index.Index, err error) {
@@ -128,4 +132,4 @@ func (m *MemIndexRepo) indexSize(k shard.Key) (uint64, error) {
 	return uint64(buff.Len()), nil
 }
 
-var _ FullIndexRepo = (*MemIndexRepo)(nil)
+var _ Repo = (*MemIndexRepo)(nil)
@@ -0,0 +1,74 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+var _ ManifestRepo = (*MemIndexRepo)(nil)
+
+func (m *MemIndexRepo) ListManifests(key shard.Key) ([]ManifestKey, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	ret := []ManifestKey{}
+	for k := range m.manifests {
+		if k.Shard == key {
+			ret = append(ret, k)
+		}
+	}
+	return ret, nil
+}
+
+func (m *MemIndexRepo) GetManifest(key ManifestKey) (Manifest, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	manifest, ok := m.manifests[key]
+	if !ok {
+		return nil, fmt.Errorf("manifest %s: %w", key, ErrNotFound)
+	}
+	return manifest, nil
+}
+
+func (m *MemIndexRepo) AddManifest(key ManifestKey, manifest Manifest) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	m.manifests[key] = manifest
+
+	return nil
+}
+
+func (m *MemIndexRepo) DropManifest(key ManifestKey) (bool, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	_, ok := m.manifests[key]
+	delete(m.manifests, key)
+
+	return ok, nil
+}
+
+func (m *MemIndexRepo) StatManifest(key ManifestKey) (Stat, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	manifest, ok := m.manifests[key]
+	if !ok {
+		return Stat{Exists: false}, nil
+	}
+
+	// serialize the manifest just to get the size, like we do for indices.
+	var buff bytes.Buffer
+	if _, err := WriteManifest(&buff, manifest); err != nil {
+		return Stat{}, err
+	}
+
+	return Stat{
+		Exists: true,
+		Size:   uint64(buff.Len()),
+	}, nil
+}
@@ -8,4 +8,5 @@ import (
 
 func TestMemIndexRepo(t *testing.T) {
 	suite.Run(t, &fullIndexRepoSuite{impl: NewMemoryRepo()})
+	suite.Run(t, &manifestRepoSuite{impl: NewMemoryRepo()})
 }
@@ -108,3 +108,100 @@ func (s *fullIndexRepoSuite) TestAllMethods() {
 	size, err = r.Size()
 	require.EqualValues(t, 0, size)
 }
+
+type manifestRepoSuite struct {
+	suite.Suite
+	impl ManifestRepo
+}
+
+func (s *manifestRepoSuite) TestAllMethods() {
+	r := s.impl
+	t := s.T()
+
+	cid1, err := cid.Parse("bafykbzaceaeqhm77anl5mv2wjkmh4ofyf6s6eww3ujfmhtsfab65vi3rlccaq")
+	require.NoError(t, err)
+	cid2, err := cid.Parse("QmPNHBy5h7f19yJDt7ip9TvmMRbqmYsa6aetkrsc1ghjLB")
+	require.NoError(t, err)
+
+	k := shard.KeyFromString("shard-key-1")
+	mk1 := ManifestKey{Shard: k, GenRule: "roots", GenVersion: 1}
+	mk2 := ManifestKey{Shard: k, GenRule: "all.cids", GenVersion: 12}
+	other := ManifestKey{Shard: shard.KeyFromString("shard-key-2"), GenRule: "roots", GenVersion: 1}
+
+	// Verify that an empty repo has no manifests
+	keys, err := r.ListManifests(k)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	stat, err := r.StatManifest(mk1)
+	require.NoError(t, err)
+	require.False(t, stat.Exists)
+
+	_, err = r.GetManifest(mk1)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Add manifests
+	require.NoError(t, r.AddManifest(mk1, NewSetManifest(cid1)))
+	require.NoError(t, r.AddManifest(mk2, NewSetManifest(cid1, cid2)))
+	require.NoError(t, r.AddManifest(other, NewSetManifest(cid2)))
+
+	keys, err = r.ListManifests(k)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []ManifestKey{mk1, mk2}, keys)
+
+	// Verify the size of the manifest is correct
+	var b bytes.Buffer
+	_, err = WriteManifest(&b, NewSetManifest(cid1, cid2))
+	require.NoError(t, err)
+
+	stat, err = r.StatManifest(mk2)
+	require.NoError(t, err)
+	require.True(t, stat.Exists)
+	require.EqualValues(t, b.Len(), stat.Size)
+
+	// Verify that we can retrieve a manifest and perform lookups
+	m, err := r.GetManifest(mk2)
+	require.NoError(t, err)
+	l, err := m.Len()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, l)
+	ok, err := m.Contains(cid2)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	m, err = r.GetManifest(mk1)
+	require.NoError(t, err)
+	ok, err = m.Contains(cid2)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	var visited []cid.Cid
+	err = m.ForEach(func(c cid.Cid) (bool, error) {
+		visited = append(visited, c)
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{cid1}, visited)
+
+	// Drop a manifest
+	dropped, err := r.DropManifest(mk1)
+	require.NoError(t, err)
+	require.True(t, dropped)
+
+	dropped, err = r.DropManifest(mk1)
+	require.NoError(t, err)
+	require.False(t, dropped)
+
+	keys, err = r.ListManifests(k)
+	require.NoError(t, err)
+	require.Equal(t, []ManifestKey{mk2}, keys)
+
+	stat, err = r.StatManifest(mk1)
+	require.NoError(t, err)
+	require.False(t, stat.Exists)
+
+	// The other shard's manifests are untouched
+	keys, err = r.ListManifests(other.Shard)
+	require.NoError(t, err)
+	require.Equal(t, []ManifestKey{other}, keys)
+}
@@ -0,0 +1,151 @@
+package dagstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	_ "github.com/ipld/go-codec-dagpb"              // register the dag-pb decoder.
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor" // register the dag-cbor decoder.
+	_ "github.com/ipld/go-ipld-prime/codec/dagjson" // register the dag-json decoder.
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipldcodec "github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/multiformats/go-multicodec"
+
+	"github.com/filecoin-project/dagstore/index"
+)
+
+// ManifestGenerator derives a manifest from a shard when the shard is
+// initialized. The generated manifest is stored under a ManifestKey made of
+// the shard key, and the generator's GenRule and GenVersion.
+type ManifestGenerator interface {
+	// GenRule identifies the rule by which the generator derives manifests.
+	GenRule() string
+
+	// GenVersion is the version of the rule. It must be bumped whenever the
+	// manifests generated for the same shard would change.
+	GenVersion() uint
+
+	// Generate derives a manifest from the shard's blocks and roots.
+	Generate(ctx context.Context, bs ReadBlockstore, roots []cid.Cid) (index.Manifest, error)
+}
+
+// RootsManifestGenerator generates manifests containing the roots of the
+// shard, as declared in its CAR header.
+type RootsManifestGenerator struct{}
+
+var _ ManifestGenerator = RootsManifestGenerator{}
+
+func (RootsManifestGenerator) GenRule() string  { return "roots" }
+func (RootsManifestGenerator) GenVersion() uint { return 1 }
+
+func (RootsManifestGenerator) Generate(_ context.Context, _ ReadBlockstore, roots []cid.Cid) (index.Manifest, error) {
+	return index.NewSetManifest(roots...), nil
+}
+
+// AllCIDsManifestGenerator generates manifests containing the CIDs of all
+// the blocks in the shard.
+type AllCIDsManifestGenerator struct{}
+
+var _ ManifestGenerator = AllCIDsManifestGenerator{}
+
+func (AllCIDsManifestGenerator) GenRule() string  { return "all-cids" }
+func (AllCIDsManifestGenerator) GenVersion() uint { return 1 }
+
+func (AllCIDsManifestGenerator) Generate(ctx context.Context, bs ReadBlockstore, _ []cid.Cid) (index.Manifest, error) {
+	ch, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enumerate blocks: %w", err)
+	}
+
+	m := index.NewSetManifest()
+	for c := range ch {
+		m.Add(c)
+	}
+	// AllKeysChan closes the channel early if the context is cancelled.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DAGManifestGenerator generates manifests containing the CIDs of the blocks
+// in the shard that are reachable from its roots. Links are followed for the
+// dag-pb, dag-cbor and dag-json codecs; links to blocks that aren't in the
+// shard are not followed, nor included in the manifest.
+type DAGManifestGenerator struct{}
+
+var _ ManifestGenerator = DAGManifestGenerator{}
+
+func (DAGManifestGenerator) GenRule() string  { return "dag" }
+func (DAGManifestGenerator) GenVersion() uint { return 1 }
+
+func (DAGManifestGenerator) Generate(ctx context.Context, bs ReadBlockstore, roots []cid.Cid) (index.Manifest, error) {
+	m := index.NewSetManifest()
+	queue := append([]cid.Cid(nil), roots...)
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		c := queue[0]
+		queue = queue[1:]
+		if ok, _ := m.Contains(c); ok {
+			continue
+		}
+		if has, err := bs.Has(ctx, c); err != nil {
+			return nil, fmt.Errorf("failed to check for block %s: %w", c, err)
+		} else if !has {
+			continue
+		}
+		m.Add(c)
+
+		links, err := blockLinks(ctx, bs, c)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, links...)
+	}
+	return m, nil
+}
+
+// blockLinks decodes the block with the specified CID, and returns the CIDs
+// it links to. Blocks encoded with codecs that can't hold links, or that
+// aren't supported, have no links.
+func blockLinks(ctx context.Context, bs ReadBlockstore, c cid.Cid) ([]cid.Cid, error) {
+	switch multicodec.Code(c.Prefix().Codec) {
+	case multicodec.DagPb, multicodec.DagCbor, multicodec.DagJson:
+	default:
+		return nil, nil
+	}
+
+	decoder, err := ipldcodec.LookupDecoder(c.Prefix().Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	blk, err := bs.Get(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get block %s: %w", c, err)
+	}
+
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := decoder(nb, bytes.NewReader(blk.RawData())); err != nil {
+		return nil, fmt.Errorf("failed to decode block %s: %w", c, err)
+	}
+	links, err := traversal.SelectLinks(nb.Build())
+	if err != nil {
+		return nil, fmt.Errorf("failed to select links of block %s: %w", c, err)
+	}
+
+	ret := make([]cid.Cid, 0, len(links))
+	for _, l := range links {
+		if cl, ok := l.(cidlink.Link); ok {
+			ret = append(ret, cl.Cid)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,254 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/throttle"
+)
+
+const metricsNamespace = "dagstore"
+
+// metrics holds the DAG store metrics. They are always collected, and are
+// registered on Config.MetricsRegisterer, if provided.
+type metrics struct {
+	taskDuration     *prometheus.HistogramVec
+	acquireDuration  prometheus.Histogram
+	fetchDuration    *prometheus.HistogramVec
+	fetchBytes       *prometheus.CounterVec
+	indexDuration    prometheus.Histogram
+	indexBytes       prometheus.Counter
+	gcReclaimedBytes prometheus.Counter
+	throttleWait     *prometheus.HistogramVec
+	traceDropped     prometheus.Counter
+
+	// state exposes gauges that are computed from the DAG store state when
+	// collected.
+	state *stateCollector
+}
+
+func newMetrics(d *DAGStore) *metrics {
+	return &metrics{
+		taskDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "task_duration_seconds",
+			Help:      "Time from queuing a task to the event loop finishing processing it, by operation.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"op"}),
+		acquireDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "acquire_duration_seconds",
+			Help:      "Time from requesting a shard acquisition to the result being ready for delivery.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		fetchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "fetch_duration_seconds",
+			Help:      "Time taken to fetch shards from their mounts, including downloading transients, by mount scheme.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"scheme"}),
+		fetchBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "fetch_bytes_total",
+			Help:      "Bytes downloaded from mounts into transients when fetching shards, by mount scheme.",
+		}, []string{"scheme"}),
+		indexDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "index_duration_seconds",
+			Help:      "Time taken to read or generate the index of a shard.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		indexBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "index_bytes_total",
+			Help:      "Bytes read from shards to read or generate their indices.",
+		}),
+		gcReclaimedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "gc_reclaimed_bytes_total",
+			Help:      "Bytes reclaimed by deleting transients, through GC or quota eviction.",
+		}),
+		throttleWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "throttle_wait_seconds",
+			Help:      "Time spent waiting for a throttler slot, by throttler.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"throttler"}),
+		traceDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "trace_dropped_total",
+			Help:      "Traces dropped or coalesced because a subscriber's buffer was full.",
+		}),
+		state: &stateCollector{
+			d: d,
+			shards: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "shards"),
+				"Number of shards, by state.", []string{"state"}, nil),
+			queueDepth: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "queue_depth"),
+				"Number of tasks waiting in the event loop queues, by queue, summed across event loops.", []string{"queue"}, nil),
+			transientsBytes: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "transients_bytes"),
+				"Disk space used by transients.", nil, nil),
+			throttleInUse: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "throttle_in_use"),
+				"Concurrency, or weight, claimed by the work in flight, by throttler.", []string{"throttler"}, nil),
+			throttleWaiting: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "throttle_waiting"),
+				"Number of jobs waiting for a throttler, by throttler.", []string{"throttler"}, nil),
+		},
+	}
+}
+
+// register registers all metrics on the registerer.
+func (m *metrics) register(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		m.taskDuration,
+		m.acquireDuration,
+		m.fetchDuration,
+		m.fetchBytes,
+		m.indexDuration,
+		m.indexBytes,
+		m.gcReclaimedBytes,
+		m.throttleWait,
+		m.traceDropped,
+		m.state,
+	} {
+		if err := r.Register(c); err != nil {
+			return fmt.Errorf("failed to register metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+// stateCollector collects gauges derived from the DAG store state.
+type stateCollector struct {
+	d *DAGStore
+
+	shards          *prometheus.Desc
+	queueDepth      *prometheus.Desc
+	transientsBytes *prometheus.Desc
+	throttleInUse   *prometheus.Desc
+	throttleWaiting *prometheus.Desc
+}
+
+var _ prometheus.Collector = (*stateCollector)(nil)
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.shards
+	ch <- c.queueDepth
+	ch <- c.transientsBytes
+	ch <- c.throttleInUse
+	ch <- c.throttleWaiting
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	d := c.d
+
+	counts := map[ShardState]int{
+		ShardStateNew:          0,
+		ShardStateInitializing: 0,
+		ShardStateAvailable:    0,
+		ShardStateServing:      0,
+		ShardStateRecovering:   0,
+		ShardStateErrored:      0,
+	}
+	for _, info := range d.AllShardsInfo() {
+		counts[info.ShardState]++
+	}
+	for state, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.shards, prometheus.GaugeValue, float64(n), state.String())
+	}
+
+	var external, internal, completion int
+	for _, l := range d.loops {
+		external += len(l.externalCh)
+		internal += len(l.internalCh)
+		completion += len(l.completionCh)
+	}
+	for name, n := range map[string]int{
+		"external":   external,
+		"internal":   internal,
+		"completion": completion,
+	} {
+		ch <- prometheus.MustNewConstMetric(c.queueDepth, prometheus.GaugeValue, float64(n), name)
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.transientsBytes, prometheus.GaugeValue, float64(d.transientsUsage()))
+
+	stats := d.LimitsStats()
+	for name, s := range map[string]throttle.Stats{
+		"index":             stats.Index,
+		"ready_fetch":       stats.ReadyFetch,
+		"index_bytes":       stats.IndexBytes,
+		"ready_fetch_bytes": stats.ReadyFetchBytes,
+	} {
+		ch <- prometheus.MustNewConstMetric(c.throttleInUse, prometheus.GaugeValue, float64(s.InUse), name)
+		ch <- prometheus.MustNewConstMetric(c.throttleWaiting, prometheus.GaugeValue, float64(s.Waiting), name)
+	}
+}
+
+// observeThrottler records the time spent waiting for a slot in the
+// throttler.
+func observeThrottler(t throttle.Throttler, wait prometheus.Observer) throttle.Throttler {
+	return &observedThrottler{Throttler: t, wait: wait}
+}
+
+type observedThrottler struct {
+	throttle.Throttler
+	wait prometheus.Observer
+}
+
+func (t *observedThrottler) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	return t.Throttler.Do(ctx, func(ctx context.Context) error {
+		t.wait.Observe(time.Since(start).Seconds())
+		return fn(ctx)
+	})
+}
+
+// observeWeighted records the time spent waiting for capacity in the weighted
+// throttler.
+func observeWeighted(t throttle.WeightedThrottler, wait prometheus.Observer) throttle.WeightedThrottler {
+	return &observedWeighted{WeightedThrottler: t, wait: wait}
+}
+
+type observedWeighted struct {
+	throttle.WeightedThrottler
+	wait prometheus.Observer
+}
+
+func (t *observedWeighted) Do(ctx context.Context, weight int64, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	return t.WeightedThrottler.Do(ctx, weight, func(ctx context.Context) error {
+		t.wait.Observe(time.Since(start).Seconds())
+		return fn(ctx)
+	})
+}
+
+// countingReader counts the bytes read from a mount.Reader.
+type countingReader struct {
+	mount.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.Reader.ReadAt(p, off)
+	r.n += int64(n)
+	return n, err
+}
+
+// mountScheme returns the scheme of the shard's underlying mount, for use
+// as a metric label.
+func (d *DAGStore) mountScheme(s *Shard) string {
+	u, err := d.mounts.Represent(s.mount.Underlying())
+	if err != nil {
+		return "unknown"
+	}
+	return u.Scheme
+}
@@ -0,0 +1,110 @@
+package dagstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/testdata"
+)
+
+func TestMetrics(t *testing.T) {
+	registry := prometheus.NewPedanticRegistry()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:      testRegistry(t),
+		TransientsDir:      t.TempDir(),
+		MetricsRegisterer:  registry,
+		MaxConcurrentIndex: 1,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// the metrics can only be registered once per registry.
+	_, err = NewDAGStore(Config{TransientsDir: t.TempDir(), MetricsRegisterer: registry})
+	require.Error(t, err)
+
+	keys := registerShards(t, dagst, 2, carv2mnt, RegisterOpts{})
+	releaseAll(t, dagst, keys[0], acquireShard(t, dagst, keys[0], 2))
+
+	size := float64(len(testdata.CarV2))
+	m := dagst.metrics
+
+	// both shards were downloaded into transients, and indexed; acquisitions
+	// fetch from the existing transient.
+	require.Equal(t, 2*size, testutil.ToFloat64(m.fetchBytes.WithLabelValues("fs")))
+	require.EqualValues(t, 4, histogramCount(t, m.fetchDuration.WithLabelValues("fs")))
+	require.EqualValues(t, 2, histogramCount(t, m.indexDuration))
+	require.Greater(t, testutil.ToFloat64(m.indexBytes), float64(0))
+	require.EqualValues(t, 2, histogramCount(t, m.throttleWait.WithLabelValues("index")))
+	require.EqualValues(t, 2, histogramCount(t, m.acquireDuration))
+	require.EqualValues(t, 2, histogramCount(t, m.taskDuration.WithLabelValues(OpShardRegister.String())))
+	require.EqualValues(t, 2, histogramCount(t, m.taskDuration.WithLabelValues(OpShardAcquire.String())))
+
+	// state gauges are computed on collection.
+	expected := map[string]float64{
+		`dagstore_shards{state="ShardStateAvailable"}`: 2,
+		`dagstore_shards{state="ShardStateServing"}`:   0,
+		`dagstore_queue_depth{queue="external"}`:       0,
+		`dagstore_transients_bytes`:                    2 * size,
+		`dagstore_throttle_in_use{throttler="index"}`:  0,
+	}
+	require.Eventually(t, func() bool {
+		gathered := gather(t, registry)
+		for k, v := range expected {
+			if gathered[k] != v {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// GC reclaims both transients.
+	res, err := dagst.GC(context.Background())
+	require.NoError(t, err)
+	require.Len(t, res.Shards, 2)
+	require.Equal(t, 2*size, testutil.ToFloat64(m.gcReclaimedBytes))
+	require.Zero(t, gather(t, registry)[`dagstore_transients_bytes`])
+}
+
+// histogramCount returns the number of observations of a histogram.
+func histogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	var pb dto.Metric
+	require.NoError(t, o.(prometheus.Metric).Write(&pb))
+	return pb.GetHistogram().GetSampleCount()
+}
+
+// gather gathers the gauges in the registry, keyed by name and labels in
+// exposition format.
+func gather(t *testing.T, g prometheus.Gatherer) map[string]float64 {
+	mfs, err := g.Gather()
+	require.NoError(t, err)
+
+	ret := make(map[string]float64)
+	for _, mf := range mfs {
+		if mf.GetType() != dto.MetricType_GAUGE {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			name := mf.GetName()
+			if lbls := m.GetLabel(); len(lbls) > 0 {
+				name += "{"
+				for i, l := range lbls {
+					if i > 0 {
+						name += ","
+					}
+					name += l.GetName() + `="` + l.GetValue() + `"`
+				}
+				name += "}"
+			}
+			ret[name] = m.GetGauge().GetValue()
+		}
+	}
+	return ret
+}
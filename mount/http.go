@@ -0,0 +1,409 @@
+package mount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rangesFragment is the URL fragment HTTPMount uses to record that the server
+// supports range requests. Fragments are never sent to servers, so it's safe
+// to piggyback on it.
+const rangesFragment = "ranges"
+
+// HTTPMount is a mount that fetches a CAR file from an HTTP(S) URL. It is
+// meant to be registered under both the http and https schemes:
+//
+//	_ = registry.Register("http", &mount.HTTPMount{})
+//	_ = registry.RegisterAlias("https", "http")
+//
+// If the server supports range requests (as reported by NewHTTPMount, or by
+// setting Ranges), the mount supports random access and seeking by issuing
+// range requests, and the Upgrader passes through to it. Otherwise, it only
+// supports sequential access, and the Upgrader will download it to a
+// transient file.
+type HTTPMount struct {
+	// URL is the URL of the CAR file.
+	URL string
+	// Ranges indicates whether the server supports range requests.
+	Ranges bool
+	// Client is the HTTP client to use. If nil, http.DefaultClient is used.
+	// As an exported field, it is carried over to mounts instantiated from a
+	// registered template.
+	Client *http.Client
+}
+
+var (
+	_ Mount        = (*HTTPMount)(nil)
+	_ RangeFetcher = (*HTTPMount)(nil)
+	_ Retryable    = (*HTTPMount)(nil)
+	_ ErrorSource  = (*HTTPMount)(nil)
+)
+
+// NewHTTPMount creates a new HTTPMount for the specified URL, probing the
+// server with a HEAD request to determine whether it supports range requests.
+func NewHTTPMount(ctx context.Context, client *http.Client, u string) (*HTTPMount, error) {
+	m := &HTTPMount{URL: u, Client: client}
+	resp, err := m.head(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	m.Ranges = resp.StatusCode == http.StatusOK && resp.Header.Get("Accept-Ranges") == "bytes"
+	return m, nil
+}
+
+func (h *HTTPMount) Fetch(ctx context.Context) (Reader, error) {
+	if h.Ranges {
+		size, err := h.size(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// with range requests, requests are issued lazily, as the reader is
+		// read from, possibly after the fetch has returned. They carry the
+		// values of the caller's context, but they're only cancelled when the
+		// reader is closed.
+		rctx, cancel := context.WithCancel(detachedContext{ctx})
+		return &httpReader{mnt: h, ctx: rctx, cancel: cancel, size: size}, nil
+	}
+
+	// without range requests, the only thing we can do is to stream the
+	// body sequentially.
+	resp, err := h.get(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return &httpReader{mnt: h, ctx: ctx, body: resp.Body, size: resp.ContentLength}, nil
+}
+
+// FetchFrom fetches the resource from the specified offset through a range
+// request. It fails if the server doesn't honour range requests.
+func (h *HTTPMount) FetchFrom(ctx context.Context, offset int64) (Reader, error) {
+	if offset == 0 {
+		return h.Fetch(ctx)
+	}
+	resp, err := h.get(ctx, fmt.Sprintf("bytes=%d-", offset))
+	if err != nil {
+		return nil, err
+	}
+	r := &httpReader{mnt: h, ctx: ctx, body: resp.Body, offset: offset, size: contentRangeSize(resp)}
+	return r, nil
+}
+
+func (h *HTTPMount) Info() Info {
+	return Info{
+		Kind:             KindRemote,
+		AccessSequential: true,
+		AccessSeek:       h.Ranges,
+		AccessRandom:     h.Ranges,
+	}
+}
+
+func (h *HTTPMount) Stat(ctx context.Context) (Stat, error) {
+	size, err := h.size(ctx)
+	var serr *statusError
+	if errors.As(err, &serr) && (serr.code == http.StatusNotFound || serr.code == http.StatusGone) {
+		return Stat{Exists: false}, nil
+	}
+	if err != nil {
+		return Stat{}, err
+	}
+
+	return Stat{
+		Exists: true,
+		Size:   size,
+		Ready:  true,
+	}, nil
+}
+
+// size returns the size of the resource, as reported by the Content-Length of
+// a HEAD request or, if the server omits it, by the Content-Range of a
+// single-byte range request.
+func (h *HTTPMount) size(ctx context.Context) (int64, error) {
+	resp, err := h.head(ctx)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, &statusError{op: "stat", url: h.URL, code: resp.StatusCode, status: resp.Status}
+	}
+	if resp.ContentLength >= 0 {
+		return resp.ContentLength, nil
+	}
+
+	resp, err = h.get(ctx, "bytes=0-0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to probe size of %s: %w", h.URL, err)
+	}
+	_ = resp.Body.Close()
+	size := contentRangeSize(resp)
+	if size < 0 {
+		return 0, fmt.Errorf("failed to determine size of %s: no Content-Length nor complete Content-Range", h.URL)
+	}
+	return size, nil
+}
+
+// contentRangeSize returns the complete length of the resource reported by
+// the Content-Range header of a partial response, or -1 if it's unknown.
+func contentRangeSize(resp *http.Response) int64 {
+	cr := resp.Header.Get("Content-Range")
+	i := strings.LastIndexByte(cr, '/')
+	if i < 0 {
+		return -1
+	}
+	size, err := strconv.ParseInt(cr[i+1:], 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+func (h *HTTPMount) Serialize() *url.URL {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return &url.URL{Host: "irrecoverable"}
+	}
+	u.Fragment = ""
+	if h.Ranges {
+		u.Fragment = rangesFragment
+	}
+	return u
+}
+
+func (h *HTTPMount) Deserialize(u *url.URL) error {
+	if u.Host == "" || u.Host == "irrecoverable" {
+		return fmt.Errorf("invalid host")
+	}
+	cpy := *u
+	h.Ranges = cpy.Fragment == rangesFragment
+	cpy.Fragment = ""
+	h.URL = cpy.String()
+	return nil
+}
+
+func (h *HTTPMount) Close() error {
+	return nil
+}
+
+func (h *HTTPMount) client() *http.Client {
+	if h.Client == nil {
+		return http.DefaultClient
+	}
+	return h.Client
+}
+
+func (h *HTTPMount) head(ctx context.Context) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, h.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", h.URL, err)
+	}
+	return resp, nil
+}
+
+// get issues a GET request, with the specified Range header if non-empty. It
+// returns an error if the response status is not the expected one.
+func (h *HTTPMount) get(ctx context.Context, rng string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	expected := http.StatusOK
+	if rng != "" {
+		req.Header.Set("Range", rng)
+		expected = http.StatusPartialContent
+	}
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", h.URL, err)
+	}
+	if resp.StatusCode != expected {
+		_ = resp.Body.Close()
+		return nil, &statusError{op: "fetch", url: h.URL, code: resp.StatusCode, status: resp.Status}
+	}
+	return resp, nil
+}
+
+// Retryable considers server errors, rate limiting, network timeouts and
+// connection failures transient, and any other error permanent.
+func (h *HTTPMount) Retryable(err error) bool {
+	var serr *statusError
+	if errors.As(err, &serr) {
+		return serr.code >= http.StatusInternalServerError || serr.code == http.StatusTooManyRequests
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	var operr *net.OpError
+	if errors.As(err, &operr) {
+		return true
+	}
+	// the connection was closed midway through a response.
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Produced recognises unexpected statuses, failures of the HTTP client and
+// network errors.
+func (h *HTTPMount) Produced(err error) bool {
+	var serr *statusError
+	var uerr *url.Error
+	var operr *net.OpError
+	return errors.As(err, &serr) || errors.As(err, &uerr) || errors.As(err, &operr)
+}
+
+// statusError is returned when the server responds with an unexpected status.
+type statusError struct {
+	op     string
+	url    string
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("failed to %s %s: unexpected status: %s", e.op, e.url, e.status)
+}
+
+// detachedContext carries the values of its parent, but not its deadline and
+// cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// httpReader is the Reader returned by HTTPMount. When the server supports
+// range requests, sequential reads stream the body from the current offset,
+// seeks reset the stream, and random reads issue a range request each.
+type httpReader struct {
+	mnt    *HTTPMount
+	ctx    context.Context
+	cancel context.CancelFunc // may be nil.
+	size   int64              // size of the resource; -1 if unknown.
+
+	lk     sync.Mutex
+	body   io.ReadCloser // current sequential stream; may be nil.
+	offset int64
+}
+
+var _ Reader = (*httpReader)(nil)
+
+func (r *httpReader) Read(p []byte) (int, error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if r.body == nil {
+		// a range request at or past the end would be answered with a 416.
+		if r.size >= 0 && r.offset >= r.size {
+			return 0, io.EOF
+		}
+		resp, err := r.mnt.get(r.ctx, fmt.Sprintf("bytes=%d-", r.offset))
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *httpReader) ReadAt(p []byte, off int64) (int, error) {
+	if !r.mnt.Ranges {
+		return 0, ErrRandomAccessUnsupported
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// don't request bytes past the end, which would be answered with a 416.
+	want := p
+	if r.size >= 0 {
+		if off >= r.size {
+			return 0, io.EOF
+		}
+		if rem := r.size - off; rem < int64(len(want)) {
+			want = want[:rem]
+		}
+	}
+
+	resp, err := r.mnt.get(r.ctx, fmt.Sprintf("bytes=%d-%d", off, off+int64(len(want))-1))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.ReadFull(resp.Body, want)
+	if err == io.ErrUnexpectedEOF || (err == nil && n < len(p)) {
+		// we've reached the end of the resource.
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *httpReader) Seek(offset int64, whence int) (int64, error) {
+	if !r.mnt.Ranges {
+		return 0, ErrSeekUnsupported
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		if r.size < 0 {
+			size, err := r.mnt.size(r.ctx)
+			if err != nil {
+				return 0, err
+			}
+			r.size = size
+		}
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+
+	// reset the stream if we've moved.
+	if offset != r.offset && r.body != nil {
+		_ = r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *httpReader) Close() error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,311 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/dagstore/testdata"
+	"github.com/filecoin-project/dagstore/throttle"
+	"github.com/stretchr/testify/require"
+)
+
+// newHTTPServer starts a server serving testdata.CarV2 at /file.car. If ranges
+// is true, the server honours range requests; otherwise, it always serves the
+// full body.
+func newHTTPServer(t *testing.T, ranges bool) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.car", func(w http.ResponseWriter, r *http.Request) {
+		if ranges {
+			http.ServeContent(w, r, "file.car", time.Time{}, bytes.NewReader(testdata.CarV2))
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(testdata.CarV2)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		_, _ = w.Write(testdata.CarV2)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHTTPMount(t *testing.T) {
+	ctx := context.Background()
+	srv := newHTTPServer(t, true)
+
+	mnt, err := NewHTTPMount(ctx, srv.Client(), srv.URL+"/file.car")
+	require.NoError(t, err)
+	require.True(t, mnt.Ranges)
+
+	info := mnt.Info()
+	require.True(t, info.AccessSequential && info.AccessSeek && info.AccessRandom) // all flags true
+	require.Equal(t, KindRemote, info.Kind)
+
+	stat, err := mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.True(t, stat.Exists)
+	require.True(t, stat.Ready)
+	require.EqualValues(t, len(testdata.CarV2), stat.Size)
+
+	reader, err := mnt.Fetch(ctx)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	// sequential access.
+	bz, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2, bz)
+
+	// seek to the beginning and read the first bytes.
+	n, err := reader.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	b := make([]byte, 16)
+	_, err = io.ReadFull(reader, b)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2[:16], b)
+
+	// seek relative to the end.
+	n, err = reader.Seek(-16, io.SeekEnd)
+	require.NoError(t, err)
+	require.EqualValues(t, len(testdata.CarV2)-16, n)
+	_, err = io.ReadFull(reader, b)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2[len(testdata.CarV2)-16:], b)
+
+	// random access.
+	i, err := reader.ReadAt(b, 100)
+	require.NoError(t, err)
+	require.EqualValues(t, 16, i)
+	require.Equal(t, testdata.CarV2[100:116], b)
+
+	// random access past the end.
+	i, err = reader.ReadAt(b, int64(len(testdata.CarV2)-4))
+	require.ErrorIs(t, err, io.EOF)
+	require.EqualValues(t, 4, i)
+	require.Equal(t, testdata.CarV2[len(testdata.CarV2)-4:], b[:i])
+
+	// random access at the end.
+	i, err = reader.ReadAt(b, int64(len(testdata.CarV2)))
+	require.ErrorIs(t, err, io.EOF)
+	require.Zero(t, i)
+
+	// sequential access at the end.
+	_, err = reader.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	i, err = reader.Read(b)
+	require.ErrorIs(t, err, io.EOF)
+	require.Zero(t, i)
+
+	// fetch from an offset.
+	reader2, err := mnt.FetchFrom(ctx, 100)
+	require.NoError(t, err)
+	defer reader2.Close()
+	bz, err = ioutil.ReadAll(reader2)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2[100:], bz)
+}
+
+func TestHTTPMountFetchContext(t *testing.T) {
+	srv := newHTTPServer(t, true)
+	mnt := &HTTPMount{URL: srv.URL + "/file.car", Client: srv.Client(), Ranges: true}
+
+	// the reader outlives the context of the fetch.
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err := mnt.Fetch(ctx)
+	require.NoError(t, err)
+	cancel()
+
+	b := make([]byte, 16)
+	_, err = reader.ReadAt(b, 100)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2[100:116], b)
+
+	// but not its own closing.
+	require.NoError(t, reader.Close())
+	_, err = reader.ReadAt(b, 100)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestHTTPMountNoContentLength(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Accept-Ranges", "bytes")
+			return
+		}
+		http.ServeContent(w, r, "file.car", time.Time{}, bytes.NewReader(testdata.CarV2))
+	}))
+	t.Cleanup(srv.Close)
+
+	// the size is probed with a range request.
+	mnt := &HTTPMount{URL: srv.URL, Client: srv.Client(), Ranges: true}
+	stat, err := mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, len(testdata.CarV2), stat.Size)
+
+	// without range support, the size can't be determined.
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(testdata.CarV2)
+		}
+	})
+	_, err = mnt.Stat(ctx)
+	require.Error(t, err)
+}
+
+func TestHTTPMountNoRanges(t *testing.T) {
+	ctx := context.Background()
+	srv := newHTTPServer(t, false)
+
+	mnt, err := NewHTTPMount(ctx, srv.Client(), srv.URL+"/file.car")
+	require.NoError(t, err)
+	require.False(t, mnt.Ranges)
+
+	info := mnt.Info()
+	require.True(t, info.AccessSequential)
+	require.False(t, info.AccessSeek || info.AccessRandom)
+
+	reader, err := mnt.Fetch(ctx)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	_, err = reader.ReadAt(make([]byte, 16), 0)
+	require.ErrorIs(t, err, ErrRandomAccessUnsupported)
+	_, err = reader.Seek(0, io.SeekStart)
+	require.ErrorIs(t, err, ErrSeekUnsupported)
+
+	bz, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2, bz)
+
+	// fetching from an offset requires range support.
+	_, err = mnt.FetchFrom(ctx, 100)
+	require.Error(t, err)
+}
+
+func TestHTTPMountStatNotFound(t *testing.T) {
+	srv := newHTTPServer(t, true)
+
+	mnt := &HTTPMount{URL: srv.URL + "/missing.car", Client: srv.Client()}
+	stat, err := mnt.Stat(context.Background())
+	require.NoError(t, err)
+	require.False(t, stat.Exists)
+
+	_, err = mnt.Fetch(context.Background())
+	require.Error(t, err)
+}
+
+func TestHTTPMountRetryable(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+
+	mnt := &HTTPMount{URL: srv.URL + "/file.car", Client: srv.Client()}
+	_, err := mnt.Fetch(context.Background())
+	require.Error(t, err)
+	require.True(t, mnt.Retryable(err))
+
+	status = http.StatusForbidden
+	_, err = mnt.Fetch(context.Background())
+	require.Error(t, err)
+	require.False(t, mnt.Retryable(err))
+
+	status = http.StatusTooManyRequests
+	_, err = mnt.Fetch(context.Background())
+	require.Error(t, err)
+	require.True(t, mnt.Retryable(err))
+
+	// unknown errors are permanent.
+	require.False(t, mnt.Retryable(errors.New("unknown")))
+
+	// the mount only claims its own errors.
+	require.True(t, mnt.Produced(err))
+	_, err = os.Open(t.TempDir() + "/missing")
+	require.False(t, mnt.Produced(err))
+	require.False(t, mnt.Produced(&TransientIntegrityError{Path: "foo", Reason: "size mismatch"}))
+
+	// failures to reach the server are transient.
+	srv.Close()
+	_, err = mnt.Fetch(context.Background())
+	require.Error(t, err)
+	require.True(t, mnt.Retryable(err))
+}
+
+func TestHTTPMountRegistry(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register("http", &HTTPMount{}))
+	require.NoError(t, r.RegisterAlias("https", "http"))
+
+	// aliases can't clash with existing schemes, nor point to unknown ones.
+	require.Error(t, r.RegisterAlias("https", "http"))
+	require.ErrorIs(t, r.RegisterAlias("ftp", "gopher"), ErrUnrecognizedScheme)
+
+	for _, u := range []string{"http://example.com/file.car", "https://example.com/a/file.car?x=y"} {
+		for _, ranges := range []bool{true, false} {
+			mnt := &HTTPMount{URL: u, Ranges: ranges}
+			rep, err := r.Represent(mnt)
+			require.NoError(t, err)
+
+			// the scheme is preserved.
+			require.Equal(t, mnt.Serialize().Scheme, rep.Scheme)
+
+			inst, err := r.Instantiate(rep)
+			require.NoError(t, err)
+			require.Equal(t, mnt.URL, inst.(*HTTPMount).URL)
+			require.Equal(t, ranges, inst.(*HTTPMount).Ranges)
+		}
+	}
+}
+
+func TestHTTPMountUpgrader(t *testing.T) {
+	ctx := context.Background()
+
+	// with range support, the upgrader passes through to the mount.
+	srv := newHTTPServer(t, true)
+	mnt, err := NewHTTPMount(ctx, srv.Client(), srv.URL+"/file.car")
+	require.NoError(t, err)
+
+	rootDir := t.TempDir()
+	u, err := Upgrade(mnt, throttle.Noop(), rootDir, "passthrough", "")
+	require.NoError(t, err)
+	reader, err := u.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, testdata.CarV2, bz)
+
+	fs, err := ioutil.ReadDir(rootDir)
+	require.NoError(t, err)
+	require.Empty(t, fs)
+
+	// without range support, the upgrader downloads a transient.
+	srv = newHTTPServer(t, false)
+	mnt, err = NewHTTPMount(ctx, srv.Client(), srv.URL+"/file.car")
+	require.NoError(t, err)
+
+	u, err = Upgrade(mnt, throttle.Noop(), rootDir, "transient", "")
+	require.NoError(t, err)
+	reader, err = u.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err = ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, testdata.CarV2, bz)
+
+	_, err = os.Stat(u.TransientPath())
+	require.NoError(t, err)
+}
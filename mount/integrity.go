@@ -0,0 +1,100 @@
+package mount
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TransientInfo describes a complete transient, so that its integrity can be
+// verified when it is reused.
+type TransientInfo struct {
+	// Size is the size of the transient, as reported by the underlying mount.
+	Size int64
+	// Digest is the SHA-256 digest of the transient, if digests are enabled.
+	Digest []byte
+}
+
+// TransientIntegrityError is returned when a transient fails integrity
+// verification, i.e. its size or digest don't match the expected values.
+type TransientIntegrityError struct {
+	// Path is the path of the offending transient.
+	Path string
+	// Reason describes the mismatch.
+	Reason string
+}
+
+func (e *TransientIntegrityError) Error() string {
+	return fmt.Sprintf("transient %s failed integrity verification: %s", e.Path, e.Reason)
+}
+
+// fileDigest computes the SHA-256 digest of a file.
+func fileDigest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("failed to digest %s: %w", path, err)
+	}
+	return h.Sum(nil), nil
+}
+
+// owns returns whether the path is inside our transients root directory.
+func (u *Upgrader) owns(path string) bool {
+	rel, err := filepath.Rel(u.rootdir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// verifyTransient verifies the integrity of the ready transient against its
+// recorded integrity information. Transients without integrity information
+// (e.g. supplied by the user without expectations) are trusted, and their
+// information is recorded from now on. Digests are only verified once, as
+// they're expensive to compute. It must be called with the lock held.
+func (u *Upgrader) verifyTransient() error {
+	fi, err := os.Stat(u.path)
+	if err != nil {
+		return err
+	}
+
+	if u.info == nil {
+		info := &TransientInfo{Size: fi.Size()}
+		if u.digests {
+			if info.Digest, err = fileDigest(u.path); err != nil {
+				return err
+			}
+		}
+		u.info = info
+		u.verified = true
+		return nil
+	}
+
+	if fi.Size() != u.info.Size {
+		return &TransientIntegrityError{
+			Path:   u.path,
+			Reason: fmt.Sprintf("size mismatch; expected: %d, actual: %d", u.info.Size, fi.Size()),
+		}
+	}
+
+	if !u.verified && u.info.Digest != nil {
+		digest, err := fileDigest(u.path)
+		if err != nil {
+			return err
+		}
+		if string(digest) != string(u.info.Digest) {
+			return &TransientIntegrityError{
+				Path:   u.path,
+				Reason: fmt.Sprintf("digest mismatch; expected: %x, actual: %x", u.info.Digest, digest),
+			}
+		}
+	}
+
+	u.verified = true
+	return nil
+}
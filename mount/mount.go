@@ -94,6 +94,35 @@ type Reader interface {
 	io.Seeker
 }
 
+// RangeFetcher is an optional interface that mounts can implement if they're
+// able to fetch their contents starting at an offset, even if the Readers they
+// return don't support seeking. The Upgrader uses it to resume interrupted
+// transient downloads.
+type RangeFetcher interface {
+	// FetchFrom returns a Reader positioned at the specified offset.
+	FetchFrom(ctx context.Context, offset int64) (Reader, error)
+}
+
+// Retryable is an optional interface that mounts can implement to classify
+// the errors returned by their methods, and by the Readers they return, as
+// transient or permanent. The DAG store retries failed fetches and
+// initializations according to its retry policy only if the error is
+// transient.
+type Retryable interface {
+	// Retryable returns whether the operation that failed with the error
+	// may succeed if retried.
+	Retryable(err error) bool
+}
+
+// ErrorSource is an optional interface that Retryable mounts can implement to
+// report which errors they produced. The DAG store only lets such mounts
+// classify their own errors; any other error, e.g. a failure of the Upgrader
+// or of the local filesystem, is classified by the DAG store's retry policy.
+type ErrorSource interface {
+	// Produced returns whether the error originates from the mount.
+	Produced(err error) bool
+}
+
 // Info describes a mount.
 type Info struct {
 	// Kind indicates the kind of mount.
@@ -53,6 +53,29 @@ func (r *Registry) Register(scheme string, template Mount) error {
 	return nil
 }
 
+// RegisterAlias registers an additional scheme for the mount type registered
+// under the specified scheme. This is useful for mounts that can represent
+// themselves under several schemes, such as http and https.
+//
+// Represent will preserve the scheme returned by the mount's Serialize method
+// if it's the original scheme or one of its aliases.
+func (r *Registry) RegisterAlias(alias string, scheme string) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if _, ok := r.byScheme[alias]; ok {
+		return fmt.Errorf("mount already registered for scheme: %s", alias)
+	}
+
+	template, ok := r.byScheme[scheme]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnrecognizedScheme, scheme)
+	}
+
+	r.byScheme[alias] = template
+	return nil
+}
+
 // Instantiate instantiates a new Mount from a URL.
 //
 // It looks up the Mount template in the registry based on the URL scheme,
@@ -94,7 +117,9 @@ func (r *Registry) Represent(mount Mount) (*url.URL, error) {
 	}
 
 	u := mount.Serialize()
-	u.Scheme = scheme
+	if template, ok := r.byScheme[u.Scheme]; !ok || reflect.TypeOf(template) != reflect.TypeOf(mount) {
+		u.Scheme = scheme
+	}
 	return u, nil
 }
 
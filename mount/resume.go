@@ -0,0 +1,175 @@
+package mount
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// checkpointInterval is the number of bytes after which the progress of a
+// transient download is checkpointed.
+const checkpointInterval = 16 << 20 // 16MiB
+
+var errResumeUnsupported = errors.New("underlying mount doesn't support resuming fetches")
+
+// transientProgress records how much of a partial transient has been durably
+// written. It is persisted next to the partial transient, so that interrupted
+// downloads can be resumed, even across restarts.
+type transientProgress struct {
+	// Offset is the offset up to which the partial transient has been synced.
+	Offset int64 `json:"o"`
+	// Size is the size of the underlying mount when the download started.
+	Size int64 `json:"s"`
+}
+
+// canResume returns whether the underlying mount supports resuming fetches,
+// either by implementing RangeFetcher or by supporting seeking.
+func (u *Upgrader) canResume() bool {
+	if _, ok := u.underlying.(RangeFetcher); ok {
+		return true
+	}
+	return u.underlying.Info().AccessSeek
+}
+
+// fetchFrom fetches the underlying mount from the specified offset.
+func (u *Upgrader) fetchFrom(ctx context.Context, offset int64) (Reader, error) {
+	if offset == 0 {
+		return u.underlying.Fetch(ctx)
+	}
+
+	if rf, ok := u.underlying.(RangeFetcher); ok {
+		return rf.FetchFrom(ctx, offset)
+	}
+
+	if !u.underlying.Info().AccessSeek {
+		return nil, errResumeUnsupported
+	}
+	r, err := u.underlying.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		_ = r.Close()
+		return nil, fmt.Errorf("failed to seek underlying mount to offset %d: %w", offset, err)
+	}
+	return r, nil
+}
+
+// openPartial opens the partial transient, positioned at the offset the
+// download should continue from. If there's a resumable partial transient for
+// an underlying mount of the specified size, it is reused, discarding any
+// data written after the last checkpoint. Otherwise, a new empty partial
+// transient is created.
+func (u *Upgrader) openPartial(size int64) (*os.File, int64, error) {
+	if p, ok := u.loadProgress(); ok && p.Size == size && u.canResume() {
+		if fi, err := os.Stat(u.pathPartial); err == nil && fi.Size() >= p.Offset {
+			f, err := os.OpenFile(u.pathPartial, os.O_RDWR, 0)
+			if err == nil {
+				if err = f.Truncate(p.Offset); err == nil {
+					_, err = f.Seek(p.Offset, io.SeekStart)
+				}
+				if err == nil {
+					log.Debugw("resuming partial transient", "shard", u.key, "path", u.pathPartial, "offset", p.Offset)
+					return f, p.Offset, nil
+				}
+				_ = f.Close()
+			}
+			log.Warnw("failed to reopen partial transient; fetching from scratch", "shard", u.key, "path", u.pathPartial, "error", err)
+		}
+	}
+
+	// os.Create truncates existing files.
+	f, err := os.Create(u.pathPartial)
+	if err != nil {
+		return nil, 0, err
+	}
+	u.removeProgress()
+	return f, 0, nil
+}
+
+// copyResumable copies the underlying mount into the partial transient,
+// which is positioned at the specified offset, checkpointing progress
+// periodically and when the copy is interrupted.
+func (u *Upgrader) copyResumable(ctx context.Context, into *os.File, from io.Reader, offset, size int64) error {
+	buf := make([]byte, 1<<20)
+	checkpointed := offset
+	for {
+		if err := ctx.Err(); err != nil {
+			u.checkpoint(into, offset, size)
+			return err
+		}
+
+		n, rerr := from.Read(buf)
+		if n > 0 {
+			if _, err := into.Write(buf[:n]); err != nil {
+				// we can't trust what was written since the last checkpoint.
+				return err
+			}
+			offset += int64(n)
+		}
+
+		switch {
+		case rerr == io.EOF:
+			return nil
+		case rerr != nil:
+			u.checkpoint(into, offset, size)
+			return rerr
+		case offset-checkpointed >= checkpointInterval:
+			u.checkpoint(into, offset, size)
+			checkpointed = offset
+		}
+	}
+}
+
+// checkpoint syncs the partial transient and records the download progress.
+// It's a no-op if the underlying mount doesn't support resuming. Errors are
+// logged, as failing to checkpoint only means that a later download will
+// resume from an earlier offset.
+func (u *Upgrader) checkpoint(f *os.File, offset, size int64) {
+	if !u.canResume() {
+		return
+	}
+	if err := f.Sync(); err != nil {
+		log.Warnw("failed to sync partial transient", "shard", u.key, "path", u.pathPartial, "error", err)
+		return
+	}
+
+	b, err := json.Marshal(&transientProgress{Offset: offset, Size: size})
+	if err != nil {
+		log.Warnw("failed to serialize transient progress", "shard", u.key, "error", err)
+		return
+	}
+	tmp := tmpPath(u.pathProgress)
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		log.Warnw("failed to write transient progress", "shard", u.key, "path", tmp, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, u.pathProgress); err != nil {
+		log.Warnw("failed to replace transient progress", "shard", u.key, "path", u.pathProgress, "error", err)
+	}
+}
+
+// loadProgress loads the progress record of the partial transient, if any.
+func (u *Upgrader) loadProgress() (transientProgress, bool) {
+	var p transientProgress
+	b, err := ioutil.ReadFile(u.pathProgress)
+	if err != nil {
+		return p, false
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		log.Warnw("failed to parse transient progress; ignoring", "shard", u.key, "path", u.pathProgress, "error", err)
+		return p, false
+	}
+	return p, true
+}
+
+// removeProgress removes the progress record of the partial transient.
+func (u *Upgrader) removeProgress() {
+	if err := os.Remove(u.pathProgress); err != nil && !os.IsNotExist(err) {
+		log.Warnw("failed to remove transient progress", "shard", u.key, "path", u.pathProgress, "error", err)
+	}
+}
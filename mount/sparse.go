@@ -0,0 +1,387 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// defaultSparseChunkSize is the default granularity at which sparse
+// transients are fetched and tracked.
+const defaultSparseChunkSize = 1 << 20 // 1MiB
+
+// sparsePersistInterval is the number of chunks that can be fetched before
+// the bitmap is persisted. Chunks fetched since the last persist are refetched
+// after a crash.
+const sparsePersistInterval = 64
+
+// sparseCache tracks which chunks of a sparse transient file have been fetched
+// from the underlying mount. The transient file has the full size of the
+// underlying mount, but only the chunks that have been read are populated.
+//
+// The set of populated chunks is tracked in a bitmap that is persisted in a
+// sidecar file, so that the cache survives restarts. To avoid syncing and
+// rewriting the sidecar on every fetch, the bitmap is persisted every
+// sparsePersistInterval chunks, when the transient becomes complete, and when
+// readers are closed. The transient file is synced before the bitmap is
+// persisted, so the persisted bitmap never covers chunks that weren't
+// written.
+type sparseCache struct {
+	path       string // path of the sparse transient file.
+	bitmapPath string // path of the sidecar bitmap.
+	chunkSize  int64
+
+	lk     sync.Mutex
+	size   int64  // guarded by lk; size of the underlying mount.
+	bitmap []byte // guarded by lk; nil if the cache is not initialized.
+	dirty  int    // guarded by lk; chunks marked since the last persist.
+}
+
+func newSparseCache(path string, chunkSize int64) *sparseCache {
+	return &sparseCache{
+		path:       path,
+		bitmapPath: path + ".bitmap",
+		chunkSize:  chunkSize,
+	}
+}
+
+// initialized returns whether the cache has been initialized, either by
+// loading an existing bitmap or by creating a new sparse file.
+func (c *sparseCache) initialized() bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return c.bitmap != nil
+}
+
+// init creates an empty sparse transient of the specified size, and an empty
+// bitmap.
+func (c *sparseCache) init(size int64) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	f, err := os.Create(c.path)
+	if err != nil {
+		return fmt.Errorf("failed to create sparse transient: %w", err)
+	}
+	defer f.Close()
+
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("failed to size sparse transient: %w", err)
+	}
+
+	chunks := (size + c.chunkSize - 1) / c.chunkSize
+	c.size = size
+	c.bitmap = make([]byte, (chunks+7)/8)
+	return c.persist()
+}
+
+// load loads the bitmap from its sidecar file.
+func (c *sparseCache) load() error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if _, err := os.Stat(c.path); err != nil {
+		return fmt.Errorf("failed to stat sparse transient: %w", err)
+	}
+
+	b, err := ioutil.ReadFile(c.bitmapPath)
+	if err != nil {
+		return fmt.Errorf("failed to read sparse transient bitmap: %w", err)
+	}
+
+	r := bytes.NewReader(b)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("failed to read sparse transient size: %w", err)
+	}
+	chunkSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("failed to read sparse transient chunk size: %w", err)
+	}
+	if int64(chunkSize) != c.chunkSize {
+		return fmt.Errorf("sparse transient chunk size mismatch; expected: %d, actual: %d", c.chunkSize, chunkSize)
+	}
+
+	bitmap := b[len(b)-r.Len():]
+	chunks := (int64(size) + c.chunkSize - 1) / c.chunkSize
+	if int64(len(bitmap)) != (chunks+7)/8 {
+		return fmt.Errorf("malformed sparse transient bitmap")
+	}
+
+	c.size = int64(size)
+	c.bitmap = append([]byte{}, bitmap...)
+	return nil
+}
+
+// persist syncs the sparse transient, and then writes the bitmap to its
+// sidecar file, replacing it atomically. It must be called with the lock held.
+func (c *sparseCache) persist() error {
+	f, err := os.OpenFile(c.path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open sparse transient: %w", err)
+	}
+	err = f.Sync()
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to sync sparse transient: %w", err)
+	}
+
+	buf := make([]byte, 2*binary.MaxVarintLen64+len(c.bitmap))
+	n := binary.PutUvarint(buf, uint64(c.size))
+	n += binary.PutUvarint(buf[n:], uint64(c.chunkSize))
+	n += copy(buf[n:], c.bitmap)
+
+	tmp := tmpPath(c.bitmapPath)
+	if err := ioutil.WriteFile(tmp, buf[:n], 0644); err != nil {
+		return fmt.Errorf("failed to write sparse transient bitmap: %w", err)
+	}
+	if err := os.Rename(tmp, c.bitmapPath); err != nil {
+		return fmt.Errorf("failed to replace sparse transient bitmap: %w", err)
+	}
+	c.dirty = 0
+	return nil
+}
+
+// flush persists the bitmap if chunks were marked since the last persist.
+func (c *sparseCache) flush() error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if c.bitmap == nil || c.dirty == 0 {
+		return nil
+	}
+	return c.persist()
+}
+
+// reset forgets the cache contents, and removes the sidecar bitmap. The
+// sparse transient file itself is left for the caller to remove.
+func (c *sparseCache) reset() error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.size = 0
+	c.bitmap = nil
+	c.dirty = 0
+	if err := os.Remove(c.bitmapPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// complete returns whether all chunks have been fetched.
+func (c *sparseCache) complete() bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return c.bitmap != nil && len(c.missing(0, c.size)) == 0
+}
+
+// populated returns the number of bytes covered by the fetched chunks.
+func (c *sparseCache) populated() int64 {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if c.bitmap == nil {
+		return 0
+	}
+	var n int64
+	for i := int64(0); i*c.chunkSize < c.size; i++ {
+		if c.bitmap[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		if end := (i + 1) * c.chunkSize; end > c.size {
+			n += c.size - i*c.chunkSize
+		} else {
+			n += c.chunkSize
+		}
+	}
+	return n
+}
+
+// missing returns the runs of chunks in [from, to) that haven't been fetched
+// yet, as a list of [start, end) byte ranges. It must be called with the lock
+// held.
+func (c *sparseCache) missing(from, to int64) (ret [][2]int64) {
+	for i := from / c.chunkSize; i*c.chunkSize < to; i++ {
+		if c.bitmap[i/8]&(1<<(i%8)) != 0 {
+			continue
+		}
+		start, end := i*c.chunkSize, (i+1)*c.chunkSize
+		if end > c.size {
+			end = c.size
+		}
+		if l := len(ret); l > 0 && ret[l-1][1] == start {
+			ret[l-1][1] = end // extend the previous run.
+		} else {
+			ret = append(ret, [2]int64{start, end})
+		}
+	}
+	return ret
+}
+
+// mark records the chunks in [from, to) as fetched, and persists the bitmap
+// if enough chunks were marked since the last persist, or if all chunks have
+// been fetched. Both ends must be aligned to chunk boundaries, except for the
+// end of the file.
+func (c *sparseCache) mark(from, to int64) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if c.bitmap == nil {
+		return fmt.Errorf("sparse transient was deleted")
+	}
+	for i := from / c.chunkSize; i*c.chunkSize < to; i++ {
+		if c.bitmap[i/8]&(1<<(i%8)) == 0 {
+			c.bitmap[i/8] |= 1 << (i % 8)
+			c.dirty++
+		}
+	}
+	if c.dirty >= sparsePersistInterval || len(c.missing(0, c.size)) == 0 {
+		return c.persist()
+	}
+	return nil
+}
+
+// sparseReader is the Reader returned by the Upgrader for sparse transients.
+// Reads are served from the sparse transient, filling any holes from the
+// underlying mount beforehand.
+type sparseReader struct {
+	u     *Upgrader
+	cache *sparseCache
+	size  int64
+	file  *os.File
+	from  Reader // reader of the underlying mount.
+
+	// ctx carries the values of the context the reader was fetched with, and
+	// is cancelled when the reader is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lk     sync.Mutex
+	offset int64 // guarded by lk.
+}
+
+var _ Reader = (*sparseReader)(nil)
+
+func (r *sparseReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	end := off + int64(len(p))
+	if end > r.size {
+		end = r.size
+	}
+	if err := r.fill(off, end); err != nil {
+		return 0, err
+	}
+
+	n, err := r.file.ReadAt(p[:end-off], off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// fill fetches the chunks covering [from, to) that are missing from the
+// sparse transient.
+func (r *sparseReader) fill(from, to int64) error {
+	r.cache.lk.Lock()
+	if r.cache.bitmap == nil {
+		r.cache.lk.Unlock()
+		return fmt.Errorf("sparse transient was deleted")
+	}
+	runs := r.cache.missing(from, to)
+	r.cache.lk.Unlock()
+
+	if len(runs) == 0 {
+		return nil
+	}
+
+	// concurrent readers may fetch the same chunk simultaneously; this is
+	// harmless, as they write the same data.
+	for _, run := range runs {
+		fetch := func(ctx context.Context) error {
+			buf := make([]byte, run[1]-run[0])
+			n, err := r.from.ReadAt(buf, run[0])
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("failed to read range [%d, %d) from underlying mount: %w", run[0], run[1], err)
+			}
+			if r.u.bandwidth != nil {
+				if err := r.u.bandwidth.WaitN(ctx, int64(n)); err != nil {
+					return err
+				}
+			}
+			if _, err := r.file.WriteAt(buf, run[0]); err != nil {
+				return fmt.Errorf("failed to write range [%d, %d) to sparse transient: %w", run[0], run[1], err)
+			}
+			return nil
+		}
+		err := r.u.throttler.Do(r.ctx, func(ctx context.Context) error {
+			return r.u.weights.Do(ctx, run[1]-run[0], fetch)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, run := range runs {
+		if err := r.cache.mark(run[0], run[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sparseReader) Read(p []byte) (int, error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil // the next read will return io.EOF.
+	}
+	return n, err
+}
+
+func (r *sparseReader) Seek(offset int64, whence int) (int64, error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *sparseReader) Close() error {
+	r.cancel()
+	err := r.cache.flush()
+	if err2 := r.file.Close(); err == nil {
+		err = err2
+	}
+	if err2 := r.from.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
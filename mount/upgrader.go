@@ -2,6 +2,7 @@ package mount
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
@@ -26,19 +27,36 @@ type Upgrader struct {
 	rootdir     string
 	underlying  Mount
 	throttler   throttle.Throttler
+	weights     throttle.WeightedThrottler
+	bandwidth   *throttle.TokenBucket // nil if unlimited.
 	key         string
 	passthrough bool
 
 	// paths: pathComplete is the path of transients that are
 	// completely downloaded; pathPartial is the path where in-progress
 	// downloads are placed. Once fully downloaded, the file is renamed to
-	// pathComplete.
+	// pathComplete. pathProgress records the progress of the download into
+	// pathPartial, so that it can be resumed if interrupted.
 	pathComplete string
 	pathPartial  string
+	pathProgress string
+	pathSparse   string
+
+	// sparse is the cache backing sparse transients; nil if sparse
+	// transients are disabled for this mount.
+	sparse *sparseCache
+
+	// digests enables computing the digest of complete transients.
+	digests bool
 
 	lk    sync.Mutex
 	path  string // guarded by lk
 	ready bool   // guarded by lk
+	// info is the integrity information of the ready transient; nil if
+	// unknown. verified indicates whether the transient's digest has been
+	// verified against info.
+	info     *TransientInfo // guarded by lk
+	verified bool           // guarded by lk
 	// once guards deduplicates concurrent refetch requests; the caller that
 	// gets to run stores the result in onceErr, for other concurrent callers to
 	// consume it.
@@ -50,36 +68,113 @@ type Upgrader struct {
 
 var _ Mount = (*Upgrader)(nil)
 
+// UpgradeOpts are options for upgrading a mount.
+type UpgradeOpts struct {
+	// Sparse enables sparse transients for remote mounts that support random
+	// access. Instead of passing through to the underlying mount, or
+	// downloading it in full before serving it, the Upgrader fetches only the
+	// chunks that are actually read into a sparse transient file, and tracks
+	// which chunks are present in a sidecar bitmap.
+	//
+	// Note that reading the mount sequentially, as the DAG store does to index
+	// a shard when it's initialized, fetches every chunk. Sparse transients
+	// pay off when shards are accessed after their transient was evicted.
+	Sparse bool
+
+	// SparseChunkSize is the granularity at which sparse transients are
+	// fetched and tracked. Defaults to 1MiB.
+	SparseChunkSize int64
+
+	// Digest enables computing the SHA-256 digest of transients once they
+	// are complete. The digest is verified the first time a transient is
+	// reused, e.g. after a restart.
+	Digest bool
+
+	// InitialInfo is the expected integrity information of the initial
+	// transient, e.g. as previously returned by TransientInfo. If nil, the
+	// initial transient is trusted.
+	InitialInfo *TransientInfo
+
+	// FetchWeights, if set, additionally throttles fetches of ready mounts by
+	// their size, as reported by Stat, and sparse chunk fetches by the size
+	// of the chunks.
+	FetchWeights throttle.WeightedThrottler
+
+	// Bandwidth, if set, caps the throughput of fetches from the underlying
+	// mount. It's usually shared by all Upgraders to cap their aggregate
+	// throughput.
+	Bandwidth *throttle.TokenBucket
+}
+
 // Upgrade constructs a new Upgrader for the underlying Mount. If provided, it
 // will reuse the file in path `initial` as the initial transient copy. Whenever
 // a new transient copy has to be created, it will be created under `rootdir`.
 func Upgrade(underlying Mount, throttler throttle.Throttler, rootdir, key string, initial string) (*Upgrader, error) {
+	return UpgradeWithOpts(underlying, throttler, rootdir, key, initial, UpgradeOpts{})
+}
+
+// UpgradeWithOpts is like Upgrade, but accepts options.
+func UpgradeWithOpts(underlying Mount, throttler throttle.Throttler, rootdir, key string, initial string, opts UpgradeOpts) (*Upgrader, error) {
 	ret := &Upgrader{
 		underlying:   underlying,
 		key:          key,
 		rootdir:      rootdir,
 		once:         new(sync.Once),
 		throttler:    throttler,
+		weights:      opts.FetchWeights,
+		bandwidth:    opts.Bandwidth,
+		digests:      opts.Digest,
 		pathComplete: filepath.Join(rootdir, "transient-"+key+".complete"),
 		pathPartial:  filepath.Join(rootdir, "transient-"+key+".partial"),
+		pathProgress: filepath.Join(rootdir, "transient-"+key+".partial.progress"),
+		pathSparse:   filepath.Join(rootdir, "transient-"+key+".sparse"),
 	}
 	if ret.rootdir == "" {
 		ret.rootdir = os.TempDir() // use the OS' default temp dir.
 	}
+	if ret.weights == nil {
+		ret.weights = throttle.NoopWeighted()
+	}
 
 	switch info := underlying.Info(); {
 	case !info.AccessSequential:
 		return nil, fmt.Errorf("underlying mount must support sequential access")
+	case opts.Sparse && info.Kind == KindRemote && info.AccessRandom:
+		chunkSize := opts.SparseChunkSize
+		if chunkSize <= 0 {
+			chunkSize = defaultSparseChunkSize
+		}
+		ret.sparse = newSparseCache(ret.pathSparse, chunkSize)
 	case info.AccessSeek && info.AccessRandom:
 		ret.passthrough = true
 		return ret, nil
 	}
 
+	// a sparse transient can only be resumed in sparse mode; in any other
+	// case, we disregard it and a new transient will be fetched.
+	if initial != "" && initial == ret.pathSparse {
+		if ret.sparse == nil {
+			log.Warnw("disregarding sparse transient, as sparse transients are disabled", "shard", key, "path", initial)
+			return ret, nil
+		}
+		if err := ret.sparse.load(); err != nil {
+			log.Warnw("failed to load sparse transient; will refetch", "shard", key, "path", initial, "error", err)
+			return ret, nil
+		}
+		log.Debugw("initialized with existing sparse transient", "shard", key, "path", initial)
+		ret.path = initial
+		return ret, nil
+	}
+
 	if initial != "" {
 		if _, err := os.Stat(initial); err == nil {
 			log.Debugw("initialized with existing transient that's alive", "shard", key, "path", initial)
 			ret.path = initial
 			ret.ready = true
+			if opts.InitialInfo != nil {
+				info := *opts.InitialInfo
+				ret.info = &info
+			}
 			return ret, nil
 		}
 	}
@@ -98,19 +193,33 @@ func (u *Upgrader) Fetch(ctx context.Context) (Reader, error) {
 	// after it's done, open the resulting transient.
 	u.lk.Lock()
 	if u.ready {
-		log.Debugw("transient local copy exists; check liveness", "shard", u.key, "path", u.path)
-		if _, err := os.Stat(u.path); err == nil {
+		log.Debugw("transient local copy exists; check liveness and integrity", "shard", u.key, "path", u.path)
+		if err := u.verifyTransient(); err == nil {
 			log.Debugw("transient copy alive; not refetching", "shard", u.key, "path", u.path)
 			defer u.lk.Unlock()
 			return os.Open(u.path)
 		} else {
 			u.ready = false
-			log.Debugw("transient copy dead; removing and refetching", "shard", u.key, "path", u.path, "error", err)
-			if err := os.Remove(u.path); err != nil {
+			u.info = nil
+			u.verified = false
+			var ierr *TransientIntegrityError
+			if errors.As(err, &ierr) {
+				log.Warnw("transient copy corrupted; refetching", "shard", u.key, "path", u.path, "error", err)
+			} else {
+				log.Debugw("transient copy dead; removing and refetching", "shard", u.key, "path", u.path, "error", err)
+			}
+			// never remove transients we don't own, e.g. those supplied by
+			// the user.
+			if !u.owns(u.path) {
+				log.Warnw("refetch: not removing transient that's not owned by us", "shard", u.key, "dead_path", u.path)
+			} else if err := os.Remove(u.path); err != nil && !os.IsNotExist(err) {
 				log.Warnw("refetch: failed to remove transient; garbage left behind", "shard", u.key, "dead_path", u.path, "error", err)
 			}
 		}
-		// TODO add size check.
+	}
+	if u.sparse != nil {
+		u.lk.Unlock()
+		return u.fetchSparse(ctx)
 	}
 	// transient appears to be dead, refetch.
 	// get the current sync under the lock, use it to deduplicate concurrent fetches.
@@ -118,28 +227,33 @@ func (u *Upgrader) Fetch(ctx context.Context) (Reader, error) {
 	u.lk.Unlock()
 
 	once.Do(func() {
-		// Create a new file in the partial location.
-		// os.Create truncates existing files.
-		var partial *os.File
-		partial, u.onceErr = os.Create(u.pathPartial)
-		if u.onceErr != nil {
-			return
-		}
-		defer partial.Close()
-
-		// do the refetch; abort and remove/reset the partial if it fails.
+		// do the refetch; if it fails, keep the partial for a later refetch
+		// to resume from, if the underlying mount supports it, or remove it
+		// otherwise.
 		// perform outside the lock as this is a long-running operation.
 		// u.onceErr is only written by the goroutine that gets to run sync.Once
 		// and it's only read after it finishes.
 
-		u.onceErr = u.refetch(ctx, partial)
+		var info *TransientInfo
+		info, u.onceErr = u.refetch(ctx)
 		if u.onceErr != nil {
 			log.Warnw("failed to refetch", "shard", u.key, "error", u.onceErr)
-			if err := os.Remove(u.pathPartial); err != nil {
-				log.Warnw("failed to remove partial transient", "shard", u.key, "path", u.pathPartial, "error", err)
+			// a corrupted partial can't be resumed.
+			var ierr *TransientIntegrityError
+			if !u.canResume() || errors.As(u.onceErr, &ierr) {
+				if err := os.Remove(u.pathPartial); err != nil {
+					log.Warnw("failed to remove partial transient", "shard", u.key, "path", u.pathPartial, "error", err)
+				}
+				u.removeProgress()
 			}
+			// recycle the sync.Once so that the next fetch retries, resuming
+			// from the partial if we kept it.
+			u.lk.Lock()
+			u.once = new(sync.Once)
+			u.lk.Unlock()
 			return
 		}
+		u.removeProgress()
 
 		// rename the partial file to a non-partial file.
 		// set the new transient path under a lock, and recycle the sync.Once.
@@ -151,6 +265,8 @@ func (u *Upgrader) Fetch(ctx context.Context) (Reader, error) {
 		u.lk.Lock()
 		u.path = u.pathComplete
 		u.ready = true
+		u.info = info
+		u.verified = true
 		u.once = new(sync.Once)
 		u.lk.Unlock()
 
@@ -171,6 +287,60 @@ func (u *Upgrader) Fetch(ctx context.Context) (Reader, error) {
 	return os.Open(u.pathComplete)
 }
 
+// fetchSparse returns a reader over the sparse transient, creating it if
+// necessary. Holes are filled from the underlying mount as they are read.
+func (u *Upgrader) fetchSparse(ctx context.Context) (Reader, error) {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	if u.path != "" && u.sparse.initialized() {
+		if _, err := os.Stat(u.path); err != nil {
+			log.Debugw("sparse transient dead; recreating", "shard", u.key, "path", u.path, "error", err)
+			if err := u.sparse.reset(); err != nil {
+				log.Warnw("failed to remove sparse transient bitmap", "shard", u.key, "error", err)
+			}
+		}
+	}
+
+	if !u.sparse.initialized() {
+		stat, err := u.underlying.Stat(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("underlying mount stat returned error: %w", err)
+		} else if !stat.Exists {
+			return nil, fmt.Errorf("underlying mount no longer exists")
+		}
+		if err := u.sparse.init(stat.Size); err != nil {
+			return nil, err
+		}
+		u.path = u.pathSparse
+		log.Debugw("created sparse transient", "shard", u.key, "path", u.path, "size", stat.Size)
+	}
+
+	if u.sparse.complete() {
+		log.Debugw("sparse transient is complete; not fetching underlying", "shard", u.key, "path", u.path)
+		return os.Open(u.path)
+	}
+
+	from, err := u.underlying.Fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch from underlying mount: %w", err)
+	}
+	f, err := os.OpenFile(u.path, os.O_RDWR, 0)
+	if err != nil {
+		_ = from.Close()
+		return nil, fmt.Errorf("failed to open sparse transient: %w", err)
+	}
+
+	u.sparse.lk.Lock()
+	size := u.sparse.size
+	u.sparse.lk.Unlock()
+
+	// holes are filled as the reader is read from, possibly after the fetch
+	// has returned, so the fills aren't bound to the caller's context.
+	rctx, cancel := context.WithCancel(detachedContext{ctx})
+	return &sparseReader{u: u, cache: u.sparse, size: size, file: f, from: from, ctx: rctx, cancel: cancel}, nil
+}
+
 func (u *Upgrader) Info() Info {
 	return Info{
 		Kind:             KindLocal,
@@ -198,6 +368,75 @@ func (u *Upgrader) TransientPath() string {
 	return u.path
 }
 
+// SparseUsage returns the number of bytes of the sparse transient that have
+// been fetched, and whether the transient is sparse at all.
+func (u *Upgrader) SparseUsage() (int64, bool) {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	if u.sparse == nil || u.path != u.pathSparse {
+		return 0, false
+	}
+	return u.sparse.populated(), true
+}
+
+// Passthrough returns whether the Upgrader passes through to the underlying
+// mount, in which case it never creates transients.
+func (u *Upgrader) Passthrough() bool {
+	return u.passthrough
+}
+
+// OwnedPaths returns the paths of the files that this Upgrader may own in the
+// transients directory and that must be preserved: the transient, the sidecar
+// files needed to resume sparse transients and partial downloads, and the
+// temporary files those sidecars are written through. Some of them may not
+// exist.
+func (u *Upgrader) OwnedPaths() []string {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	var ret []string
+	if u.path != "" && u.owns(u.path) {
+		ret = append(ret, u.path)
+	}
+	if u.sparse != nil {
+		ret = append(ret, u.pathSparse, u.sparse.bitmapPath, tmpPath(u.sparse.bitmapPath))
+	}
+	if !u.passthrough && u.canResume() {
+		ret = append(ret, u.pathPartial, u.pathProgress, tmpPath(u.pathProgress))
+	}
+	return ret
+}
+
+// tmpPath returns the path of the temporary file that the file at the
+// supplied path is atomically replaced through.
+func tmpPath(path string) string {
+	return path + ".tmp"
+}
+
+// OwnsTransient returns whether the transient file, if any, lives in the
+// transients root directory, as opposed to having been supplied by the user.
+// Transients that aren't owned are never removed.
+func (u *Upgrader) OwnsTransient() bool {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	return u.path != "" && u.owns(u.path)
+}
+
+// TransientInfo returns the integrity information of the transient file, if a
+// complete one exists.
+func (u *Upgrader) TransientInfo() *TransientInfo {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	if !u.ready || u.info == nil {
+		return nil
+	}
+	info := *u.info
+	return &info
+}
+
 // TimesFetched returns the number of times that the underlying has
 // been fetched.
 func (u *Upgrader) TimesFetched() int {
@@ -217,50 +456,99 @@ func (u *Upgrader) Deserialize(url *url.URL) error {
 	return u.underlying.Deserialize(url)
 }
 
-// TODO implement
+// Close closes the underlying mount. The transient is left in place.
 func (u *Upgrader) Close() error {
-	log.Warnf("Upgrader.Close() not implemented yet; call will no-op")
-	return nil
+	return u.underlying.Close()
 }
 
-func (u *Upgrader) refetch(ctx context.Context, into *os.File) error {
-	log.Debugw("actually refetching", "shard", u.key, "path", into.Name())
+// refetch downloads the underlying mount into the partial transient, and
+// returns the integrity information of the result.
+func (u *Upgrader) refetch(ctx context.Context) (*TransientInfo, error) {
+	log.Debugw("actually refetching", "shard", u.key, "path", u.pathPartial)
 
 	// sanity check on underlying mount.
 	stat, err := u.underlying.Stat(ctx)
 	if err != nil {
-		return fmt.Errorf("underlying mount stat returned error: %w", err)
+		return nil, fmt.Errorf("underlying mount stat returned error: %w", err)
 	} else if !stat.Exists {
-		return fmt.Errorf("underlying mount no longer exists")
+		return nil, fmt.Errorf("underlying mount no longer exists")
 	}
 
 	// throttle only if the file is ready; if it's not ready, we would be
 	// throttling and then idling.
-	t := u.throttler
+	t, w := u.throttler, u.weights
 	if !stat.Ready {
 		log.Debugw("underlying mount is not ready; will skip throttling", "shard", u.key)
-		t = throttle.Noop()
+		t, w = throttle.Noop(), throttle.NoopWeighted()
 	} else {
 		log.Debugw("underlying mount is ready; will throttle fetch and copy", "shard", u.key)
 	}
 
-	err = t.Do(ctx, func(ctx context.Context) error {
-		// fetch from underlying and copy.
-		from, err := u.underlying.Fetch(ctx)
+	fetch := func(ctx context.Context) error {
+		into, offset, err := u.openPartial(stat.Size)
+		if err != nil {
+			return fmt.Errorf("failed to open partial transient: %w", err)
+		}
+		defer into.Close()
+
+		// fetch from underlying and copy, resuming from the offset if we
+		// have a partial transient; start from scratch if we can't resume.
+		from, err := u.fetchFrom(ctx, offset)
+		if err != nil && offset > 0 {
+			log.Warnw("failed to resume fetch; fetching from scratch", "shard", u.key, "offset", offset, "error", err)
+			if err := into.Truncate(0); err != nil {
+				return fmt.Errorf("failed to truncate partial transient: %w", err)
+			}
+			if _, err := into.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to rewind partial transient: %w", err)
+			}
+			u.removeProgress()
+			offset = 0
+			from, err = u.underlying.Fetch(ctx)
+		}
 		if err != nil {
 			return fmt.Errorf("failed to fetch from underlying mount: %w", err)
 		}
 		defer from.Close()
 
-		_, err = io.Copy(into, from)
-		return err
+		return u.copyResumable(ctx, into, u.limit(ctx, from), offset, stat.Size)
+	}
+	err = t.Do(ctx, func(ctx context.Context) error {
+		return w.Do(ctx, stat.Size, fetch)
 	})
 
 	if err != nil {
-		return fmt.Errorf("failed to fetch and copy underlying mount to transient file: %w", err)
+		return nil, fmt.Errorf("failed to fetch and copy underlying mount to transient file: %w", err)
 	}
 
-	return nil
+	// verify the size of the download, if the underlying mount reports it.
+	fi, err := os.Stat(u.pathPartial)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat partial transient: %w", err)
+	}
+	if stat.Size > 0 && fi.Size() != stat.Size {
+		return nil, &TransientIntegrityError{
+			Path:   u.pathPartial,
+			Reason: fmt.Sprintf("size mismatch; expected: %d, actual: %d", stat.Size, fi.Size()),
+		}
+	}
+
+	info := &TransientInfo{Size: fi.Size()}
+	if u.digests {
+		if info.Digest, err = fileDigest(u.pathPartial); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// limit caps the throughput of reads from the underlying mount, if a
+// bandwidth is configured.
+func (u *Upgrader) limit(ctx context.Context, r io.Reader) io.Reader {
+	if u.bandwidth == nil {
+		return r
+	}
+	return u.bandwidth.Reader(ctx, r)
 }
 
 // DeleteTransient deletes the transient associated with this Upgrader, if
@@ -278,8 +566,8 @@ func (u *Upgrader) DeleteTransient() error {
 
 	// refuse to delete the transient if it's not being managed by us (i.e. in
 	// our transients root directory).
-	if _, err := filepath.Rel(u.rootdir, u.path); err != nil {
-		log.Debugw("transient is not owned by us; nothing to remove", "shard", u.key)
+	if !u.owns(u.path) {
+		log.Debugw("transient is not owned by us; nothing to remove", "shard", u.key, "path", u.path)
 		return nil
 	}
 
@@ -287,8 +575,15 @@ func (u *Upgrader) DeleteTransient() error {
 	// returns an error. This allows us to recover from errors like the user
 	// deleting the transient we're currently tracking.
 	err := os.Remove(u.path)
+	if u.sparse != nil && u.path == u.pathSparse {
+		if err := u.sparse.reset(); err != nil {
+			log.Warnw("failed to remove sparse transient bitmap", "shard", u.key, "error", err)
+		}
+	}
 	u.path = ""
 	u.ready = false
+	u.info = nil
+	u.verified = false
 	log.Debugw("deleted existing transient", "shard", u.key, "path", u.path, "error", err)
 	return err
 }
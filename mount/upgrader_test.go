@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"context"
 	rand2 "crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -221,6 +225,393 @@ func TestUpgraderDeduplicatesRemote(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestUpgraderSparse(t *testing.T) {
+	ctx := context.Background()
+	carBytes := testdata.CarV2
+	const chunkSize = 1024
+
+	// serve the CAR with range support, counting the bytes served.
+	var served int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &countingWriter{ResponseWriter: w, n: &served}
+		http.ServeContent(cw, r, "file.car", time.Time{}, bytes.NewReader(carBytes))
+	}))
+	defer srv.Close()
+
+	mnt, err := NewHTTPMount(ctx, srv.Client(), srv.URL)
+	require.NoError(t, err)
+	require.True(t, mnt.Ranges)
+
+	key := fmt.Sprintf("%d", rand.Uint64())
+	rootDir := t.TempDir()
+	opts := UpgradeOpts{Sparse: true, SparseChunkSize: chunkSize}
+	u, err := UpgradeWithOpts(mnt, throttle.Noop(), rootDir, key, "", opts)
+	require.NoError(t, err)
+	require.Empty(t, u.TransientPath())
+
+	// read a few bytes in the middle of the second chunk; only that chunk
+	// should be fetched.
+	rd, err := u.Fetch(ctx)
+	require.NoError(t, err)
+	require.NotEmpty(t, u.TransientPath())
+	b := make([]byte, 10)
+	n, err := rd.ReadAt(b, chunkSize+100)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, n)
+	require.Equal(t, carBytes[chunkSize+100:chunkSize+110], b)
+	require.EqualValues(t, chunkSize, atomic.LoadInt64(&served))
+
+	// the sparse transient has the full size.
+	fi, err := os.Stat(u.TransientPath())
+	require.NoError(t, err)
+	require.EqualValues(t, len(carBytes), fi.Size())
+
+	// but only the fetched chunk counts towards its usage.
+	usage, ok := u.SparseUsage()
+	require.True(t, ok)
+	require.EqualValues(t, chunkSize, usage)
+
+	// reading again within the same chunk doesn't hit the underlying.
+	n, err = rd.ReadAt(b, chunkSize)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, n)
+	require.Equal(t, carBytes[chunkSize:chunkSize+10], b)
+	require.EqualValues(t, chunkSize, atomic.LoadInt64(&served))
+	require.NoError(t, rd.Close())
+
+	// a new upgrader resuming from the sparse transient doesn't refetch the
+	// cached chunk, and fetches the rest of the file on a sequential read.
+	u, err = UpgradeWithOpts(mnt, throttle.Noop(), rootDir, key, u.TransientPath(), opts)
+	require.NoError(t, err)
+	rd, err = u.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, carBytes, bz)
+	require.NoError(t, rd.Close())
+	require.EqualValues(t, len(carBytes), atomic.LoadInt64(&served))
+
+	// the transient is now complete; fetching again is served locally.
+	rd, err = u.Fetch(ctx)
+	require.NoError(t, err)
+	require.IsType(t, (*os.File)(nil), rd)
+	require.NoError(t, rd.Close())
+
+	// deleting the transient removes the bitmap too.
+	path := u.TransientPath()
+	require.NoError(t, u.DeleteTransient())
+	require.Empty(t, u.TransientPath())
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path + ".bitmap")
+	require.True(t, os.IsNotExist(err))
+
+	// without sparse transients, the sparse transient is disregarded, and the
+	// upgrader passes through to the mount.
+	u, err = UpgradeWithOpts(mnt, throttle.Noop(), rootDir, key, path, UpgradeOpts{})
+	require.NoError(t, err)
+	require.Empty(t, u.TransientPath())
+}
+
+func TestUpgraderSparseBitmapPersistence(t *testing.T) {
+	ctx := context.Background()
+	carBytes := testdata.CarV2
+	const chunkSize = 64
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.car", time.Time{}, bytes.NewReader(carBytes))
+	}))
+	defer srv.Close()
+
+	mnt, err := NewHTTPMount(ctx, srv.Client(), srv.URL)
+	require.NoError(t, err)
+
+	opts := UpgradeOpts{Sparse: true, SparseChunkSize: chunkSize}
+	u, err := UpgradeWithOpts(mnt, throttle.Noop(), t.TempDir(), "foo", "", opts)
+	require.NoError(t, err)
+
+	// persisted returns the number of chunks recorded in the persisted bitmap.
+	persisted := func() (n int) {
+		c := newSparseCache(u.TransientPath(), chunkSize)
+		require.NoError(t, c.load())
+		for i := int64(0); i*chunkSize < c.size; i++ {
+			if c.bitmap[i/8]&(1<<(i%8)) != 0 {
+				n++
+			}
+		}
+		return n
+	}
+
+	// the bitmap isn't persisted on every fetch, but every
+	// sparsePersistInterval chunks.
+	rd, err := u.Fetch(ctx)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	for i := 0; i < sparsePersistInterval-1; i++ {
+		_, err = rd.ReadAt(b, int64(i)*chunkSize)
+		require.NoError(t, err)
+	}
+	require.Zero(t, persisted())
+	_, err = rd.ReadAt(b, (sparsePersistInterval-1)*chunkSize)
+	require.NoError(t, err)
+	require.Equal(t, sparsePersistInterval, persisted())
+
+	// and when the reader is closed.
+	_, err = rd.ReadAt(b, sparsePersistInterval*chunkSize)
+	require.NoError(t, err)
+	require.Equal(t, sparsePersistInterval, persisted())
+	require.NoError(t, rd.Close())
+	require.Equal(t, sparsePersistInterval+1, persisted())
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+func TestUpgraderResumesFetch(t *testing.T) {
+	ctx := context.Background()
+	carBytes := testdata.CarV2
+	const failAt = 1000
+
+	t.Run("resumable", func(t *testing.T) {
+		mnt := &flakyMount{data: carBytes, seek: true, failAt: failAt}
+		key := fmt.Sprintf("%d", rand.Uint64())
+		rootDir := t.TempDir()
+		u, err := Upgrade(mnt, throttle.Noop(), rootDir, key, "")
+		require.NoError(t, err)
+
+		// the first fetch fails midway; the partial and its progress are kept.
+		_, err = u.Fetch(ctx)
+		require.Error(t, err)
+		fi, err := os.Stat(u.pathPartial)
+		require.NoError(t, err)
+		require.EqualValues(t, failAt, fi.Size())
+		p, ok := u.loadProgress()
+		require.True(t, ok)
+		require.EqualValues(t, failAt, p.Offset)
+		require.EqualValues(t, len(carBytes), p.Size)
+
+		// the progress is written through a temporary file, which is owned
+		// too, so that it isn't cleared as an orphan midway through.
+		require.Contains(t, u.OwnedPaths(), tmpPath(u.pathProgress))
+
+		// a new upgrader (e.g. after a restart) resumes where we left off.
+		u, err = Upgrade(mnt, throttle.Noop(), rootDir, key, "")
+		require.NoError(t, err)
+		rd, err := u.Fetch(ctx)
+		require.NoError(t, err)
+		bz, err := ioutil.ReadAll(rd)
+		require.NoError(t, err)
+		require.NoError(t, rd.Close())
+		require.Equal(t, carBytes, bz)
+
+		// every byte was read from the underlying mount only once.
+		require.EqualValues(t, len(carBytes), atomic.LoadInt64(&mnt.read))
+
+		// the partial and its progress are gone.
+		_, err = os.Stat(u.pathPartial)
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(u.pathProgress)
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("not resumable", func(t *testing.T) {
+		mnt := &flakyMount{data: carBytes, failAt: failAt}
+		key := fmt.Sprintf("%d", rand.Uint64())
+		rootDir := t.TempDir()
+		u, err := Upgrade(mnt, throttle.Noop(), rootDir, key, "")
+		require.NoError(t, err)
+
+		// the first fetch fails midway; the partial is removed.
+		_, err = u.Fetch(ctx)
+		require.Error(t, err)
+		_, err = os.Stat(u.pathPartial)
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(u.pathProgress)
+		require.True(t, os.IsNotExist(err))
+
+		// a new upgrader fetches from scratch.
+		u, err = Upgrade(mnt, throttle.Noop(), rootDir, key, "")
+		require.NoError(t, err)
+		rd, err := u.Fetch(ctx)
+		require.NoError(t, err)
+		bz, err := ioutil.ReadAll(rd)
+		require.NoError(t, err)
+		require.NoError(t, rd.Close())
+		require.Equal(t, carBytes, bz)
+		require.EqualValues(t, failAt+len(carBytes), atomic.LoadInt64(&mnt.read))
+	})
+}
+
+// flakyMount is a remote mount that fails after serving failAt bytes on the
+// first fetch. It supports seeking if seek is true.
+type flakyMount struct {
+	data   []byte
+	seek   bool
+	failAt int64
+	read   int64 // guarded by atomic
+}
+
+var _ Mount = (*flakyMount)(nil)
+
+func (f *flakyMount) Fetch(_ context.Context) (Reader, error) {
+	r := &flakyReader{Reader: bytes.NewReader(f.data), mnt: f, failAt: f.failAt}
+	f.failAt = 0
+	return r, nil
+}
+
+func (f *flakyMount) Info() Info {
+	return Info{
+		Kind:             KindRemote,
+		AccessSequential: true,
+		AccessSeek:       f.seek,
+	}
+}
+
+func (f *flakyMount) Stat(_ context.Context) (Stat, error) {
+	return Stat{Exists: true, Size: int64(len(f.data)), Ready: true}, nil
+}
+
+func (f *flakyMount) Serialize() *url.URL {
+	panic("implement me")
+}
+
+func (f *flakyMount) Deserialize(_ *url.URL) error {
+	panic("implement me")
+}
+
+func (f *flakyMount) Close() error {
+	return nil
+}
+
+type flakyReader struct {
+	*bytes.Reader
+	mnt    *flakyMount
+	failAt int64
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if r.failAt > 0 {
+		pos := r.Size() - int64(r.Len())
+		if pos >= r.failAt {
+			return 0, errors.New("connection reset")
+		}
+		if rem := r.failAt - pos; int64(len(p)) > rem {
+			p = p[:rem]
+		}
+	}
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(&r.mnt.read, int64(n))
+	return n, err
+}
+
+func (r *flakyReader) Close() error {
+	return nil
+}
+
+func TestUpgraderTransientIntegrity(t *testing.T) {
+	ctx := context.Background()
+	carBytes := testdata.CarV2
+	digest := sha256.Sum256(carBytes)
+
+	fetch := func(t *testing.T, u *Upgrader) {
+		rd, err := u.Fetch(ctx)
+		require.NoError(t, err)
+		bz, err := ioutil.ReadAll(rd)
+		require.NoError(t, err)
+		require.NoError(t, rd.Close())
+		require.Equal(t, carBytes, bz)
+	}
+
+	mnt := &Counting{Mount: &FSMount{testdata.FS, testdata.FSPathCarV2}}
+	key := fmt.Sprintf("%d", rand.Uint64())
+	rootDir := t.TempDir()
+	opts := UpgradeOpts{Digest: true}
+	u, err := UpgradeWithOpts(mnt, throttle.Noop(), rootDir, key, "", opts)
+	require.NoError(t, err)
+	require.Nil(t, u.TransientInfo())
+
+	// the size and digest are recorded when the transient completes.
+	fetch(t, u)
+	require.EqualValues(t, 1, mnt.Count())
+	info := u.TransientInfo()
+	require.NotNil(t, info)
+	require.EqualValues(t, len(carBytes), info.Size)
+	require.Equal(t, digest[:], info.Digest)
+
+	// a truncated transient is refetched.
+	require.NoError(t, os.Truncate(u.TransientPath(), 100))
+	fetch(t, u)
+	require.EqualValues(t, 2, mnt.Count())
+
+	// a corrupted transient is detected by its digest after a restart, and
+	// refetched.
+	corrupted := append([]byte{}, carBytes...)
+	corrupted[100] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(u.TransientPath(), corrupted, 0644))
+	opts.InitialInfo = info
+	u, err = UpgradeWithOpts(mnt, throttle.Noop(), rootDir, key, u.TransientPath(), opts)
+	require.NoError(t, err)
+	fetch(t, u)
+	require.EqualValues(t, 3, mnt.Count())
+
+	// a healthy transient is reused after a restart.
+	u, err = UpgradeWithOpts(mnt, throttle.Noop(), rootDir, key, u.TransientPath(), opts)
+	require.NoError(t, err)
+	fetch(t, u)
+	require.EqualValues(t, 3, mnt.Count())
+
+	// a user-supplied transient not matching expectations is refetched, but
+	// not removed.
+	existing := filepath.Join(t.TempDir(), "existing.car")
+	require.NoError(t, ioutil.WriteFile(existing, corrupted[:1000], 0644))
+	u, err = UpgradeWithOpts(mnt, throttle.Noop(), rootDir, key, existing, UpgradeOpts{InitialInfo: &TransientInfo{Size: int64(len(carBytes))}})
+	require.NoError(t, err)
+	fetch(t, u)
+	require.EqualValues(t, 4, mnt.Count())
+	_, err = os.Stat(existing)
+	require.NoError(t, err)
+	require.NotEqual(t, existing, u.TransientPath())
+
+	// a download not matching the size reported by the mount fails.
+	short := &blockingReaderMount{isReady: true, br: &blockingReader{r: bytes.NewReader(carBytes[:10])}}
+	u, err = Upgrade(short, throttle.Noop(), rootDir, "short", "")
+	require.NoError(t, err)
+	_, err = u.Fetch(ctx)
+	var ierr *TransientIntegrityError
+	require.ErrorAs(t, err, &ierr)
+	require.Empty(t, u.TransientPath())
+}
+
+func TestUpgraderBandwidth(t *testing.T) {
+	carBytes := testdata.CarV2
+	size := int64(len(carBytes))
+
+	// allow fetching the whole CAR in a second, in bursts of a quarter; the
+	// fetch has to wait for three quarters of it to refill.
+	bw := throttle.NewTokenBucket(size, size/4)
+	mnt := &FSMount{testdata.FS, testdata.FSPathCarV2}
+	u, err := UpgradeWithOpts(mnt, throttle.Noop(), t.TempDir(), "foo", "", UpgradeOpts{Bandwidth: bw})
+	require.NoError(t, err)
+
+	start := time.Now()
+	rd, err := u.Fetch(context.Background())
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(600*time.Millisecond))
+
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, carBytes, bz)
+}
+
 func TestUpgraderFetchAndCopyThrottle(t *testing.T) {
 	nFixedThrottle := 3
 
@@ -349,7 +740,7 @@ func (b *blockingReaderMount) Info() Info {
 func (b *blockingReaderMount) Stat(ctx context.Context) (Stat, error) {
 	return Stat{
 		Exists: true,
-		Size:   1024,
+		Size:   1, // the readers serve a single byte.
 		Ready:  b.isReady,
 	}, nil
 }
@@ -0,0 +1,135 @@
+package dagstore
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/filecoin-project/dagstore/mount"
+)
+
+const (
+	// defaultRetryInitialBackoff is the default delay before the first retry.
+	defaultRetryInitialBackoff = time.Second
+	// defaultRetryMaxBackoff is the default cap on the delay between retries.
+	defaultRetryMaxBackoff = time.Minute
+	// defaultRetryMultiplier is the default growth factor of the backoff.
+	defaultRetryMultiplier = 2
+)
+
+// RetryPolicy configures how failed fetches and initializations are retried
+// before the shard is failed. The zero value disables retries.
+//
+// Every retry is preceded by an OpShardRetry trace carrying the error and
+// the number of the attempt that failed.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first
+	// one. 0 and 1 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry. Defaults to 1s.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries. Defaults to 1m.
+	MaxBackoff time.Duration
+	// Multiplier is the factor by which the delay grows after every retry.
+	// Defaults to 2.
+	Multiplier float64
+	// Jitter randomizes every delay by up to this fraction of it, in either
+	// direction, so that shards that failed together don't retry in
+	// lockstep. 0 disables jitter.
+	Jitter float64
+	// Retryable classifies errors as transient, for mounts that don't
+	// implement mount.Retryable. If nil, all errors are considered
+	// transient. Context cancellations are never retried.
+	Retryable func(err error) bool
+}
+
+// backoff returns the delay before retrying the supplied failed attempt,
+// counting from 1.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	initial, max, mult := p.InitialBackoff, p.MaxBackoff, p.Multiplier
+	if initial <= 0 {
+		initial = defaultRetryInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultRetryMaxBackoff
+	}
+	if mult < 1 {
+		mult = defaultRetryMultiplier
+	}
+
+	d := math.Min(float64(initial)*math.Pow(mult, float64(attempt-1)), float64(max))
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// retryable returns whether the error the shard's operation failed with is
+// transient. Failures of the index and unrestorable mounts are always
+// permanent, and failed transient integrity checks always transient. Other
+// errors are classified by the shard's mount if it produced them, and by the
+// retry policy otherwise.
+func (d *DAGStore) retryable(s *Shard, err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrDAGStoreClosed) {
+		return false
+	}
+	if errors.Is(err, ErrIndexCorrupt) || errors.Is(err, ErrMountUnrestorable) {
+		return false
+	}
+	var ierr *mount.TransientIntegrityError
+	if errors.As(err, &ierr) {
+		return true
+	}
+	if retryable, ok := mountRetryable(s, err); ok {
+		return retryable
+	}
+	if f := d.config.RetryPolicy.Retryable; f != nil {
+		return f(err)
+	}
+	return true
+}
+
+// mountRetryable asks the shard's mount whether the error is transient. ok is
+// false if the mount can't classify errors, or if it didn't produce this one.
+func mountRetryable(s *Shard, err error) (retryable bool, ok bool) {
+	underlying := s.mount.Underlying()
+	r, ok := underlying.(mount.Retryable)
+	if !ok {
+		return false, false
+	}
+	if src, ok := underlying.(mount.ErrorSource); ok && !src.Produced(err) {
+		return false, false
+	}
+	return r.Retryable(err), true
+}
+
+// retry runs the supplied operation of the shard until it succeeds, fails
+// with a permanent error, exhausts the attempts allowed by the retry policy,
+// or the context is done. It returns the last error. The id is the
+// operation the retries are attributed to in traces.
+func (d *DAGStore) retry(ctx context.Context, s *Shard, id OpID, fn func(ctx context.Context) error) error {
+	p := &d.config.RetryPolicy
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= p.MaxAttempts || d.ctxErr(ctx) != nil || !d.retryable(s, err) {
+			return err
+		}
+
+		backoff := p.backoff(attempt)
+		log.Warnw("shard operation failed; retrying", "op_id", id, "shard", s.key, "attempt", attempt, "backoff", backoff, "error", err)
+		_ = d.queueTask(&task{op: OpShardRetry, shard: s, err: err, id: id, attempt: attempt}, s.loop.completionCh)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-d.ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
@@ -3,9 +3,11 @@ package dagstore
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/filecoin-project/dagstore/mount"
 	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/throttle"
 )
 
 // waiter encapsulates a context passed by the user, and the channel they want
@@ -14,18 +16,65 @@ type waiter struct {
 	ctx        context.Context    // governs the op if it's external
 	outCh      chan<- ShardResult // to send back the result
 	notifyDead func()             // called when the context expired and we weren't able to deliver the result
+	id         OpID               // the operation the result belongs to
+	created    time.Time          // when the op was requested; zero for internal waiters
+	started    time.Time          // when the event loop started processing the op
+	buffered   bool               // outCh has room for every result; deliver even if ctx is done
+	priority   throttle.Priority  // the priority of the op; also carried by ctx
+}
+
+// prioritize sets the priority of the waiter's operation, and attaches it to
+// its context, so that the throttlers the operation goes through honour it.
+func (w *waiter) prioritize(p throttle.Priority) {
+	w.priority = p
+	w.ctx = throttle.WithPriority(w.ctx, p)
+}
+
+// stamp returns a copy of the result stamped with the waiter's operation id
+// and timestamps, finishing at the specified time.
+func (w *waiter) stamp(res ShardResult, finished time.Time) *ShardResult {
+	res.OpID, res.Queued, res.Started, res.Finished = w.id, w.created, w.started, finished
+	return &res
 }
 
 func (w waiter) deliver(res *ShardResult) {
 	if w.outCh == nil {
 		return
 	}
+	if w.buffered {
+		w.outCh <- *res
+		return
+	}
+	select {
+	case w.outCh <- *res:
+	case <-w.ctx.Done():
+		if w.notifyDead != nil {
+			w.notifyDead()
+		}
+	}
+}
+
+// tryDeliver delivers the result if the waiter's channel can take it without
+// blocking, and returns whether it did.
+func (w waiter) tryDeliver(res *ShardResult) bool {
+	select {
+	case w.outCh <- *res:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliverWithin is like deliver, but it also gives up when ctx is done, even
+// if the waiter is buffered.
+func (w waiter) deliverWithin(ctx context.Context, res *ShardResult) {
 	select {
 	case w.outCh <- *res:
 	case <-w.ctx.Done():
 		if w.notifyDead != nil {
 			w.notifyDead()
 		}
+	case <-ctx.Done():
 	}
 }
 
@@ -39,13 +88,19 @@ type Shard struct {
 	key   shard.Key       // persisted in PersistedShard.Key
 	mount *mount.Upgrader // persisted in PersistedShard.URL (underlying)
 	lazy  bool            // persisted in PersistedShard.Lazy; whether this shard has lazy indexing
+	loop  *eventLoop      // the event loop processing the shard's tasks.
 
 	// Mutable fields.
 	// Cannot read/write outside event loop.
 	state ShardState // persisted in PersistedShard.State
 	err   error      // persisted in PersistedShard.Error; populated if shard state is errored.
 
-	recoverOnNextAcquire bool // a shard marked in error state during initialization can be recovered on its first acquire.
+	recoverOnNextAcquire bool      // a shard marked in error state during initialization can be recovered on its first acquire.
+	destroyed            bool      // the shard is being torn down; no further operations are accepted, nor is its state persisted.
+	pinned               bool      // persisted in PersistedShard.Pinned; the transient is exempt from eviction and GC.
+	lastAccessed         time.Time // last time the shard was acquired or became available; drives LRU eviction of transients.
+	recoveries           int       // automatic recoveries scheduled since the shard last became available.
+	record               []byte    // the record last queued for persistence; unchanged records are not persisted again.
 
 	// Waiters.
 	wRegister *waiter   // waiter for registration result.
@@ -55,3 +110,11 @@ type Shard struct {
 
 	refs uint32 // number of DAG accessors currently open
 }
+
+// reclaimable returns whether the shard's transient can be reclaimed, i.e.
+// the shard is idle, and its transient is not pinned. It must be called with
+// the shard lock held.
+func (s *Shard) reclaimable() bool {
+	idle := (s.state == ShardStateAvailable || s.state == ShardStateErrored) && len(s.wAcquire) == 0
+	return idle && !s.destroyed && !s.pinned
+}
@@ -1,6 +1,7 @@
 package dagstore
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,8 +11,27 @@ import (
 	"github.com/filecoin-project/dagstore/mount"
 	"github.com/filecoin-project/dagstore/shard"
 	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
 )
 
+// Shard records used to be persisted as JSON objects; they are now persisted
+// as CBOR (see shard_gen.go), prefixed by a version byte:
+//
+//	[version byte][CBOR-encoded PersistedShard]
+//
+// Legacy JSON records are still readable. They are rewritten in the current
+// format on start, or by MigrateDatastore.
+const (
+	// recordVersion1 is the version byte of the current record format.
+	recordVersion1 byte = 0x01
+
+	// legacyJSONPrefix is the first byte of legacy JSON-encoded records.
+	legacyJSONPrefix byte = '{'
+)
+
+var errUnknownRecordFormat = errors.New("unknown shard record format")
+
 // PersistedShard is the persistent representation of the Shard.
 type PersistedShard struct {
 	Key           string     `json:"k"`
@@ -20,34 +40,97 @@ type PersistedShard struct {
 	State         ShardState `json:"s"`
 	Lazy          bool       `json:"l"`
 	Error         string     `json:"e"`
+
+	// TransientSize and TransientDigest record the integrity information of
+	// the transient, if it's complete, to verify it on restart.
+	TransientSize   uint64 `json:"ts,omitempty"`
+	TransientDigest []byte `json:"td,omitempty"`
+
+	// Pinned indicates whether the transient is pinned.
+	Pinned bool `json:"p,omitempty"`
+}
+
+// isLegacyRecord returns whether the record is encoded in the legacy JSON
+// format.
+func isLegacyRecord(b []byte) bool {
+	return len(b) > 0 && b[0] == legacyJSONPrefix
+}
+
+// encodeRecord encodes the persisted shard in the current record format.
+func encodeRecord(ps *PersistedShard) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte(recordVersion1)
+	if err := ps.MarshalCBOR(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decodeRecord decodes a persisted shard from a record in either the current
+// or the legacy format.
+func decodeRecord(b []byte) (*PersistedShard, error) {
+	var ps PersistedShard
+	switch {
+	case isLegacyRecord(b):
+		if err := json.Unmarshal(b, &ps); err != nil {
+			return nil, err
+		}
+	case len(b) > 0 && b[0] == recordVersion1:
+		if err := ps.UnmarshalCBOR(bytes.NewReader(b[1:])); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errUnknownRecordFormat
+	}
+	return &ps, nil
 }
 
 // MarshalJSON returns a serialized representation of the state. It must be
 // called with a shard lock (read, at least), such as from inside the event
 // loop, as it accesses mutable state.
 func (s *Shard) MarshalJSON() ([]byte, error) {
-	u, err := s.d.mounts.Represent(s.mount)
+	ps, err := s.persisted()
 	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ps)
+}
+
+// persisted returns the persistent representation of the shard. Like
+// MarshalJSON, it must be called with a shard lock.
+func (s *Shard) persisted() (*PersistedShard, error) {
+	var (
+		u   *url.URL
+		err error
+	)
+	if m, ok := s.mount.Underlying().(*unrestorableMount); ok {
+		// preserve the original URL, in case the mount can be restored later.
+		u = m.Serialize()
+	} else if u, err = s.d.mounts.Represent(s.mount); err != nil {
 		return nil, fmt.Errorf("failed to encode mount: %w", err)
 	}
-	ps := PersistedShard{
+	ps := &PersistedShard{
 		Key:           s.key.String(),
 		URL:           u.String(),
 		State:         s.state,
 		Lazy:          s.lazy,
+		Pinned:        s.pinned,
 		TransientPath: s.mount.TransientPath(),
 	}
+	if ps.State == ShardStateServing {
+		// shards have no active acquirers on restart, so references don't
+		// need to be persisted.
+		ps.State = ShardStateAvailable
+	}
+	if info := s.mount.TransientInfo(); info != nil {
+		ps.TransientSize = uint64(info.Size)
+		ps.TransientDigest = info.Digest
+	}
 	if s.err != nil {
 		ps.Error = s.err.Error()
 	}
 
-	return json.Marshal(ps)
-	// TODO maybe switch to CBOR, as it's probably faster.
-	// var b bytes.Buffer
-	// if err := ps.MarshalCBOR(&b); err != nil {
-	// 	return nil, err
-	// }
-	// return b.Bytes(), nil
+	return ps, nil
 }
 
 func (s *Shard) UnmarshalJSON(b []byte) error {
@@ -55,11 +138,20 @@ func (s *Shard) UnmarshalJSON(b []byte) error {
 	if err := json.Unmarshal(b, &ps); err != nil {
 		return err
 	}
+	return s.restore(&ps)
+}
 
+// restore restores the shard from its persisted representation.
+//
+// If the mount can't be restored, the shard is given a placeholder mount
+// that preserves the original mount URL, and an error wrapping
+// ErrMountUnrestorable is returned.
+func (s *Shard) restore(ps *PersistedShard) error {
 	// restore basics.
 	s.key = shard.KeyFromString(ps.Key)
 	s.state = ps.State
 	s.lazy = ps.Lazy
+	s.pinned = ps.Pinned
 	if ps.Error != "" {
 		s.err = errors.New(ps.Error)
 	}
@@ -69,32 +161,113 @@ func (s *Shard) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return fmt.Errorf("failed to parse mount URL: %w", err)
 	}
-	mnt, err := s.d.mounts.Instantiate(u)
-	if err != nil {
-		return fmt.Errorf("failed to instantiate mount from URL: %w", err)
+	var info *mount.TransientInfo
+	if ps.TransientSize > 0 {
+		info = &mount.TransientInfo{Size: int64(ps.TransientSize), Digest: ps.TransientDigest}
 	}
-	s.mount, err = mount.Upgrade(mnt, s.d.throttleReaadyFetch, s.d.config.TransientsDir, s.key.String(), ps.TransientPath)
+	mnt, mntErr := s.d.mounts.Instantiate(u)
+	if mntErr != nil {
+		mntErr = fmt.Errorf("%w: failed to instantiate mount from URL: %s", ErrMountUnrestorable, mntErr)
+		mnt = &unrestorableMount{u: u, err: mntErr}
+	}
+	s.mount, err = mount.UpgradeWithOpts(mnt, s.d.throttleReaadyFetch, s.d.config.TransientsDir, s.key.String(), ps.TransientPath, s.d.upgradeOpts(info))
 	if err != nil {
-		return fmt.Errorf("failed to apply mount upgrader: %w", err)
+		return fmt.Errorf("%w: failed to apply mount upgrader: %s", ErrMountUnrestorable, err)
 	}
 
+	return mntErr
+}
+
+// unrestorableMount stands in for a mount that couldn't be restored on start.
+// It preserves the original URL, so that the mount can be restored on a later
+// start, and fails all accesses.
+type unrestorableMount struct {
+	u   *url.URL
+	err error
+}
+
+var _ mount.Mount = (*unrestorableMount)(nil)
+
+func (m *unrestorableMount) Close() error {
 	return nil
 }
 
-// persist persists the shard's state into the supplied Datastore. It calls
-// MarshalJSON, which requires holding a shard lock to be safe.
-func (s *Shard) persist(ctx context.Context, store ds.Datastore) error {
-	ps, err := s.MarshalJSON()
+func (m *unrestorableMount) Fetch(_ context.Context) (mount.Reader, error) {
+	return nil, m.err
+}
+
+func (m *unrestorableMount) Info() mount.Info {
+	return mount.Info{Kind: mount.KindRemote, AccessSequential: true}
+}
+
+func (m *unrestorableMount) Stat(_ context.Context) (mount.Stat, error) {
+	return mount.Stat{}, m.err
+}
+
+func (m *unrestorableMount) Serialize() *url.URL {
+	u := *m.u
+	return &u
+}
+
+func (m *unrestorableMount) Deserialize(u *url.URL) error {
+	m.u = u
+	return nil
+}
+
+// MigrateDatastore rewrites the shard records persisted in the supplied
+// Datastore by an older version of the DAG store in the current format. The
+// records are expected under StoreNamespace, as in Config.Datastore. It
+// returns the number of records rewritten.
+//
+// The DAG store migrates records on start, so calling this is only necessary
+// to upgrade a datastore offline. It must not be called on a datastore in use
+// by a running DAG store. Records that can't be parsed are left untouched.
+func MigrateDatastore(ctx context.Context, store ds.Datastore) (int, error) {
+	store = namespace.Wrap(store, StoreNamespace)
+	results, err := store.Query(ctx, query.Query{})
 	if err != nil {
-		return fmt.Errorf("failed to serialize shard state: %w", err)
+		return 0, fmt.Errorf("failed to query shard records: %w", err)
 	}
-	// assuming that the datastore is namespaced if need be.
-	k := ds.NewKey(s.key.String())
-	if err := store.Put(ctx, k, ps); err != nil {
-		return fmt.Errorf("failed to put shard state: %w", err)
+	defer results.Close()
+
+	legacy := make(map[ds.Key]*PersistedShard)
+	for res := range results.Next() {
+		if res.Error != nil {
+			return 0, fmt.Errorf("failed to query shard records: %w", res.Error)
+		}
+		if !isLegacyRecord(res.Value) {
+			continue
+		}
+		ps, err := decodeRecord(res.Value)
+		if err != nil {
+			log.Warnw("migration: skipping unparseable shard record", "key", res.Key, "error", err)
+			continue
+		}
+		legacy[ds.NewKey(res.Key)] = ps
+	}
+	return migrateRecords(ctx, store, legacy)
+}
+
+// migrateRecords rewrites the supplied legacy records in the current format,
+// and returns the number of records rewritten.
+func migrateRecords(ctx context.Context, store ds.Datastore, legacy map[ds.Key]*PersistedShard) (int, error) {
+	if len(legacy) == 0 {
+		return 0, nil
+	}
+	var n int
+	for k, ps := range legacy {
+		v, err := encodeRecord(ps)
+		if err != nil {
+			return n, fmt.Errorf("failed to encode shard record %s: %w", k, err)
+		}
+		if err := store.Put(ctx, k, v); err != nil {
+			return n, fmt.Errorf("failed to rewrite shard record %s: %w", k, err)
+		}
+		n++
 	}
 	if err := store.Sync(ctx, ds.Key{}); err != nil {
-		return fmt.Errorf("failed to sync shard state to store: %w", err)
+		return n, fmt.Errorf("failed to sync migrated shard records: %w", err)
 	}
-	return nil
+	log.Infow("migrated legacy shard records", "count", n)
+	return n, nil
 }
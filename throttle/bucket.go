@@ -0,0 +1,109 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// TokenBucket limits the aggregate throughput of the readers it wraps to a
+// number of bytes per second, allowing bursts of up to a number of bytes.
+type TokenBucket struct {
+	rate  float64 // bytes per second.
+	burst int64
+
+	lk     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a token bucket that refills at bytesPerSecond, and
+// holds up to burst bytes. A burst of 0 defaults to one second's worth of
+// bytes.
+func NewTokenBucket(bytesPerSecond, burst int64) *TokenBucket {
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	return &TokenBucket{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// WaitN blocks until n bytes can be consumed from the bucket, or the context
+// is done. Requests larger than the burst are consumed in bursts.
+func (b *TokenBucket) WaitN(ctx context.Context, n int64) error {
+	for n > 0 {
+		chunk := n
+		if chunk > b.burst {
+			chunk = b.burst
+		}
+		if err := b.wait(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// wait reserves n tokens, which may leave the bucket in debt, and waits until
+// the debt is paid off.
+func (b *TokenBucket) wait(ctx context.Context, n int64) error {
+	b.lk.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if max := float64(b.burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	debt := -b.tokens
+	b.lk.Unlock()
+
+	if debt <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(debt / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// return the tokens we didn't use.
+		b.lk.Lock()
+		b.tokens += float64(n)
+		b.lk.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Reader wraps the reader, so that reads consume from the bucket. Reads
+// block once the bucket is depleted until it refills, or the context is done.
+func (b *TokenBucket) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &bucketReader{ctx: ctx, r: r, b: b}
+}
+
+type bucketReader struct {
+	ctx context.Context
+	r   io.Reader
+	b   *TokenBucket
+}
+
+func (r *bucketReader) Read(p []byte) (int, error) {
+	// don't read more than a burst at once, so that the data is consumed at
+	// an even pace.
+	if int64(len(p)) > r.b.burst {
+		p = p[:r.b.burst]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.b.WaitN(r.ctx, int64(n)); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,38 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	// 64KiB/s with a 16KiB burst; reading 64KiB takes at least the time to
+	// refill the 48KiB that exceed the burst.
+	b := NewTokenBucket(64<<10, 16<<10)
+
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, b.Reader(context.Background(), bytes.NewReader(make([]byte, 64<<10))))
+	require.NoError(t, err)
+	require.EqualValues(t, 64<<10, n)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(700*time.Millisecond))
+}
+
+func TestTokenBucketCancel(t *testing.T) {
+	b := NewTokenBucket(1024, 0)
+	require.NoError(t, b.WaitN(context.Background(), 1024)) // drain the burst.
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, b.WaitN(ctx, 1024), context.DeadlineExceeded)
+
+	// the cancelled wait returned its tokens.
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	require.Greater(t, b.tokens, float64(-1024))
+}
@@ -0,0 +1,195 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Priority is the priority of a throttled action. Actions with higher
+// priorities claim throttler spots first. The zero value is PriorityNormal.
+type Priority int
+
+const (
+	// PriorityLow is for bulk or background work, such as re-indexing.
+	PriorityLow Priority = -1
+	// PriorityNormal is the default priority.
+	PriorityNormal Priority = 0
+	// PriorityHigh is for latency-sensitive work, such as retrievals.
+	PriorityHigh Priority = 1
+)
+
+// DefaultAging is the default time after which a parked action is promoted
+// by one priority level.
+const DefaultAging = 5 * time.Second
+
+type priorityKey struct{}
+
+// WithPriority returns a context carrying the supplied priority, which
+// priority-aware throttlers honour when the context is passed to Do.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFrom returns the priority carried by the context, or
+// PriorityNormal if it carries none.
+func PriorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+type prioritizedThrottler struct {
+	capacity int64
+	aging    time.Duration
+
+	lk      sync.Mutex
+	used    int64
+	waiting []*parked
+}
+
+type parked struct {
+	priority Priority
+	weight   int64
+	since    time.Time
+	ready    chan struct{} // closed when the weight is granted.
+}
+
+// Prioritized creates a new throttler that allows the specified fixed
+// concurrency at most, like Fixed, but hands spots over by strict priority,
+// as carried by the context passed to Do; see WithPriority. Actions with the
+// same priority are served in arrival order.
+//
+// To prevent starvation, parked actions are promoted by one priority level
+// for every aging period they have waited. An aging of 0 uses DefaultAging.
+//
+// The concurrency can be changed while in use through SetCapacity; a
+// concurrency of 0 leaves the throttler unlimited.
+func Prioritized(maxConcurrency int, aging time.Duration) ResizableThrottler {
+	return newPrioritized(int64(maxConcurrency), aging)
+}
+
+func newPrioritized(capacity int64, aging time.Duration) *prioritizedThrottler {
+	if aging <= 0 {
+		aging = DefaultAging
+	}
+	if capacity < 0 {
+		capacity = 0
+	}
+	return &prioritizedThrottler{capacity: capacity, aging: aging}
+}
+
+func (t *prioritizedThrottler) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	return t.do(ctx, 1, fn)
+}
+
+// do performs the action once the weight fits in the remaining capacity, and
+// no parked action with a higher effective priority is waiting. Weights are
+// clamped to [1, capacity] when claimed, so that every action can run
+// eventually.
+func (t *prioritizedThrottler) do(ctx context.Context, weight int64, fn func(ctx context.Context) error) error {
+	if weight < 1 {
+		weight = 1
+	}
+
+	t.lk.Lock()
+	if len(t.waiting) == 0 && t.fits(weight) {
+		weight = t.clamp(weight)
+		t.used += weight
+		t.lk.Unlock()
+	} else {
+		p := &parked{priority: PriorityFrom(ctx), weight: weight, since: time.Now(), ready: make(chan struct{})}
+		t.waiting = append(t.waiting, p)
+		// we may outrank the waiters that are blocking the others.
+		t.grant()
+		t.lk.Unlock()
+
+		select {
+		case <-p.ready:
+		case <-ctx.Done():
+			if !t.abandon(p) {
+				// the weight was granted to us in the meantime; pass it on.
+				t.release(p.weight)
+			}
+			return ctx.Err()
+		}
+		// the weight may have been clamped when granted.
+		weight = p.weight
+	}
+
+	defer t.release(weight)
+	return fn(ctx)
+}
+
+// release releases the weight, and grants the remaining capacity to parked
+// actions.
+func (t *prioritizedThrottler) release(weight int64) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	t.used -= weight
+	t.grant()
+}
+
+// grant grants the remaining capacity to parked actions in order of
+// effective priority, until the next one doesn't fit. It must be called with
+// the lock held.
+func (t *prioritizedThrottler) grant() {
+	now := time.Now()
+	for len(t.waiting) > 0 {
+		next := 0
+		for i, p := range t.waiting[1:] {
+			if t.effective(p, now) > t.effective(t.waiting[next], now) {
+				next = i + 1
+			}
+		}
+		p := t.waiting[next]
+		if !t.fits(p.weight) {
+			// strict priority: don't let lighter actions overtake it.
+			return
+		}
+		p.weight = t.clamp(p.weight)
+		t.used += p.weight
+		t.waiting = append(t.waiting[:next], t.waiting[next+1:]...)
+		close(p.ready)
+	}
+}
+
+// fits returns whether the weight, once clamped, fits in the remaining
+// capacity. It must be called with the lock held.
+func (t *prioritizedThrottler) fits(weight int64) bool {
+	return t.capacity == 0 || t.used+t.clamp(weight) <= t.capacity
+}
+
+// clamp clamps the weight to the capacity. It must be called with the lock
+// held.
+func (t *prioritizedThrottler) clamp(weight int64) int64 {
+	if t.capacity > 0 && weight > t.capacity {
+		return t.capacity
+	}
+	return weight
+}
+
+// abandon removes a parked action, and returns false if it was granted its
+// weight already.
+func (t *prioritizedThrottler) abandon(p *parked) bool {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	for i, w := range t.waiting {
+		if w == p {
+			t.waiting = append(t.waiting[:i], t.waiting[i+1:]...)
+			// the action may have been blocking lighter ones.
+			t.grant()
+			return true
+		}
+	}
+	return false
+}
+
+// effective returns the priority of the parked action, promoted by one level
+// for every aging period it has waited.
+func (t *prioritizedThrottler) effective(p *parked, now time.Time) Priority {
+	return p.priority + Priority(now.Sub(p.since)/t.aging)
+}
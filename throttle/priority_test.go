@@ -0,0 +1,146 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// park runs an action through the throttler with the supplied priority, and
+// waits until it's parked.
+func park(t *testing.T, tt Throttler, p Priority, order chan<- Priority, wg *sync.WaitGroup) {
+	pt := tt.(*prioritizedThrottler)
+	pt.lk.Lock()
+	n := len(pt.waiting)
+	pt.lk.Unlock()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := tt.Do(WithPriority(context.Background(), p), func(ctx context.Context) error {
+			order <- PriorityFrom(ctx)
+			return nil
+		})
+		require.NoError(t, err)
+	}()
+
+	require.Eventually(t, func() bool {
+		pt.lk.Lock()
+		defer pt.lk.Unlock()
+		return len(pt.waiting) == n+1
+	}, time.Second, time.Millisecond)
+}
+
+// occupy occupies the only spot of the throttler until release is closed.
+func occupy(t *testing.T, tt Throttler) (release chan struct{}, done chan error) {
+	release, done = make(chan struct{}), make(chan error)
+	go func() {
+		done <- tt.Do(context.Background(), func(ctx context.Context) error {
+			<-release
+			return nil
+		})
+	}()
+	require.Eventually(t, func() bool {
+		pt := tt.(*prioritizedThrottler)
+		pt.lk.Lock()
+		defer pt.lk.Unlock()
+		return pt.used == 1
+	}, time.Second, time.Millisecond)
+	return release, done
+}
+
+func TestPrioritizedThrottler(t *testing.T) {
+	tt := Prioritized(1, time.Hour)
+
+	release, done := occupy(t, tt)
+
+	var wg sync.WaitGroup
+	order := make(chan Priority, 4)
+	park(t, tt, PriorityLow, order, &wg)
+	park(t, tt, PriorityNormal, order, &wg)
+	park(t, tt, PriorityHigh, order, &wg)
+
+	// a cancelled action gives up its place.
+	ctx, cancel := context.WithCancel(WithPriority(context.Background(), PriorityHigh))
+	errCh := make(chan error)
+	go func() {
+		errCh <- tt.Do(ctx, func(ctx context.Context) error {
+			t.Error("cancelled action executed")
+			return nil
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-errCh, context.Canceled)
+
+	close(release)
+	require.NoError(t, <-done)
+	wg.Wait()
+	close(order)
+
+	var got []Priority
+	for p := range order {
+		got = append(got, p)
+	}
+	require.Equal(t, []Priority{PriorityHigh, PriorityNormal, PriorityLow}, got)
+}
+
+func TestPrioritizedThrottlerAging(t *testing.T) {
+	tt := Prioritized(1, 100*time.Millisecond)
+
+	release, done := occupy(t, tt)
+
+	var wg sync.WaitGroup
+	order := make(chan Priority, 2)
+	park(t, tt, PriorityLow, order, &wg)
+
+	// the low priority action waits for long enough to be promoted above the
+	// normal priority action that arrives later.
+	time.Sleep(250 * time.Millisecond)
+	park(t, tt, PriorityNormal, order, &wg)
+
+	close(release)
+	require.NoError(t, <-done)
+	wg.Wait()
+	close(order)
+
+	require.Equal(t, PriorityLow, <-order)
+	require.Equal(t, PriorityNormal, <-order)
+}
+
+func TestPrioritizedThrottlerConcurrency(t *testing.T) {
+	tt := Prioritized(3, 0)
+
+	var (
+		lk          sync.Mutex
+		active, max int
+		wg          sync.WaitGroup
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(p Priority) {
+			defer wg.Done()
+			err := tt.Do(WithPriority(context.Background(), p), func(ctx context.Context) error {
+				lk.Lock()
+				active++
+				if active > max {
+					max = active
+				}
+				lk.Unlock()
+
+				time.Sleep(5 * time.Millisecond)
+
+				lk.Lock()
+				active--
+				lk.Unlock()
+				return nil
+			})
+			require.NoError(t, err)
+		}(Priority(i%3 - 1))
+	}
+	wg.Wait()
+	require.Equal(t, 3, max)
+}
@@ -0,0 +1,68 @@
+package throttle
+
+// Stats is a snapshot of the usage of a throttler.
+type Stats struct {
+	// Capacity is the maximum concurrency, or total weight, allowed by the
+	// throttler; 0 if unlimited.
+	Capacity int64
+	// InUse is the concurrency, or total weight, claimed by the actions in
+	// flight.
+	InUse int64
+	// Waiting is the number of actions parked waiting to claim capacity.
+	Waiting int
+}
+
+// Resizable is implemented by throttlers whose capacity can be changed while
+// in use.
+type Resizable interface {
+	// SetCapacity changes the capacity of the throttler, and takes effect
+	// immediately for parked actions. If the capacity shrinks below what is in
+	// use, actions in flight run to completion, but no further actions are
+	// admitted until usage drops below the new capacity. A capacity of 0
+	// lifts the limit.
+	SetCapacity(capacity int64)
+
+	// Stats returns a snapshot of the usage of the throttler.
+	Stats() Stats
+}
+
+// ResizableThrottler is a Throttler whose concurrency can be changed while
+// in use.
+type ResizableThrottler interface {
+	Throttler
+	Resizable
+}
+
+// ResizableWeightedThrottler is a WeightedThrottler whose capacity can be
+// changed while in use.
+type ResizableWeightedThrottler interface {
+	WeightedThrottler
+	Resizable
+}
+
+func (t *prioritizedThrottler) SetCapacity(capacity int64) {
+	if capacity < 0 {
+		capacity = 0
+	}
+
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	t.capacity = capacity
+	t.grant()
+}
+
+func (t *prioritizedThrottler) Stats() Stats {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	return Stats{Capacity: t.capacity, InUse: t.used, Waiting: len(t.waiting)}
+}
+
+func (w *weightedThrottler) SetCapacity(capacity int64) {
+	w.t.SetCapacity(capacity)
+}
+
+func (w *weightedThrottler) Stats() Stats {
+	return w.t.Stats()
+}
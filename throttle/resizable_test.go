@@ -0,0 +1,71 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResizable(t *testing.T) {
+	tt := Prioritized(1, 0)
+
+	release, done := occupy(t, tt)
+
+	var wg sync.WaitGroup
+	order := make(chan Priority, 2)
+	park(t, tt, PriorityNormal, order, &wg)
+	park(t, tt, PriorityNormal, order, &wg)
+	require.Equal(t, Stats{Capacity: 1, InUse: 1, Waiting: 2}, tt.Stats())
+
+	// growing the throttler admits the parked actions.
+	tt.SetCapacity(3)
+	wg.Wait()
+	require.Equal(t, Stats{Capacity: 3, InUse: 1}, tt.Stats())
+
+	// shrinking it to what is in use admits nothing until usage drops.
+	tt.SetCapacity(1)
+	errCh := make(chan error)
+	go func() {
+		errCh <- tt.Do(context.Background(), func(ctx context.Context) error { return nil })
+	}()
+	require.Eventually(t, func() bool {
+		return tt.Stats().Waiting == 1
+	}, time.Second, time.Millisecond)
+
+	close(release)
+	require.NoError(t, <-done)
+	require.NoError(t, <-errCh)
+	require.Equal(t, Stats{Capacity: 1}, tt.Stats())
+}
+
+func TestResizableUnlimited(t *testing.T) {
+	tt := Weighted(0, 0)
+
+	// an unlimited throttler doesn't clamp nor block.
+	var wg sync.WaitGroup
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := tt.Do(context.Background(), 1<<40, func(ctx context.Context) error {
+				started <- struct{}{}
+				<-release
+				return nil
+			})
+			require.NoError(t, err)
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-started
+	}
+	require.Equal(t, Stats{InUse: 10 << 40}, tt.Stats())
+
+	close(release)
+	wg.Wait()
+	require.Zero(t, tt.Stats().InUse)
+}
@@ -0,0 +1,55 @@
+package throttle
+
+import (
+	"context"
+	"time"
+)
+
+// WeightedThrottler is a component to perform throttling of concurrent
+// requests by their total weight, such as the number of bytes they process,
+// instead of by their number.
+type WeightedThrottler interface {
+	// Do performs the supplied action under the guard of the throttler,
+	// once its weight fits in the capacity left by the actions in flight.
+	//
+	// Like Throttler#Do, the supplied context is obeyed when parking to
+	// claim capacity, and is passed to the action. Errors from the action are
+	// propagated to the caller, as are context deadline errors.
+	//
+	// Do blocks until the action has executed.
+	Do(ctx context.Context, weight int64, fn func(ctx context.Context) error) error
+}
+
+// Weighted creates a new throttler that allows actions to run concurrently as
+// long as their total weight doesn't exceed the capacity. Actions heavier
+// than the capacity run on their own.
+//
+// Parked actions claim capacity by priority, like with Prioritized, and an
+// action that doesn't fit blocks lighter actions with lower priority from
+// overtaking it, so that heavy actions aren't starved. An aging of 0 uses
+// DefaultAging.
+//
+// The capacity can be changed while in use through SetCapacity; a capacity
+// of 0 leaves the throttler unlimited.
+func Weighted(capacity int64, aging time.Duration) ResizableWeightedThrottler {
+	return &weightedThrottler{t: newPrioritized(capacity, aging)}
+}
+
+type weightedThrottler struct {
+	t *prioritizedThrottler
+}
+
+func (w *weightedThrottler) Do(ctx context.Context, weight int64, fn func(ctx context.Context) error) error {
+	return w.t.do(ctx, weight, fn)
+}
+
+// NoopWeighted returns a noop weighted throttler.
+func NoopWeighted() WeightedThrottler {
+	return noopWeighted{}
+}
+
+type noopWeighted struct{}
+
+func (noopWeighted) Do(ctx context.Context, _ int64, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
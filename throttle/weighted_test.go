@@ -0,0 +1,160 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeightedThrottler(t *testing.T) {
+	tt := Weighted(10, time.Hour)
+	pt := tt.(*weightedThrottler).t
+
+	var (
+		lk          sync.Mutex
+		active, max int64
+		wg          sync.WaitGroup
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(weight int64) {
+			defer wg.Done()
+			err := tt.Do(context.Background(), weight, func(ctx context.Context) error {
+				lk.Lock()
+				active += weight
+				if active > max {
+					max = active
+				}
+				lk.Unlock()
+
+				time.Sleep(5 * time.Millisecond)
+
+				lk.Lock()
+				active -= weight
+				lk.Unlock()
+				return nil
+			})
+			require.NoError(t, err)
+		}(int64(i%4 + 1))
+	}
+	wg.Wait()
+
+	require.LessOrEqual(t, max, int64(10))
+	require.Zero(t, pt.used)
+	require.Empty(t, pt.waiting)
+}
+
+func TestWeightedThrottlerHeavyNotStarved(t *testing.T) {
+	tt := Weighted(10, time.Hour)
+	pt := tt.(*weightedThrottler).t
+
+	// occupy part of the capacity.
+	release, done := make(chan struct{}), make(chan error)
+	go func() {
+		done <- tt.Do(context.Background(), 4, func(ctx context.Context) error {
+			<-release
+			return nil
+		})
+	}()
+	require.Eventually(t, func() bool {
+		pt.lk.Lock()
+		defer pt.lk.Unlock()
+		return pt.used == 4
+	}, time.Second, time.Millisecond)
+
+	// a heavy action that doesn't fit parks, and so does a light one that
+	// would fit, as it may not overtake the heavy one.
+	order := make(chan int64, 2)
+	var wg sync.WaitGroup
+	for i, weight := range []int64{10, 1} {
+		i, weight := i, weight
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := tt.Do(context.Background(), weight, func(ctx context.Context) error {
+				order <- weight
+				return nil
+			})
+			require.NoError(t, err)
+		}()
+		require.Eventually(t, func() bool {
+			pt.lk.Lock()
+			defer pt.lk.Unlock()
+			return len(pt.waiting) == i+1
+		}, time.Second, time.Millisecond)
+	}
+
+	require.Empty(t, order)
+
+	close(release)
+	require.NoError(t, <-done)
+	wg.Wait()
+	close(order)
+
+	require.Equal(t, int64(10), <-order)
+	require.Equal(t, int64(1), <-order)
+}
+
+func TestWeightedThrottlerPriorityOvertakes(t *testing.T) {
+	tt := Weighted(10, time.Hour)
+	pt := tt.(*weightedThrottler).t
+
+	// occupy part of the capacity.
+	release, done := make(chan struct{}), make(chan error)
+	go func() {
+		done <- tt.Do(context.Background(), 4, func(ctx context.Context) error {
+			<-release
+			return nil
+		})
+	}()
+	require.Eventually(t, func() bool {
+		pt.lk.Lock()
+		defer pt.lk.Unlock()
+		return pt.used == 4
+	}, time.Second, time.Millisecond)
+
+	// a heavy, low priority action parks.
+	heavy := make(chan error)
+	go func() {
+		heavy <- tt.Do(WithPriority(context.Background(), PriorityLow), 10, func(ctx context.Context) error {
+			return nil
+		})
+	}()
+	require.Eventually(t, func() bool {
+		pt.lk.Lock()
+		defer pt.lk.Unlock()
+		return len(pt.waiting) == 1
+	}, time.Second, time.Millisecond)
+
+	// a light, high priority action that fits runs right away, without
+	// waiting for a release.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := tt.Do(WithPriority(ctx, PriorityHigh), 1, func(ctx context.Context) error {
+		return nil
+	})
+	require.NoError(t, err)
+
+	close(release)
+	require.NoError(t, <-done)
+	require.NoError(t, <-heavy)
+}
+
+func TestWeightedThrottlerClampsWeight(t *testing.T) {
+	tt := Weighted(10, 0)
+
+	// actions heavier than the capacity run on their own, and actions with no
+	// weight still take a unit.
+	var ran int
+	for _, weight := range []int64{100, 0, -1} {
+		err := tt.Do(context.Background(), weight, func(ctx context.Context) error {
+			ran++
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, ran)
+}
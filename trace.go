@@ -0,0 +1,259 @@
+package dagstore
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// defaultTraceBuffer is the default number of traces buffered per subscriber.
+const defaultTraceBuffer = 128
+
+// TraceOverflowPolicy determines what happens to traces published to a
+// subscriber whose buffer is full.
+type TraceOverflowPolicy int
+
+const (
+	// TraceDropNewest drops the trace being published.
+	TraceDropNewest TraceOverflowPolicy = iota
+
+	// TraceDropOldest drops the oldest buffered trace to make room for the
+	// trace being published.
+	TraceDropOldest
+
+	// TraceCoalesce merges the trace being published into the latest
+	// buffered trace for the same shard, if any, so that subscribers still
+	// observe the latest state of every shard. The merged trace keeps the
+	// Before state of the buffered trace. If there is no buffered trace for
+	// the shard, the oldest buffered trace is dropped.
+	TraceCoalesce
+)
+
+// TraceFilter selects the traces delivered to a subscriber. Empty fields
+// match all traces; a trace is delivered if it matches all fields.
+type TraceFilter struct {
+	// Keys matches traces for any of the shards.
+	Keys []shard.Key
+	// Ops matches traces for any of the operations.
+	Ops []OpType
+	// From matches traces whose state before the operation was any of these.
+	From []ShardState
+	// To matches traces whose state after the operation is any of these.
+	To []ShardState
+	// TransitionsOnly matches only traces where the shard state changed.
+	TransitionsOnly bool
+}
+
+func (f *TraceFilter) matches(t *Trace) bool {
+	if f.TransitionsOnly && t.Before.ShardState == t.After.ShardState {
+		return false
+	}
+	if len(f.Keys) > 0 && !containsKey(f.Keys, t.Key) {
+		return false
+	}
+	if len(f.Ops) > 0 && !containsOp(f.Ops, t.Op) {
+		return false
+	}
+	if len(f.From) > 0 && !containsState(f.From, t.Before.ShardState) {
+		return false
+	}
+	if len(f.To) > 0 && !containsState(f.To, t.After.ShardState) {
+		return false
+	}
+	return true
+}
+
+func containsKey(ks []shard.Key, k shard.Key) bool {
+	for _, x := range ks {
+		if x == k {
+			return true
+		}
+	}
+	return false
+}
+
+func containsOp(ops []OpType, op OpType) bool {
+	for _, x := range ops {
+		if x == op {
+			return true
+		}
+	}
+	return false
+}
+
+func containsState(states []ShardState, s ShardState) bool {
+	for _, x := range states {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SubscribeOpts are the options for DAGStore.Subscribe.
+type SubscribeOpts struct {
+	// Buffer is the number of traces buffered for the subscriber. Defaults
+	// to 128.
+	Buffer int
+	// Overflow is the policy applied when the buffer is full. Defaults to
+	// TraceDropNewest.
+	Overflow TraceOverflowPolicy
+}
+
+// Subscription is a subscription to shard operation traces. Traces are
+// buffered per subscriber, so slow subscribers never block the DAG store;
+// when the buffer is full, the overflow policy applies.
+type Subscription struct {
+	// C delivers the traces. It is closed when the subscription is cancelled,
+	// or the DAG store is closed.
+	C <-chan Trace
+
+	d       *DAGStore
+	filter  TraceFilter
+	opts    SubscribeOpts
+	dropped uint64 // guarded by atomic.
+
+	lk     sync.Mutex
+	queue  []Trace       // guarded by lk.
+	notify chan struct{} // len=1; signals that the queue is non-empty.
+
+	out      chan Trace
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// Subscribe subscribes to traces of shard operations that match the filter.
+// Unlike Config.TraceCh, subscribers never block the event loop. The
+// subscription must be cancelled when no longer needed.
+func (d *DAGStore) Subscribe(filter TraceFilter, opts SubscribeOpts) (*Subscription, error) {
+	sub := newSubscription(d, filter, opts)
+
+	d.subsLk.Lock()
+	defer d.subsLk.Unlock()
+	if d.ctx.Err() != nil {
+		return nil, ErrDAGStoreClosed
+	}
+	d.subs[sub] = struct{}{}
+
+	d.wg.Add(1)
+	go sub.pump()
+
+	return sub, nil
+}
+
+func newSubscription(d *DAGStore, filter TraceFilter, opts SubscribeOpts) *Subscription {
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultTraceBuffer
+	}
+
+	out := make(chan Trace)
+	return &Subscription{
+		C:      out,
+		d:      d,
+		filter: filter,
+		opts:   opts,
+		notify: make(chan struct{}, 1),
+		out:    out,
+		done:   make(chan struct{}),
+	}
+}
+
+// Dropped returns the number of traces that were dropped or coalesced
+// because the subscriber's buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Cancel cancels the subscription, and closes C. Buffered traces are
+// discarded.
+func (s *Subscription) Cancel() {
+	s.d.subsLk.Lock()
+	delete(s.d.subs, s)
+	s.d.subsLk.Unlock()
+
+	s.doneOnce.Do(func() { close(s.done) })
+}
+
+// publish buffers the trace for the subscriber, if it matches the filter,
+// applying the overflow policy if the buffer is full. It never blocks.
+func (s *Subscription) publish(t Trace) {
+	if !s.filter.matches(&t) {
+		return
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if len(s.queue) >= s.opts.Buffer {
+		atomic.AddUint64(&s.dropped, 1)
+		s.d.metrics.traceDropped.Inc()
+
+		switch s.opts.Overflow {
+		case TraceDropNewest:
+			return
+		case TraceCoalesce:
+			for i := len(s.queue) - 1; i >= 0; i-- {
+				if s.queue[i].Key == t.Key {
+					t.Before = s.queue[i].Before
+					s.queue[i] = t
+					return
+				}
+			}
+		}
+		// TraceDropOldest, or coalescing with no buffered trace for the shard.
+		s.queue = append(s.queue[:0], s.queue[1:]...)
+	}
+	s.queue = append(s.queue, t)
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pump delivers buffered traces to the subscriber until the subscription is
+// cancelled or the DAG store is closed.
+func (s *Subscription) pump() {
+	defer s.d.wg.Done()
+	defer close(s.out)
+
+	for {
+		select {
+		case <-s.notify:
+		case <-s.done:
+			return
+		case <-s.d.ctx.Done():
+			return
+		}
+
+		for {
+			s.lk.Lock()
+			if len(s.queue) == 0 {
+				s.lk.Unlock()
+				break
+			}
+			t := s.queue[0]
+			s.queue = s.queue[1:]
+			s.lk.Unlock()
+
+			select {
+			case s.out <- t:
+			case <-s.done:
+				return
+			case <-s.d.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// publishTrace publishes the trace to all subscribers.
+func (d *DAGStore) publishTrace(t Trace) {
+	d.subsLk.RLock()
+	defer d.subsLk.RUnlock()
+
+	for sub := range d.subs {
+		sub.publish(t)
+	}
+}
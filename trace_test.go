@@ -0,0 +1,176 @@
+package dagstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+func TestSubscribeDoesNotBlock(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// a subscriber that never consumes.
+	sub, err := dagst.Subscribe(TraceFilter{}, SubscribeOpts{Buffer: 2})
+	require.NoError(t, err)
+
+	// registration completes regardless; each registration produces three
+	// traces.
+	registerShards(t, dagst, 4, carv2mnt, RegisterOpts{})
+
+	// 2 traces are buffered, and 1 is held for delivery.
+	require.Eventually(t, func() bool {
+		return sub.Dropped() == 12-3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the oldest traces are delivered.
+	tr := <-sub.C
+	require.Equal(t, OpShardRegister, tr.Op)
+
+	sub.Cancel()
+	for range sub.C {
+		// drain until closed.
+	}
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	a, b := shard.KeyFromString("a"), shard.KeyFromString("b")
+	sub, err := dagst.Subscribe(TraceFilter{
+		Keys:            []shard.Key{a},
+		To:              []ShardState{ShardStateAvailable},
+		TransitionsOnly: true,
+	}, SubscribeOpts{})
+	require.NoError(t, err)
+	defer sub.Cancel()
+
+	for _, k := range []shard.Key{a, b} {
+		ch := make(chan ShardResult, 1)
+		err = dagst.RegisterShard(context.Background(), k, carv2mnt, ch, RegisterOpts{})
+		require.NoError(t, err)
+		require.NoError(t, (<-ch).Error)
+	}
+
+	// acquiring and releasing a only produces a transition to available on
+	// release.
+	releaseAll(t, dagst, a, acquireShard(t, dagst, a, 1))
+
+	expected := []struct {
+		op     OpType
+		before ShardState
+	}{
+		{OpShardMakeAvailable, ShardStateInitializing},
+		{OpShardRelease, ShardStateServing},
+	}
+	for _, e := range expected {
+		select {
+		case tr := <-sub.C:
+			require.Equal(t, a, tr.Key)
+			require.Equal(t, e.op, tr.Op)
+			require.Equal(t, e.before, tr.Before.ShardState)
+			require.Equal(t, ShardStateAvailable, tr.After.ShardState)
+			require.False(t, tr.Time.IsZero())
+			require.Greater(t, int64(tr.Duration), int64(0))
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for trace")
+		}
+	}
+
+	select {
+	case tr := <-sub.C:
+		t.Fatalf("unexpected trace: %+v", tr)
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.Zero(t, sub.Dropped())
+}
+
+func TestSubscribeOverflowPolicies(t *testing.T) {
+	dagst, err := NewDAGStore(Config{TransientsDir: t.TempDir()})
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	a, b := shard.KeyFromString("a"), shard.KeyFromString("b")
+	traces := []Trace{
+		{Key: a, Op: OpShardRegister, Before: ShardInfo{ShardState: ShardStateNew}, After: ShardInfo{ShardState: ShardStateNew}},
+		{Key: b, Op: OpShardRegister, Before: ShardInfo{ShardState: ShardStateNew}, After: ShardInfo{ShardState: ShardStateNew}},
+		{Key: a, Op: OpShardInitialize, Before: ShardInfo{ShardState: ShardStateNew}, After: ShardInfo{ShardState: ShardStateInitializing}},
+		{Key: a, Op: OpShardMakeAvailable, Before: ShardInfo{ShardState: ShardStateInitializing}, After: ShardInfo{ShardState: ShardStateAvailable}},
+	}
+
+	// drain receives n traces from the subscription.
+	drain := func(sub *Subscription, n int) []Trace {
+		ret := make([]Trace, n)
+		for i := range ret {
+			select {
+			case ret[i] = <-sub.C:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for trace")
+			}
+		}
+		return ret
+	}
+
+	testCases := []struct {
+		policy   TraceOverflowPolicy
+		expected []Trace
+	}{
+		{TraceDropNewest, traces[:2]},
+		{TraceDropOldest, traces[2:]},
+		{TraceCoalesce, []Trace{
+			// a's traces are coalesced in place.
+			{Key: a, Op: OpShardMakeAvailable, Before: ShardInfo{ShardState: ShardStateNew}, After: ShardInfo{ShardState: ShardStateAvailable}},
+			traces[1],
+		}},
+	}
+
+	for _, tc := range testCases {
+		// publish all traces before starting the pump, so that they're all
+		// buffered.
+		sub := newSubscription(dagst, TraceFilter{}, SubscribeOpts{Buffer: 2, Overflow: tc.policy})
+		for _, tr := range traces {
+			sub.publish(tr)
+		}
+		require.EqualValues(t, 2, sub.Dropped())
+
+		dagst.wg.Add(1)
+		go sub.pump()
+		require.Equal(t, tc.expected, drain(sub, 2))
+		sub.Cancel()
+	}
+}
+
+func TestSubscribeClosed(t *testing.T) {
+	dagst, err := NewDAGStore(Config{TransientsDir: t.TempDir()})
+	require.NoError(t, err)
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	sub, err := dagst.Subscribe(TraceFilter{}, SubscribeOpts{})
+	require.NoError(t, err)
+
+	// closing the DAG store closes subscriptions.
+	require.NoError(t, dagst.Close())
+	_, ok := <-sub.C
+	require.False(t, ok)
+
+	_, err = dagst.Subscribe(TraceFilter{}, SubscribeOpts{})
+	require.ErrorIs(t, err, ErrDAGStoreClosed)
+}